@@ -0,0 +1,145 @@
+package analysis
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+	"github.com/CG4002-AY2021S2-B16/comms-int/logging"
+)
+
+var log = logging.For("analysis")
+
+// Onset is the time at which a dancer was detected to begin a move
+type Onset struct {
+	BlunoNum  uint8  `json:"num"`
+	User      string `json:"user"`
+	Timestamp int64  `json:"unix_timestamp_milliseconds"`
+}
+
+// SyncDelay is emitted each time all active dancers have begun a move
+type SyncDelay struct {
+	DelayMs   int64   `json:"delay_ms"` // Spread between the earliest and latest onset
+	Timestamp int64   `json:"unix_timestamp_milliseconds"`
+	Onsets    []Onset `json:"onsets"`
+}
+
+// dancerState tracks the motion energy of a single dancer
+type dancerState struct {
+	baseline   float64 // Slow moving average of the IMU magnitude, i.e. the magnitude at rest
+	energy     float64 // Fast moving average of the deviation from baseline
+	init       bool
+	moving     bool
+	quietSince int64
+	lastSeen   time.Time
+}
+
+// SyncAnalyzer detects each dancer's move onset from their IMU stream, and computes
+// the spread in onset times between dancers
+type SyncAnalyzer struct {
+	sync.Mutex
+	cfg     *config.Analysis
+	users   map[uint8]string
+	dancers map[string]*dancerState
+	onsets  map[string]Onset
+	emit    func(SyncDelay)
+}
+
+// CreateSyncAnalyzer initializes and returns an analyzer given a mapping of bluno numbers to users,
+// which invokes emit every time all active dancers begin a move. emit is called inline, so it must not block.
+func CreateSyncAnalyzer(cfg *config.Analysis, users map[uint8]string, emit func(SyncDelay)) *SyncAnalyzer {
+	return &SyncAnalyzer{
+		cfg:     cfg,
+		users:   users,
+		dancers: make(map[string]*dancerState),
+		onsets:  make(map[string]Onset),
+		emit:    emit,
+	}
+}
+
+// Observe takes in an outgoing packet and updates the motion energy of its dancer.
+// Packets that do not carry IMU readings are ignored.
+func (s *SyncAnalyzer) Observe(p commsintconfig.Packet) {
+	if p.Type != commsintconfig.Data || p.MuscleSensor {
+		return
+	}
+	user, ok := s.users[p.BlunoNumber]
+	if !ok {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	d, ok := s.dancers[user]
+	if !ok {
+		d = &dancerState{}
+		s.dancers[user] = d
+	}
+	d.lastSeen = time.Now()
+
+	mag := math.Sqrt(float64(p.X)*float64(p.X) + float64(p.Y)*float64(p.Y) + float64(p.Z)*float64(p.Z))
+	if !d.init {
+		d.baseline = mag
+		d.quietSince = p.Timestamp
+		d.init = true
+		return
+	}
+
+	d.energy += s.cfg.MotionEnergySmoothing * (math.Abs(mag-d.baseline) - d.energy)
+	if !d.moving {
+		d.baseline += s.cfg.MotionBaselineSmoothing * (mag - d.baseline)
+	}
+
+	if d.moving {
+		// Hysteresis to avoid chattering around the threshold
+		if d.energy < s.cfg.OnsetEnergyThreshold/2 {
+			d.moving = false
+			d.quietSince = p.Timestamp
+		}
+	} else if d.energy >= s.cfg.OnsetEnergyThreshold {
+		d.moving = true
+		if p.Timestamp-d.quietSince >= s.cfg.OnsetQuietPeriod.Milliseconds() {
+			s.recordOnset(Onset{BlunoNum: p.BlunoNumber, User: user, Timestamp: p.Timestamp})
+		}
+	}
+}
+
+// recordOnset stores a dancer's onset, and emits a sync delay once every active dancer has an onset within the onset window
+func (s *SyncAnalyzer) recordOnset(o Onset) {
+	log.Debug("onset", "user", o.User, "bluno", o.BlunoNum, "t", o.Timestamp)
+	s.onsets[o.User] = o
+
+	// Discard onsets which belong to an earlier move
+	for u, prev := range s.onsets {
+		if o.Timestamp-prev.Timestamp > s.cfg.OnsetWindow.Milliseconds() {
+			delete(s.onsets, u)
+		}
+	}
+
+	var ready []Onset
+	for u, d := range s.dancers {
+		if time.Since(d.lastSeen) > s.cfg.DancerActiveTimeout {
+			continue
+		}
+		on, ok := s.onsets[u]
+		if !ok {
+			return
+		}
+		ready = append(ready, on)
+	}
+	if len(ready) < 2 {
+		return // A spread cannot be computed for a single dancer
+	}
+
+	sd := SyncDelay{Timestamp: o.Timestamp, Onsets: ready}
+	sort.Slice(sd.Onsets, func(i, j int) bool { return sd.Onsets[i].Timestamp < sd.Onsets[j].Timestamp })
+	sd.DelayMs = sd.Onsets[len(sd.Onsets)-1].Timestamp - sd.Onsets[0].Timestamp
+	s.onsets = make(map[string]Onset)
+
+	log.Info("sync_delay", "delay_ms", sd.DelayMs, "dancers", len(sd.Onsets))
+	s.emit(sd)
+}
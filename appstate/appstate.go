@@ -2,33 +2,50 @@ package appstate
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"encoding/json"
+	"io/ioutil"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
-	"github.com/CG4002-AY2021S2-B16/comms-int/constants"
-	"github.com/fatih/color"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+	"github.com/CG4002-AY2021S2-B16/comms-int/logging"
 	"github.com/go-ble/ble"
 )
 
+var log = logging.For("appstate")
+
+// StatusSource is where the status of a bluno, and its transitions, are kept, see bluno.StateMachine
+type StatusSource interface {
+	Report() commsintconfig.StatusReport
+	Drain() ([]commsintconfig.StatusTransition, uint64)
+	Updated() <-chan struct{}
+}
+
 // BlunoState keeps track of currently running blunos
 type BlunoState struct {
 	sync.RWMutex
-	Name       string
-	Address    string
-	Status     commsintconfig.BlunoStatus
-	UpdateChan chan commsintconfig.BlunoStatus
+	Name           string
+	Address        string
+	States         StatusSource
+	Link           *commsintconfig.LinkTelemetry // Telemetry of the current or last connection, nil if never connected
+	Health         *commsintconfig.HealthReport  // Health as of the last connection that ended, nil if none has
+	LinkUpdateChan chan commsintconfig.LinkTelemetry
+
+	HealthUpdateChan chan commsintconfig.HealthReport
+	OnTransition     func(commsintconfig.StatusTransition) // Called whenever the status changes, if set
 }
 
 // CreateBlunoState creates and returns a pointer to a BlunoState
-func CreateBlunoState(n string, addr string) *BlunoState {
+func CreateBlunoState(n string, addr string, states StatusSource) *BlunoState {
 	return &BlunoState{
-		Name:       n,
-		Address:    addr,
-		Status:     commsintconfig.NotConnected,
-		UpdateChan: make(chan commsintconfig.BlunoStatus, 1),
+		Name:           n,
+		Address:        addr,
+		States:         states,
+		LinkUpdateChan: make(chan commsintconfig.LinkTelemetry, 1),
+
+		HealthUpdateChan: make(chan commsintconfig.HealthReport, 1),
 	}
 }
 
@@ -36,9 +53,21 @@ func CreateBlunoState(n string, addr string) *BlunoState {
 func (b *BlunoState) UpdateBlunoStatus(ctx context.Context) {
 	for {
 		select {
-		case u := <-b.UpdateChan:
+		case <-b.States.Updated():
+			transitions, dropped := b.States.Drain()
+			if dropped > 0 {
+				log.Warn("bluno_transitions_dropped", "name", b.Name, "dropped", dropped)
+			}
+			for _, t := range transitions {
+				b.transition(t)
+			}
+		case l := <-b.LinkUpdateChan:
+			b.Lock()
+			b.Link = &l
+			b.Unlock()
+		case h := <-b.HealthUpdateChan:
 			b.Lock()
-			b.Status = u
+			b.Health = &h
 			b.Unlock()
 		case <-ctx.Done():
 			return
@@ -47,11 +76,17 @@ func (b *BlunoState) UpdateBlunoStatus(ctx context.Context) {
 	}
 }
 
+// transition logs a change in the status of the bluno, and hands it to OnTransition
+func (b *BlunoState) transition(t commsintconfig.StatusTransition) {
+	log.Info("bluno_transition", "name", b.Name, "bluno", t.Bluno, "from", t.From, "to", t.To, "reason", t.Reason, "after", t.Duration)
+	if b.OnTransition != nil {
+		b.OnTransition(t)
+	}
+}
+
 // FetchBlunoStatus is to be run sychronously by a status printing goroutine
 func (b *BlunoState) FetchBlunoStatus() commsintconfig.BlunoStatus {
-	b.RLock()
-	defer b.RUnlock()
-	return b.Status
+	return b.States.Report().Status
 }
 
 // AppState keeps track of the currently running application's state
@@ -61,46 +96,144 @@ type AppState struct {
 	MasterCtx       context.Context
 	MasterCtxCancel context.CancelFunc
 	BlunoStates     []*BlunoState
+	Config          *config.Config
+	DialQueue       func() commsintconfig.DialQueue // Connection attempts of the blunos, nil if they are not connected to
 }
 
 // CreateAppState creates and returns a new app state, with a default state of waiting
-func CreateAppState(pCtx context.Context) *AppState {
+func CreateAppState(pCtx context.Context, cfg *config.Config) *AppState {
 	ctx, cancel := context.WithCancel(pCtx)
 	return &AppState{
 		S:               commsintconfig.Waiting,
 		MasterCtx:       ble.WithSigHandler(ctx, cancel),
 		MasterCtxCancel: cancel,
 		BlunoStates:     make([]*BlunoState, 0),
+		Config:          cfg,
 	}
 }
 
-// MonitorBlunos is a permanently running goroutine that prints
-func (a *AppState) MonitorBlunos() {
-	ticker := time.NewTicker(constants.BlunoStatusCheckFreq)
+// Status is a snapshot of the app's state, written to the status file for the status command
+type Status struct {
+	Session   string        `json:"session"`
+	State     string        `json:"state"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	Blunos    []BlunoReport `json:"blunos"`
+
+	DialQueue *commsintconfig.DialQueue `json:"dial_queue,omitempty"`
+}
+
+// FetchLink returns the telemetry of the bluno's current or last connection, or nil if it has never connected
+func (b *BlunoState) FetchLink() *commsintconfig.LinkTelemetry {
+	b.RLock()
+	defer b.RUnlock()
+	return b.Link
+}
+
+// FetchHealth returns the bluno's latest health report, or nil if none has been made
+func (b *BlunoState) FetchHealth() *commsintconfig.HealthReport {
+	b.RLock()
+	defer b.RUnlock()
+	return b.Health
+}
+
+// BlunoReport is the status of a single bluno within a Status
+type BlunoReport struct {
+	Name    string                        `json:"name"`
+	Address string                        `json:"address"`
+	Status  string                        `json:"status"`
+	State   commsintconfig.StatusReport   `json:"state"`
+	Link    *commsintconfig.LinkTelemetry `json:"link,omitempty"`
+	Health  *commsintconfig.HealthReport  `json:"health,omitempty"`
+}
+
+// Snapshot returns the current status of the app and every bluno
+func (a *AppState) Snapshot() Status {
+	s := Status{
+		Session:   commsintconfig.SessionID,
+		State:     a.GetState().String(),
+		UpdatedAt: time.Now(),
+		Blunos:    make([]BlunoReport, 0, len(a.BlunoStates)),
+	}
+	for _, b := range a.BlunoStates {
+		st := b.States.Report()
+		s.Blunos = append(s.Blunos, BlunoReport{
+			Name:    b.Name,
+			Address: b.Address,
+			Status:  st.Status.String(),
+			State:   st,
+			Link:    b.FetchLink(),
+			Health:  b.FetchHealth(),
+		})
+	}
+	if a.DialQueue != nil {
+		q := a.DialQueue()
+		s.DialQueue = &q
+	}
+	return s
+}
+
+// WriteStatus atomically replaces the status file with a snapshot of the app's state
+func (a *AppState) WriteStatus(path string) error {
+	b, err := json.MarshalIndent(a.Snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
 
-	red := color.New(color.FgRed).SprintFunc()
-	yellow := color.New(color.FgYellow).SprintFunc()
-	green := color.New(color.FgGreen).SprintFunc()
+// ReadStatus reads the status file written by a running app
+func ReadStatus(path string) (Status, error) {
+	var s Status
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(b, &s)
+	return s, err
+}
+
+// MonitorBlunos is a permanently running goroutine that periodically logs the status of every bluno,
+// and writes it to the status file if one is configured
+// Blunos that are not streaming are logged as warnings.
+func (a *AppState) MonitorBlunos() {
+	ticker := time.NewTicker(a.Config.Status.Interval)
 
 	for {
 		select {
 		case <-ticker.C:
-			log.Println("---- BLUNO STATUS REPORT ----")
-
 			for _, b := range a.BlunoStates {
 				stat := b.FetchBlunoStatus()
+				l := log.With("name", b.Name, "addr", b.Address, "status", stat)
+				if link := b.FetchLink(); link != nil && stat != commsintconfig.Disconnected {
+					l = l.With("rssi", link.RSSI, "rssi_mean", link.RSSIMean, "conn_interval", link.Interval)
+				}
+				if h := b.FetchHealth(); h != nil {
+					l = l.With("health", h.Score)
+				}
 
 				switch stat {
-				case commsintconfig.NotConnected:
-					fmt.Printf("%s [%s] is currently %s, retrying...\n", b.Address, b.Name, red("not connected"))
-				case commsintconfig.NotHandshaked:
-					fmt.Printf("%s [%s] is connected, %s...\n", b.Address, b.Name, yellow("attempting handshake"))
+				case commsintconfig.Streaming:
+					l.Info("bluno_status")
 				default:
-					fmt.Printf("%s [%s] is connected and is %s \n", b.Address, b.Name, green("transmitting packets"))
+					l.Warn("bluno_status")
+				}
+			}
+
+			if a.DialQueue != nil {
+				if q := a.DialQueue(); len(q.Waiting) > 0 {
+					log.Debug("dial_queue", "dialing", len(q.Dialing), "waiting", len(q.Waiting), "next", q.Waiting[0].Address)
 				}
 			}
 
-			log.Println("---- END OF BLUNO STATUS REPORT ----")
+			if a.Config.Status.File != "" {
+				if err := a.WriteStatus(a.Config.Status.File); err != nil {
+					log.Warn("write_status", "path", a.Config.Status.File, "err", err)
+				}
+			}
 		}
 	}
 
@@ -12,8 +12,22 @@
 #define DESIGNATE_ACK_PACKET_MASK 0xF3  // 0b1111 0011, To be ANDed with
 #define DESIGNATE_LIVENESS_PACKET_MASK 0x04 // To be ORed with
 
+// Packet revisions, in the upper 4 bits of the last byte before the checksum
+#define SEQUENCED_REVISION 0x10 // Data packets carry a sequence number in place of the muscle sensor reading
+#define TIME_SYNC_REVISION 0x30 // Time sync acks carry the id of the request in place of the muscle sensor reading
+
 // Handshake constants
 #define HANDSHAKE_INIT 'A'
+#define HANDSHAKE_BATCH 'B' // Follows HANDSHAKE_INIT, along with the most samples the laptop accepts in a batch
+#define TIME_SYNC_REQ 'T' // Asks for the current sensor time after the handshake, followed by the id of the request, replied to with an ack
+
+// Batch specification
+// A batch holds a header (count, timestamp, sequence number and IMU data of the first sample) encrypted like a packet,
+// followed by the change in time and IMU data of every further sample, and a checksum
+#define BATCH_HEADER_SIZE 18
+#define BATCH_DELTA_SIZE 7
+#define MAX_BATCH_SAMPLES 24 // Fits within the payload of a 185 byte MTU
+#define BATCH_REVISION 0x20 // Set on the ack to agree to sending batches
 
 // Liveness constants
 #define LIVENESS_TIMEOUT 800 // Just below half of receiver-side timeout, so that 2 attempts can be made before reconnection happens
@@ -34,6 +48,8 @@ const byte AESKeyStageTwo[AES_BLOCK_SIZE] = {0x7A, 0x24, 0x43, 0x26, 0x46, 0x29,
 // Define global variables
 uint8_t receivedChar;
 boolean new_handshake_req = false;
+boolean new_time_sync_req = false;
+uint8_t time_sync_id = 0;
 boolean handshake_done = false;
 
 // Time
@@ -43,6 +59,17 @@ uint32_t last_packet_sent_at = millis();
 // Buffer used to write to bluetooth
 uint8_t sendBuffer[PACKET_SIZE];
 
+// Sequence number of the next data sample, whether sent in a packet or a batch, restarted on every handshake
+uint8_t sample_seq = 0;
+
+// Batching, agreed upon during the handshake
+uint8_t batch_max_samples = 0; // 0 when the laptop did not ask for batches
+uint8_t requested_batch_samples = 0;
+uint8_t batch_samples = 0;
+uint32_t batch_last_timestamp = 0;
+int16_t batch_last_imu[6];
+uint8_t batchBuffer[BATCH_HEADER_SIZE + (MAX_BATCH_SAMPLES - 1) * BATCH_DELTA_SIZE + 1];
+
 
 /* ---------------------------------
  * TIME FUNCTIONS
@@ -181,6 +208,16 @@ uint8_t* addMuscleSensorDataToBuffer(uint8_t* next, uint16_t ms_val) {
 }
 
 
+// addSequenceToBuffer writes the sequence number of a data packet in place of the deprecated muscle sensor reading,
+// and marks the packet as sequenced
+// returns the partially filled byte, to which the packet type is added
+uint8_t* addSequenceToBuffer(uint8_t* next) {
+  next[0] = sample_seq++;
+  next[1] = SEQUENCED_REVISION;
+  return next + 1;
+}
+
+
 // setIMUPacketTypeToBuffer adds 2-bit packet type data to the buffer to designate as IMU data packet
 uint8_t* setIMUPacketTypeToBuffer(uint8_t* next) {
   next[0] |= DESIGNATE_IMU_PACKET_MASK;
@@ -196,8 +233,12 @@ uint8_t* setEMGPacketTypeToBuffer(uint8_t* next) {
 
 
 // setAckPacketTypeToBuffer adds 2-bit packet type data to the buffer to designate as ack packet
+// The revision is set if batches were agreed upon
 uint8_t* setAckPacketTypeToBuffer(uint8_t* next) {
   next[0] &= DESIGNATE_ACK_PACKET_MASK;
+  if (batch_max_samples > 1) {
+    next[0] |= BATCH_REVISION;
+  }
   return next + 1;
 }
 
@@ -217,6 +258,11 @@ uint8_t* setLivenessPacketTypeToBuffer(uint8_t* next) {
 
 // handshakeResponse prepares the buffer to respond to an incoming handshake request
 void handshakeResponse() {
+  // Agree to batches of at most the requested number of samples, starting afresh
+  batch_max_samples = min(requested_batch_samples, MAX_BATCH_SAMPLES);
+  batch_samples = 0;
+  sample_seq = 0;
+
   // Pre-process
   clearSendBuffer();
   uint8_t* buf = sendBuffer;
@@ -240,6 +286,34 @@ void handshakeResponse() {
 }
 
 
+// timeSyncResponse replies to a time sync request with an ack carrying the current sensor time,
+// so that the laptop can estimate the drift of the sensor clock
+// The id of the request is echoed, so that the laptop never pairs a late reply with a later request.
+void timeSyncResponse() {
+  // Pre-process
+  clearSendBuffer();
+  uint8_t* buf = sendBuffer;
+
+  // Fill different sections of the buffer
+  buf = addLongToBuffer(buf, calculateTimestamp());
+  buf = addIMUDataToBuffer(buf, 0, -0, 32767, -32768, 100, -100); // Arbitrary values to verify signed transmission integrity
+
+  buf[0] = time_sync_id;
+  buf[1] = TIME_SYNC_REVISION;
+  buf = setAckPacketTypeToBuffer(buf + 1);
+
+  // Perform encryption
+  encryptAES(sendBuffer);
+
+  // Calculate and fill in checksum
+  setChecksum();
+
+  // Send response out
+  Serial.write(sendBuffer, PACKET_SIZE);
+  updateLastPacketSent();
+}
+
+
 // livenessResponse prepares the buffer to send out a liveness packet, so that the receiver can be aware of the Bluno's connection
 void livenessResponse() {
   // Pre-process
@@ -279,7 +353,7 @@ void EMGdataResponse(float MAV, float RMS, float MNF) {
   buf = addLongToBuffer(buf, calculateTimestamp());
   buf = addEMGDataToBuffer(buf, MAV, RMS, MNF);
 
-  uint8_t* partial = addMuscleSensorDataToBuffer(buf, MUSCLE_SENSOR_INVALID_VAL); // TO BE DEPRECATED
+  uint8_t* partial = addSequenceToBuffer(buf);
   buf = setEMGPacketTypeToBuffer(partial);
 
   // Perform encryption
@@ -307,7 +381,7 @@ void IMUdataResponse(int16_t x, int16_t y, int16_t z, int16_t pitch, int16_t rol
   buf = addLongToBuffer(buf, calculateTimestamp());
   buf = addIMUDataToBuffer(buf, x, y, z, pitch, roll, yaw);
 
-  uint8_t* partial = addMuscleSensorDataToBuffer(buf, MUSCLE_SENSOR_INVALID_VAL); // TO BE DEPRECATED
+  uint8_t* partial = addSequenceToBuffer(buf);
   buf = setIMUPacketTypeToBuffer(partial);
 
   // Perform encryption
@@ -322,14 +396,98 @@ void IMUdataResponse(int16_t x, int16_t y, int16_t z, int16_t pitch, int16_t rol
 }
 
 
+/* ---------------------------------
+ *  BATCH FUNCTIONS
+ * ---------------------------------
+ */
+
+// sendBatch sends out the samples added to the batch so far
+void sendBatch() {
+  if (batch_samples == 0) {
+    return;
+  }
+  batchBuffer[0] = batch_samples;
+  encryptAES(batchBuffer);
+
+  uint8_t size = BATCH_HEADER_SIZE + (batch_samples - 1) * BATCH_DELTA_SIZE + 1;
+  uint8_t checksum_val = 0;
+  for (int i = 0; i < size - 1; i++) {
+    checksum_val ^= batchBuffer[i];
+  }
+  batchBuffer[size - 1] = checksum_val;
+
+  Serial.write(batchBuffer, size);
+  updateLastPacketSent();
+  sample_seq += batch_samples;
+  batch_samples = 0;
+}
+
+
+// IMUbatchResponse adds a sample to the batch, sending the batch out once it is full
+// A sample that cannot be given relative to the one before it starts a new batch.
+void IMUbatchResponse(int16_t x, int16_t y, int16_t z, int16_t pitch, int16_t roll, int16_t yaw) {
+  int16_t imu[6] = {x, y, z, pitch, roll, yaw};
+  uint32_t timestamp = calculateTimestamp();
+
+  bool fits = batch_samples > 0 && timestamp - batch_last_timestamp <= 0xFF;
+  for (int i = 0; fits && i < 6; i++) {
+    int32_t delta = (int32_t)imu[i] - batch_last_imu[i];
+    fits = delta >= -128 && delta <= 127;
+  }
+
+  if (batch_samples > 0 && !fits) {
+    sendBatch();
+  }
+
+  if (batch_samples == 0) {
+    uint8_t* buf = batchBuffer + 1;
+    buf = addLongToBuffer(buf, timestamp);
+    buf[0] = sample_seq;
+    addIMUDataToBuffer(buf + 1, x, y, z, pitch, roll, yaw);
+  } else {
+    uint8_t* buf = batchBuffer + BATCH_HEADER_SIZE + (batch_samples - 1) * BATCH_DELTA_SIZE;
+    buf[0] = timestamp - batch_last_timestamp;
+    for (int i = 0; i < 6; i++) {
+      buf[1 + i] = (int8_t)(imu[i] - batch_last_imu[i]);
+    }
+  }
+
+  batch_samples++;
+  batch_last_timestamp = timestamp;
+  memcpy(batch_last_imu, imu, sizeof(imu));
+  if (batch_samples >= batch_max_samples) {
+    sendBatch();
+  }
+}
+
+
 void receiveData() {
   new_handshake_req = false;
+  new_time_sync_req = false;
   
   while (Serial.available() > 0) {
       receivedChar = Serial.read();
+
+      if (receivedChar == TIME_SYNC_REQ) {
+        new_time_sync_req = true;
+
+        // The id arrives along with the request, and is below every request symbol should it be read on its own
+        if (Serial.available() > 0) {
+          time_sync_id = Serial.read();
+        }
+        continue;
+      }
       
       if (receivedChar == HANDSHAKE_INIT) {
         new_handshake_req = true;
+        requested_batch_samples = 0;
+
+        // The batch request, if any, arrives along with the handshake
+        delay(5);
+        if (Serial.available() >= 2 && Serial.peek() == HANDSHAKE_BATCH) {
+          Serial.read();
+          requested_batch_samples = Serial.read();
+        }
         break;
       }
   }
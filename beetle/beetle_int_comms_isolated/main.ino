@@ -42,12 +42,20 @@ void loop(){
     delay(300);
   } 
   else if (handshake_done) {
+    if (new_time_sync_req) {
+      timeSyncResponse(); // Reply straight away, since the round trip time bounds the accuracy of the estimate
+    }
+
     if (checkLivenessPacketRequired()) {
+      sendBatch(); // Flush any samples held back before falling back to liveness packets
       livenessResponse();
       delay(7);
     } else if (EMG_SENSOR_MODE) {
       EMGdataResponse(0.00, dummy_f_val, neg_dummy_f_val);
       delay(128); // There should not be a delay on integrated code, because delay comes exclusively from EMG sampling
+    } else if (batch_max_samples > 1) {
+      IMUbatchResponse(0, -0, dummy_val, neg_dummy_val, dummy_val + neg_dummy_val, -500);
+      delay(7);
     } else {
       IMUdataResponse(0, -0, dummy_val, neg_dummy_val, dummy_val + neg_dummy_val, -500);
       delay(7);
@@ -0,0 +1,133 @@
+package bluno
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/linux"
+)
+
+// Adapter is an HCI controller through which blunos are connected
+// Only one connection can be established at a time safely through a single controller, so the Scheduler
+// gives each adapter a single turn at a time, while blunos on different adapters are connected concurrently.
+type Adapter struct {
+	Name           string
+	Device         *linux.Device
+	LinkController LinkController
+	assigned       int // Blunos connecting or connected through the adapter
+}
+
+// OpenAdapter opens the HCI adapter with the given name, e.g. hci1
+func OpenAdapter(name string) (*Adapter, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(name, "hci"))
+	if err != nil || !strings.HasPrefix(name, "hci") {
+		return nil, fmt.Errorf("%q is not an HCI adapter such as hci0", name)
+	}
+	d, err := linux.NewDevice(ble.OptDeviceID(id))
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", name, err)
+	}
+
+	return &Adapter{
+		Name:           name,
+		Device:         d,
+		LinkController: HCILinkController(d.HCI),
+	}, nil
+}
+
+// Adapters assigns blunos to the HCI adapters they are connected through
+// A bluno is either always connected through the adapter configured for it, or through whichever adapter
+// has the fewest blunos assigned when it (re)connects.
+type Adapters struct {
+	sync.Mutex
+	list      []*Adapter
+	Scheduler *Scheduler
+}
+
+// OpenAdapters opens every HCI adapter with the given names, closing those already opened if any fails
+func OpenAdapters(names []string, cfg *config.Store) (*Adapters, error) {
+	p := &Adapters{Scheduler: CreateScheduler(cfg)}
+	for _, n := range names {
+		a, err := OpenAdapter(n)
+		if err != nil {
+			p.Stop()
+			return nil, err
+		}
+		p.list = append(p.list, a)
+	}
+	return p, nil
+}
+
+// Default returns the first adapter, which is used for operations not concerning a single bluno e.g. scanning
+func (p *Adapters) Default() *Adapter {
+	return p.list[0]
+}
+
+// Assign returns the adapter with the given name, or the least loaded one if no name is given, and counts the bluno
+// connecting through it until it is released
+func (p *Adapters) Assign(name string) (*Adapter, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	var picked *Adapter
+	for _, a := range p.list {
+		if name != "" && a.Name == name {
+			picked = a
+			break
+		}
+		if name == "" && (picked == nil || a.assigned < picked.assigned) {
+			picked = a
+		}
+	}
+	if picked == nil {
+		return nil, fmt.Errorf("adapter %s is not open", name)
+	}
+	picked.assigned++
+	return picked, nil
+}
+
+// Dial connects to the bluno with the given address through an adapter, once the scheduler gives it a turn
+// The timeout only starts once it is the bluno's turn.
+func (p *Adapters) Dial(pCtx context.Context, a *Adapter, addr string, timeout time.Duration) (ble.Client, error) {
+	if err := p.Scheduler.Acquire(pCtx, addr, a); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(pCtx, timeout)
+	defer cancel()
+	client, err := a.Device.Dial(ctx, ble.NewAddr(addr))
+	p.Scheduler.Release(addr, a, err == nil || pCtx.Err() != nil) // A dial cut short by stopping the relay is not a failure
+	return client, err
+}
+
+// Release stops counting a bluno against the adapter it was assigned to
+func (p *Adapters) Release(a *Adapter) {
+	p.Lock()
+	defer p.Unlock()
+	a.assigned--
+}
+
+// Load returns the number of blunos assigned to every adapter
+func (p *Adapters) Load() map[string]int {
+	p.Lock()
+	defer p.Unlock()
+	load := make(map[string]int, len(p.list))
+	for _, a := range p.list {
+		load[a.Name] = a.assigned
+	}
+	return load
+}
+
+// Stop closes every adapter
+func (p *Adapters) Stop() {
+	for _, a := range p.list {
+		if err := a.Device.Stop(); err != nil {
+			log.Warn("adapter_stop", "adapter", a.Name, "err", err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package bluno
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+)
+
+// handshakeRequest returns the handshake to send to the bluno, asking for batched notifications if the link can carry them
+func (b *Bluno) handshakeRequest() []byte {
+	b.Batched = false
+	b.batchSamples = 0
+	n := b.Config.Get().BLE.BatchSamples
+	if max := commsintconfig.MaxBatchSamples(b.Link.MaxPayload()); n > max {
+		n = max
+	}
+	if n < 2 {
+		return []byte{commsintconfig.InitHandshakeSymbol, byte('\r'), '\n'}
+	}
+	b.batchSamples = n
+	return []byte{commsintconfig.InitHandshakeSymbol, commsintconfig.BatchHandshakeSymbol, byte(n), byte('\r'), '\n'}
+}
+
+// isBatch returns true if a notification has the checksum of a batched notification, and the length of one holding
+// between 2 and the negotiated max samples. Whether it is one is only known once its header is decrypted, see constructBatch.
+// Several whole packets concatenated into a notification also pass the checksum, but only match the length of a batch
+// of 20 or more samples.
+func isBatch(resp []byte, max int) bool {
+	deltas := len(resp) - commsintconfig.BatchSize(1)
+	if deltas <= 0 || deltas%commsintconfig.BatchDeltaSize != 0 || deltas/commsintconfig.BatchDeltaSize+1 > max {
+		return false
+	}
+
+	var c byte
+	for _, v := range resp[:len(resp)-1] {
+		c ^= v
+	}
+	return c == resp[len(resp)-1]
+}
+
+// constructBatch decodes a batched notification into a packet per sample, in the order they were taken
+// It returns false if the number of samples in the header does not match the length of the notification.
+func constructBatch(b *Bluno, resp []byte) ([]commsintconfig.Packet, bool) {
+	// The header is encrypted like the first 18 bytes of a packet, so it is decrypted as one
+	head := make([]byte, 0, commsintconfig.ExpectedPacketSize)
+	head = append(append(head, resp[:commsintconfig.BatchHeaderSize]...), resp[len(resp)-1])
+	head = decryptPacket(head)
+
+	count := int(head[0])
+	if count != (len(resp)-commsintconfig.BatchSize(1))/commsintconfig.BatchDeltaSize+1 {
+		return nil, false
+	}
+
+	ts := binary.LittleEndian.Uint32(head[1:5])
+	seq := head[5]
+	var vals [6]int16
+	for i := range vals {
+		vals[i] = twoByteToNum(head, uint8(6+2*i))
+	}
+
+	pkts := make([]commsintconfig.Packet, 0, count)
+	deltas := resp[commsintconfig.BatchHeaderSize : len(resp)-1]
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			d := deltas[(i-1)*commsintconfig.BatchDeltaSize : i*commsintconfig.BatchDeltaSize]
+			ts += uint32(d[0])
+			for j := range vals {
+				vals[j] += int16(int8(d[1+j]))
+			}
+		}
+
+		pkt := commsintconfig.Packet{
+			Timestamp:   sensorTimeToUnix(b, ts).UnixNano() / int64(time.Millisecond),
+			SensorTime:  ts,
+			Type:        commsintconfig.Data,
+			BlunoNumber: b.Num,
+			Revision:    commsintconfig.SequencedRevision,
+			Sequence:    seq + uint8(i),
+			X:           vals[0],
+			Y:           vals[1],
+			Z:           vals[2],
+			Pitch:       vals[3],
+			Roll:        vals[4],
+			Yaw:         vals[5],
+		}
+		b.updateBlunoMovementIndicator(&pkt)
+		pkts = append(pkts, pkt)
+	}
+	return pkts, true
+}
@@ -0,0 +1,153 @@
+package bluno
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+)
+
+// sample is a single IMU sample as taken by the beetle
+type sample struct {
+	ts  uint32
+	imu [6]int16
+}
+
+// encodeBatch encodes samples the way the beetle does in IMUbatchResponse and sendBatch, with count in the header
+func encodeBatch(count byte, seq uint8, samples []sample) []byte {
+	buf := make([]byte, commsintconfig.BatchSize(len(samples)))
+	buf[0] = count
+	binary.LittleEndian.PutUint32(buf[1:5], samples[0].ts)
+	buf[5] = seq
+	for i, v := range samples[0].imu {
+		binary.LittleEndian.PutUint16(buf[6+2*i:], uint16(v))
+	}
+
+	// Encrypted like the first 18 bytes of a packet, i.e. bytes 0 to 15, then bytes 2 to 17
+	cOne, cTwo := commsintconfig.CreateBlockCiphers()
+	cOne.Encrypt(buf[:commsintconfig.AESSize], buf[:commsintconfig.AESSize])
+	stageTwo := buf[commsintconfig.StageTwoOffset : commsintconfig.StageTwoOffset+commsintconfig.AESSize]
+	cTwo.Encrypt(stageTwo, stageTwo)
+
+	for i := 1; i < len(samples); i++ {
+		d := buf[commsintconfig.BatchHeaderSize+(i-1)*commsintconfig.BatchDeltaSize:]
+		d[0] = byte(samples[i].ts - samples[i-1].ts)
+		for j := range samples[i].imu {
+			d[1+j] = byte(int8(samples[i].imu[j] - samples[i-1].imu[j]))
+		}
+	}
+	return withChecksum(buf)
+}
+
+// withChecksum sets the last byte to the XOR of every byte before it
+func withChecksum(buf []byte) []byte {
+	var c byte
+	for _, v := range buf[:len(buf)-1] {
+		c ^= v
+	}
+	buf[len(buf)-1] = c
+	return buf
+}
+
+// concatenatedPackets returns a notification holding n whole packets, each with a valid checksum
+func concatenatedPackets(n int) []byte {
+	var resp []byte
+	for i := 0; i < n; i++ {
+		p := make([]byte, commsintconfig.ExpectedPacketSize)
+		for j := range p {
+			p[j] = byte(31*i + 7*j + 3)
+		}
+		resp = append(resp, withChecksum(p)...)
+	}
+	return resp
+}
+
+// steadySamples returns n samples taken 8ms apart, each differing from the one before by 1
+func steadySamples(n int) []sample {
+	s := make([]sample, n)
+	for i := range s {
+		s[i] = sample{ts: 1000 + 8*uint32(i), imu: [6]int16{int16(i), -int16(i), 100, -100, 0, 32767 - int16(i)}}
+	}
+	return s
+}
+
+func TestIsBatch(t *testing.T) {
+	corrupted := encodeBatch(3, 0, steadySamples(3))
+	corrupted[len(corrupted)-1] ^= 0xFF
+
+	tests := []struct {
+		name string
+		resp []byte
+		max  int
+		want bool
+	}{
+		{"full batch", encodeBatch(8, 0, steadySamples(8)), 8, true},
+		{"partial batch", encodeBatch(3, 0, steadySamples(3)), 8, true},
+		{"batch of 2", encodeBatch(2, 0, steadySamples(2)), 8, true},
+		{"more samples than negotiated", encodeBatch(9, 0, steadySamples(9)), 8, false},
+		{"not batching", encodeBatch(3, 0, steadySamples(3)), 0, false},
+		{"single packet", concatenatedPackets(1), 8, false},
+		{"corrupted checksum", corrupted, 8, false},
+		{"length between samples", withChecksum(make([]byte, commsintconfig.BatchSize(2)+3)), 8, false},
+		// 152 bytes is the length of a batch of 20 samples, and the XOR of packets with valid checksums is 0
+		{"8 concatenated packets", concatenatedPackets(8), 8, false},
+		{"8 concatenated packets within a larger negotiated batch", concatenatedPackets(8), 20, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isBatch(tt.resp, tt.max); got != tt.want {
+				t.Errorf("isBatch(%d bytes, %d) = %v, want %v", len(tt.resp), tt.max, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConstructBatch(t *testing.T) {
+	wraparound := []sample{
+		{ts: 4000, imu: [6]int16{0, 127, -128, 32767, -32768, 50}},
+		{ts: 4255, imu: [6]int16{-1, 0, -1, 32767 - 128, -32768 + 127, 50 - 128}},
+		{ts: 4256, imu: [6]int16{-128, 127, -129, 32767 - 256, -32768 + 254, 50 - 1}},
+	}
+
+	tests := []struct {
+		name    string
+		resp    []byte
+		seq     uint8
+		samples []sample
+		ok      bool
+	}{
+		{"round trip", encodeBatch(8, 42, steadySamples(8)), 42, steadySamples(8), true},
+		{"round trip of 2", encodeBatch(2, 0, steadySamples(2)), 0, steadySamples(2), true},
+		{"int8 delta wraparound", encodeBatch(3, 254, wraparound), 254, wraparound, true},
+		{"count above length", encodeBatch(4, 0, steadySamples(3)), 0, nil, false},
+		{"count below length", encodeBatch(2, 0, steadySamples(3)), 0, nil, false},
+	}
+
+	cfg := config.Default()
+	b := CreateBluno(config.Device{Num: 3, Address: "AA:BB:CC:DD:EE:FF"}, config.NewStore(&cfg, "", nil))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkts, ok := constructBatch(b, tt.resp)
+			if ok != tt.ok {
+				t.Fatalf("constructBatch ok = %v, want %v", ok, tt.ok)
+			}
+			if len(pkts) != len(tt.samples) {
+				t.Fatalf("constructBatch returned %d packets, want %d", len(pkts), len(tt.samples))
+			}
+			for i, p := range pkts {
+				s := tt.samples[i]
+				got := [6]int16{p.X, p.Y, p.Z, p.Pitch, p.Roll, p.Yaw}
+				if p.SensorTime != s.ts || got != s.imu {
+					t.Errorf("packet %d = %d %v, want %d %v", i, p.SensorTime, got, s.ts, s.imu)
+				}
+				if want := tt.seq + uint8(i); p.Sequence != want {
+					t.Errorf("packet %d sequence = %d, want %d", i, p.Sequence, want)
+				}
+				if p.BlunoNumber != b.Num || p.Type != commsintconfig.Data || !p.IsSequenced() {
+					t.Errorf("packet %d = %+v, want a sequenced data packet of bluno %d", i, p, b.Num)
+				}
+			}
+		})
+	}
+}
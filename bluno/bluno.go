@@ -1,94 +1,195 @@
 package bluno
 
 import (
-	"container/list"
 	"context"
 	"encoding/binary"
 	"fmt"
-	"log"
 	"math"
+	"sync/atomic"
 	"time"
 
 	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+	"github.com/CG4002-AY2021S2-B16/comms-int/logging"
 	"github.com/go-ble/ble"
 )
 
+var log = logging.For("ble")
+
 // Bluno represents a BLE device
+// The statistics and state of a connection are owned by the goroutine running Connect and then Listen, which
+// parses every notification. Other goroutines read them through Stats and ClockSnapshot instead.
 type Bluno struct {
-	Address                string     `json:"address"`
-	Name                   string     `json:"name"`
-	Num                    uint8      `json:"num"`
-	User                   string     `json:"user"`
-	Client                 ble.Client `json:"client"`
-	PacketsReceived        uint32     `json:"packets_received"`
-	HandshakeAcknowledged  bool       `json:"handshake_acknowledged"`
-	HandShakeInit          time.Time  `json:"handshake_sent_at"`
-	HandshakedAt           time.Time  `json:"handshake_received_at"`
-	LastPacketReceivedAt   time.Time  `json:"last_packet_received_at"`
-	PacketsImmSuccess      uint32     `json:"packets_immediate_success"`
-	PacketsInvalidType     uint32     `json:"packets_invalid_type"`
-	PacketsIncorrectLength uint32     `json:"packets_incorrect_length"`
-	PacketsReconciled      uint32     `json:"packets_reconciled"`
-	StartTime              time.Time  `json:"start_time"`
-	Buffer                 *list.List `json:"response_buffer"`
-	StateUpdateChan        chan commsintconfig.BlunoStatus
+	Address                string                            `json:"address"`
+	Name                   string                            `json:"name"`
+	Num                    uint8                             `json:"num"`
+	User                   string                            `json:"user"`
+	Client                 ble.Client                        `json:"client"`
+	PacketsReceived        uint32                            `json:"packets_received"`
+	HandshakeAcknowledged  bool                              `json:"handshake_acknowledged"`
+	HandShakeInit          time.Time                         `json:"handshake_sent_at"`
+	HandshakedAt           time.Time                         `json:"handshake_received_at"`
+	LastPacketReceivedAt   time.Time                         `json:"last_packet_received_at"`
+	PacketsImmSuccess      uint32                            `json:"packets_immediate_success"`
+	PacketsInvalidType     uint32                            `json:"packets_invalid_type"`
+	PacketsIncorrectLength uint32                            `json:"packets_incorrect_length"`
+	PacketsReconciled      uint32                            `json:"packets_reconciled"`
+	PacketsBatched         uint32                            `json:"packets_batched"`
+	Batched                bool                              `json:"batched"`
+	StartTime              time.Time                         `json:"start_time"`
+	Config                 *config.Store                     `json:"-"`
+	Reassembler            *Reassembler                      `json:"-"`
+	Continuity             *ContinuityTracker                `json:"-"`
+	Clock                  *SensorClock                      `json:"-"`
+	State                  *StateMachine                     `json:"-"`
+	Link                   commsintconfig.LinkTelemetry      `json:"link"`
+	LinkUpdateChan         chan commsintconfig.LinkTelemetry `json:"-"`
+	LinkController         LinkController                    `json:"-"`
+	Adapters               *Adapters                         `json:"-"`
+	Health                 *HealthTracker                    `json:"-"`
+	Session                *SessionTracker                   `json:"-"`
+	HealthUpdateChan       chan commsintconfig.HealthReport  `json:"-"`
+	WriteHealth            func(commsintconfig.HealthReport) `json:"-"`
+	PreferredAdapter       string                            `json:"preferred_adapter,omitempty"`
 	LeftIndication         uint8
 	RightIndication        uint8
 	NotSentIndication      uint8
 	LeftSent               uint8
 	RightSent              uint8
 
-	lastSent time.Time
+	lastSent       time.Time
+	syncSentAt     time.Time
+	syncID         uint8 // Id of the latest time sync request
+	adapter        *Adapter
+	dropReason     string        // Why the connection is being cancelled, reported once it is disconnected
+	sampleInterval time.Duration // Interval between samples of the Beetle, 0 for the expected sample interval
+	batchSamples   int           // Most samples the Beetle was asked to batch into a notification, 0 if not asked to batch
+	emgPackets     uint32        // EMG packets received over the connection, whose loss is only known given the sample interval
+	stats          atomic.Value
+	clock          atomic.Value
+}
+
+// CreateBluno initializes and returns a bluno for the given device
+func CreateBluno(d config.Device, cfg *config.Store) *Bluno {
+	return &Bluno{
+		Address: d.Address,
+		Name:    d.Name,
+		Num:     d.Num,
+		User:    d.User,
+		Config:  cfg,
+		Health:  CreateHealthTracker(),
+		Session: CreateSessionTracker(),
+		State:   CreateStateMachine(d.Num, d.User),
+
+		PreferredAdapter: d.Adapter,
+		sampleInterval:   d.SampleInterval,
+	}
+}
+
+// log returns the ble logger with the fields identifying this bluno attached
+func (b *Bluno) log() *logging.Logger {
+	return log.With("bluno", b.Num, "addr", b.Address, "user", b.User)
 }
 
 // Connect establishes a connection with the physical bluno
 // - Remember to close client when done
 // - Remember to check disconnected before interacting with channel
 // - To be run inside a goroutine
-func (b *Bluno) Connect(pCtx context.Context, m chan bool, done chan bool) {
-	// Dial to Bluno
-	if commsintconfig.FineDebugMode {
-		log.Printf("Entering HCI critical region: %s", b.Name)
+func (b *Bluno) Connect(pCtx context.Context, done chan bool) {
+	l := b.log()
+	if !b.awaitQuarantine(pCtx) {
+		done <- false
+		return
 	}
+	b.setStatus(commsintconfig.Dialing, "dial_queued")
 
-	<-m
-	timedCtx, cancel := context.WithTimeout(pCtx, commsintconfig.ConnectionEstablishTimeout)
-	defer cancel()
-	client, err := ble.Dial(timedCtx, ble.NewAddr(b.Address))
-	m <- true
-
-	if commsintconfig.FineDebugMode {
-		log.Printf("Exiting HCI critical region: %s", b.Name)
+	a, err := b.Adapters.Assign(b.PreferredAdapter)
+	if err != nil {
+		l.Error("assign_adapter", "err", err)
+		b.setStatus(commsintconfig.Disconnected, "adapter_unavailable")
+		backOff(pCtx)
+		done <- false
+		return
 	}
 
+	// Dial to Bluno
+	l.Trace("hci_critical_region_enter", "adapter", a.Name)
+	client, err := b.Adapters.Dial(pCtx, a, b.Address, b.Config.Get().BLE.ConnectionEstablishTimeout)
+	l.Trace("hci_critical_region_exit", "adapter", a.Name)
+
 	if err != nil {
-		log.Printf("client_connection_fail|addr=%s|err=%s", b.Address, err)
-		time.Sleep(2 * time.Second) // Sleep fixed duration to induce predictability and allow other connection attempts
+		b.Adapters.Release(a)
+		if pCtx.Err() != nil { // Stopping the relay says nothing about the bluno, so it is not counted as a failure
+			l.Info("client_connection_cancelled", "adapter", a.Name)
+			b.setStatus(commsintconfig.Disconnected, "dial_cancelled")
+			done <- false
+			return
+		}
+		l.Warn("client_connection_fail", "adapter", a.Name, "err", err)
+		b.setStatus(commsintconfig.Disconnected, "dial_failed")
+		b.Session.DialFailed()
+		backOff(pCtx)
 		done <- false
 		return
 	}
 
+	b.adapter = a
+	b.LinkController = a.LinkController // Connection handles are only known to the adapter that established them
 	b.SetClient(&client)
-	b.StateUpdateChan <- commsintconfig.NotHandshaked
-	log.Printf("client_connection_succeeded|addr=%s", b.Address)
+	b.Link.Adapter = a.Name
+	b.Session.Begin()
+	b.setStatus(commsintconfig.Discovering, "connected")
+	b.publishLink()
+	l.Info("client_connection_succeeded", "adapter", a.Name, "handle", b.Link.Handle, "conn_interval", b.Link.Interval,
+		"conn_latency", b.Link.Latency, "supervision_timeout", b.Link.SupervisionTimeout, "mtu", b.Link.MTU)
 
 	done <- true
 }
 
+// backOff waits a fixed duration after a failed connection attempt, to induce predictability and allow other
+// connection attempts, unless the relay is stopped in the meantime
+func backOff(ctx context.Context) {
+	select {
+	case <-time.After(2 * time.Second):
+	case <-ctx.Done():
+	}
+}
+
+// releaseAdapter stops counting the bluno against the adapter it was connected through, once disconnected
+func (b *Bluno) releaseAdapter() {
+	if b.adapter != nil {
+		b.Adapters.Release(b.adapter)
+		b.adapter = nil
+	}
+}
+
 // Listen receives incoming connections from bluno
 // - to be called inside a goroutine
 func (b *Bluno) Listen(pCtx context.Context, wr func(commsintconfig.Packet), done chan bool) {
+	l := b.log()
+	defer b.releaseAdapter()
+	defer b.endSession()
+	defer func() {
+		if pCtx.Err() == nil { // Connections ended by stopping the relay say nothing about the bluno's health
+			b.recordHealth()
+			if b.Adapters != nil {
+				b.Adapters.Scheduler.Dropped(b.Address, b.HandshakeAcknowledged)
+			}
+		}
+	}()
+
 	// Perform targeted find of characteristic
 	svcUUID := []ble.UUID{ble.UUID16(commsintconfig.BlunoServiceReducedUUID), ble.MustParse(commsintconfig.BlunoServiceUUID)}
 	charUUID := []ble.UUID{ble.UUID16(commsintconfig.BlunoCharacteristicReducedUUID), ble.MustParse(commsintconfig.BlunoCharacteristicUUID)}
 	//commandUUID := []ble.UUID{ble.UUID16(commsintconfig.CommandCharacteristicReducedUUID), ble.MustParse(commsintconfig.CommandCharacteristicUUID)}
 
+	b.negotiateLink()
+
 	// Isolate the service
 	s, err := b.Client.DiscoverServices(svcUUID)
 	if err != nil || len(s) != 1 {
-		if commsintconfig.DebugMode {
-			log.Printf("client_svc_discovery_err|addr=%s|err=%s|len_svcs=%d", b.Address, err, len(s))
-		}
+		l.Debug("client_svc_discovery_err", "err", err, "len_svcs", len(s))
+		b.drop("service_discovery_failed")
 		done <- false
 		b.Client.CancelConnection()
 		return
@@ -97,9 +198,8 @@ func (b *Bluno) Listen(pCtx context.Context, wr func(commsintconfig.Packet), don
 	// Isolate the characteristic
 	c, err := b.Client.DiscoverCharacteristics(charUUID, s[0])
 	if err != nil || len(c) != 1 {
-		if commsintconfig.DebugMode {
-			log.Printf("client_char_discovery_err|addr=%s|err=%s|num_characteristics=%d", b.Address, err, len(c))
-		}
+		l.Debug("client_char_discovery_err", "err", err, "num_characteristics", len(c))
+		b.drop("characteristic_discovery_failed")
 		done <- false
 		b.Client.CancelConnection()
 		return
@@ -111,136 +211,320 @@ func (b *Bluno) Listen(pCtx context.Context, wr func(commsintconfig.Packet), don
 	customDescriptor := ble.NewDescriptor(ble.UUID16(commsintconfig.ClientCharacteristicConfig))
 	customDescriptor.Handle = commsintconfig.ClientCharacteristicConfigHandle
 	characteristic.CCCD = customDescriptor
+	b.setStatus(commsintconfig.Subscribing, "characteristic_found")
 
-	hsFail := make(chan bool, 1)
+	notifications := make(chan notification, notificationBacklog)
+	stopped := make(chan struct{})
 
-	// Subscribe to notifications
-	err = b.Client.Subscribe(characteristic, false, b.parseResponse(hsFail, wr))
+	// Subscribe to notifications, which are handed over to be parsed by this goroutine
+	err = b.Client.Subscribe(characteristic, false, receiveNotifications(notifications, stopped))
 	if err != nil {
-		log.Printf("client_subscription_err|addr=%s|err=%s", b.Address, err)
+		l.Warn("client_subscription_err", "err", err)
+		b.drop("subscription_failed")
 		done <- false
 		b.Client.CancelConnection()
 		return
 	}
 	defer b.Client.Unsubscribe(characteristic, false)
+	defer close(stopped)                                  // Before unsubscribing, so that notifications arriving meanwhile are dropped instead of blocking
+	b.setStatus(commsintconfig.Handshaking, "subscribed") // Before the handshake is sent, which may be acknowledged straight away
 
 	// Handshake
-	log.Printf("Handshake initiated with %s (%s) service=%s char=%s", b.Name, b.Address, s[0].UUID.String(), characteristic.UUID.String())
-	toSend := []byte{commsintconfig.InitHandshakeSymbol, byte('\r'), '\n'}
+	l.Info("handshake_initiated", "service", s[0].UUID.String(), "char", characteristic.UUID.String())
+	toSend := b.handshakeRequest()
 	err = b.Client.WriteCharacteristic(characteristic, toSend, false)
 	if err != nil {
-		log.Printf("write_handshake|err=%s", err)
+		l.Warn("write_handshake", "err", err)
+		b.drop("handshake_write_failed")
 		done <- false
 		b.Client.CancelConnection()
 		return
 	}
 	b.HandShakeInit = time.Now()
-	log.Printf("Handshake sent to %s (%s)|[ %X ]", b.Name, b.Address, toSend)
+	b.dropReason = "disconnected"
+	l.Debug("handshake_sent", "data", fmt.Sprintf("% X", toSend))
 
 	// Start tickers
-	tickChan := time.NewTicker(commsintconfig.ConnectionLivenessCheckInterval)
-	establishTickChan := time.NewTicker(commsintconfig.ConnectionEstablishTimeout)
+	cfg := &b.Config.Get().BLE
+	tickChan := time.NewTicker(cfg.ConnectionLivenessCheckInterval)
+	establishTickChan := time.NewTicker(cfg.ConnectionEstablishTimeout)
+	continuityTickChan := time.NewTicker(cfg.ContinuityReportInterval)
+	syncTickChan := time.NewTicker(cfg.TimeSyncInterval)
+	defer tickChan.Stop()
+	defer establishTickChan.Stop()
+	defer continuityTickChan.Stop()
+	defer syncTickChan.Stop()
+	var rssiTick <-chan time.Time
+	if cfg.RSSISampleInterval > 0 {
+		rssiTickChan := time.NewTicker(cfg.RSSISampleInterval)
+		defer rssiTickChan.Stop()
+		rssiTick = rssiTickChan.C
+	}
 
 	// Read
 	for {
 		select {
 		case <-b.Client.Disconnected():
-			b.StateUpdateChan <- commsintconfig.NotConnected
-			log.Printf("client_connection_disconnected|addr=%s", b.Address)
+			b.setStatus(commsintconfig.Disconnected, b.dropReason)
+			l.Info("client_connection_disconnected", b.linkFields()...)
 			b.PrintStats()
 			done <- false
 			return
-		case <-hsFail:
-			log.Printf("client_handshake_fail|addr=%s", b.Address)
-			b.Client.CancelConnection()
+		case n := <-notifications:
+			b.handleNotification(l, n, wr)
 		case t := <-tickChan.C:
+			if pkts := b.Reassembler.Flush(t); len(pkts) > 0 {
+				for _, p := range pkts {
+					b.handlePacket(l, p, nil, wr)
+				}
+				b.publishStats()
+			}
 			diff := t.Sub(b.LastPacketReceivedAt)
-			if b.HandshakeAcknowledged && diff >= commsintconfig.ConnectionLivenessTimeout {
+			if b.HandshakeAcknowledged && diff >= cfg.ConnectionLivenessTimeout {
 				b.PrintStats()
-				log.Printf(
-					"client_connection_terminated|liveness_ticker_exceed|packets received=%d|lastPacketReceived=%s|curr_t=%s",
-					b.PacketsReceived,
-					b.LastPacketReceivedAt,
-					t,
-				)
+				l.Warn("client_connection_terminated", append([]interface{}{
+					"reason", "liveness_ticker_exceed",
+					"packets_received", b.PacketsReceived,
+					"last_packet_received", b.LastPacketReceivedAt,
+					"curr_t", t,
+				}, b.linkFields()...)...)
+				b.dropReason = "liveness_timeout"
 				b.Client.CancelConnection()
+			} else if b.HandshakeAcknowledged && diff >= cfg.ConnectionLivenessTimeout/2 {
+				b.setStatus(commsintconfig.Stalled, "no_packets") // Halfway to being dropped
 			}
 		case et := <-establishTickChan.C:
 			diff := et.Sub(b.LastPacketReceivedAt)
-			if !b.HandshakeAcknowledged && diff >= commsintconfig.ConnectionEstablishTimeout {
-				log.Printf(
-					"client_connection_terminated|establish_ticker_exceed|packets received=%d|lastPacketReceived=%s|curr_t=%s",
-					b.PacketsReceived,
-					b.LastPacketReceivedAt,
-					et,
-				)
+			if !b.HandshakeAcknowledged && diff >= cfg.ConnectionEstablishTimeout {
+				l.Warn("client_connection_terminated", append([]interface{}{
+					"reason", "establish_ticker_exceed",
+					"packets_received", b.PacketsReceived,
+					"last_packet_received", b.LastPacketReceivedAt,
+					"curr_t", et,
+				}, b.linkFields()...)...)
+				b.dropReason = "establish_timeout"
 				b.Client.CancelConnection()
 			}
+		case <-syncTickChan.C:
+			if b.HandshakeAcknowledged {
+				b.requestTimeSync(characteristic)
+			}
+		case <-rssiTick:
+			b.sampleRSSI()
+		case <-continuityTickChan.C:
+			if b.HandshakeAcknowledged {
+				l.Info("continuity",
+					"rolling_loss", b.Continuity.RollingLoss(),
+					"total_loss", b.Continuity.TotalLoss(),
+					"missing", b.Continuity.Missing,
+					"duplicates", b.Continuity.Duplicates,
+					"backwards", b.Continuity.Backwards,
+					"resets", b.Continuity.Resets,
+				)
+			}
 		case <-pCtx.Done():
-			log.Printf("client_connection_terminated|force=true|packets received=%d", b.PacketsReceived)
+			l.Info("client_connection_terminated", "reason", "forced", "packets_received", b.PacketsReceived)
 			b.PrintStats()
-			b.StateUpdateChan <- commsintconfig.NotConnected
+			b.dropReason = "stopped"
+			b.setStatus(commsintconfig.Stopping, b.dropReason)
 			b.Client.ClearSubscriptions()
 			b.Client.CancelConnection()
+			b.setStatus(commsintconfig.Disconnected, b.dropReason)
 			done <- true
 			return
 		}
 	}
 }
 
-func (b *Bluno) parseResponse(hsFail chan bool, wr func(commsintconfig.Packet)) func([]byte) {
+// notificationBacklog is the number of notifications that may await parsing before the bluno's delivery blocks
+const notificationBacklog = 256
+
+// notification is a notification from a bluno, along with when it was received
+type notification struct {
+	resp []byte
+	at   time.Time
+}
+
+// receiveNotifications returns the handler for the notifications of a bluno, which hands them over to the goroutine
+// running Listen. That goroutine owns every statistic of the connection, so none is touched by the BLE stack's goroutine.
+// Once stopped is closed, notifications are dropped so that the BLE stack is never blocked by a connection being torn down.
+func receiveNotifications(notifications chan<- notification, stopped <-chan struct{}) func([]byte) {
 	return func(resp []byte) {
-		b.LastPacketReceivedAt = time.Now()
-		b.PacketsReceived++
-		if commsintconfig.DebugMode {
-			log.Printf("Received packet from bluno: [ % X ]\n", resp)
+		n := notification{resp: append([]byte(nil), resp...), at: time.Now()} // The BLE stack may reuse its buffer
+		select {
+		case notifications <- n:
+		case <-stopped:
 		}
+	}
+}
 
-		var p commsintconfig.Packet = commsintconfig.Packet{Type: commsintconfig.Invalid}
+// handleNotification parses a notification from the bluno, and acts on every complete packet within it
+func (b *Bluno) handleNotification(l *logging.Logger, n notification, wr func(commsintconfig.Packet)) {
+	defer b.publishStats()
+	resp := n.resp
+	b.LastPacketReceivedAt = n.at
+	b.PacketsReceived++
+	if b.State.Current() == commsintconfig.Stalled {
+		b.setStatus(commsintconfig.Streaming, "packets_resumed")
+	}
+	if l.Enabled(logging.Trace) {
+		l.Trace("packet_received", "resp", fmt.Sprintf("% X", resp))
+	}
 
-		if len(resp) != commsintconfig.ExpectedPacketSize {
-			b.PacketsIncorrectLength++
-			if commsintconfig.DebugMode {
-				log.Printf("Received packet from bluno of incorrect size = %d: [ % X ]\n", len(resp), resp)
+	if b.Batched && isBatch(resp, b.batchSamples) {
+		if pkts, ok := constructBatch(b, resp); ok {
+			b.PacketsBatched += uint32(len(pkts))
+			for _, p := range pkts {
+				for _, p := range b.Reassembler.Sequence(p, b.LastPacketReceivedAt) {
+					b.handlePacket(l, p, resp, wr)
+				}
 			}
+			return
+		}
+	}
 
-			var reconciled bool
-			p, reconciled = b.ReconcilePacket(resp)
-			if !reconciled {
-				return
-			}
-			b.PacketsReconciled++
-		} else {
-			p = constructPacket(b, resp)
+	frames := [][]byte{resp}
+	if concatenated(resp, b.Link.MaxPayload()) {
+		frames = splitConcatenated(resp)
+	} else if len(resp) != commsintconfig.ExpectedPacketSize {
+		b.PacketsIncorrectLength++
+		if l.Enabled(logging.Debug) {
+			l.Debug("packet_incorrect_size", "size", len(resp), "resp", fmt.Sprintf("% X", resp))
 		}
 
-		if commsintconfig.DebugMode || p.Movement != 0 {
-			printPacket(&p, resp)
+		frames = b.Reassembler.Push(resp, b.LastPacketReceivedAt)
+		b.PacketsReconciled = b.Reassembler.Reassembled
+	}
+
+	for _, f := range frames {
+		p := constructPacket(b, f)
+		if p.Type == commsintconfig.Ack && !b.HandshakeAcknowledged {
+			b.Reassembler.Restart() // The Beetle restarts its sequence numbers upon every handshake
+		}
+		for _, p := range b.Reassembler.Sequence(p, b.LastPacketReceivedAt) {
+			b.handlePacket(l, p, f, wr)
 		}
+	}
+}
 
-		switch p.Type {
-		case commsintconfig.Ack:
-			log.Printf("Handshake successful with %s (%s)", b.Name, b.Address)
-			b.StateUpdateChan <- commsintconfig.Transmitting
-			b.HandshakeAcknowledged = true
-		case commsintconfig.Invalid:
-			b.PacketsInvalidType++
-		case commsintconfig.Liveness:
-			if b.HandshakeAcknowledged == false {
-				hsFail <- true
-			} else {
-				b.PacketsImmSuccess++
-				b.resetLeftIndicator()
-				b.resetRightIndicator()
-			}
-		default:
-			if b.HandshakeAcknowledged == false {
-				hsFail <- true
-			} else {
-				b.PacketsImmSuccess++
-				wr(p) // Send to output buffer
-			}
+// drop records why a connection is dropped before the handshake is sent, upon which it is disconnected straight away
+func (b *Bluno) drop(reason string) {
+	b.dropReason = reason
+	b.setStatus(commsintconfig.Disconnected, reason)
+}
+
+// failHandshake drops the connection to a bluno that transmits before acknowledging the handshake
+func (b *Bluno) failHandshake(l *logging.Logger) {
+	if b.dropReason == "handshake_failed" {
+		return // Already being dropped
+	}
+	l.Warn("client_handshake_fail")
+	b.dropReason = "handshake_failed"
+	b.Client.CancelConnection()
+}
+
+// requestTimeSync sends an in-band time sync request, to which the bluno replies with an Ack carrying its current millis()
+// Every request carries a new id, which the reply echoes, so that a reply arriving after a later request was sent is ignored.
+func (b *Bluno) requestTimeSync(c *ble.Characteristic) {
+	b.syncID = b.syncID%commsintconfig.MaxTimeSyncID + 1
+	toSend := []byte{commsintconfig.TimeSyncSymbol, b.syncID, byte('\r'), '\n'}
+	sentAt := time.Now()
+	if err := b.Client.WriteCharacteristic(c, toSend, false); err != nil {
+		b.log().Warn("write_time_sync", "err", err)
+		b.syncSentAt = time.Time{}
+		return
+	}
+	b.syncSentAt = sentAt
+}
+
+// handleTimeSync records the reply to an outstanding time sync request
+// Replies from Beetles that do not echo the id are taken to answer the latest request, relying on the round trip bound instead.
+func (b *Bluno) handleTimeSync(p commsintconfig.Packet) {
+	if b.syncSentAt.IsZero() {
+		b.log().Debug("time_sync_unsolicited", "sensor_time", p.SensorTime)
+		return
+	}
+	if p.IsTimeSyncReply() && p.Sequence != b.syncID {
+		b.Clock.Rejected++
+		b.publishClock()
+		b.log().Debug("time_sync_stale", "id", p.Sequence, "expected", b.syncID, "sensor_time", p.SensorTime)
+		return
+	}
+
+	accepted := b.Clock.AddSample(p.SensorTime, b.syncSentAt, b.LastPacketReceivedAt)
+	b.publishClock()
+	b.log().Debug("time_sync", "accepted", accepted, "rtt", b.LastPacketReceivedAt.Sub(b.syncSentAt), "drift_ppm", b.Clock.DriftPPM())
+	b.syncSentAt = time.Time{}
+}
+
+// handlePacket acts on a single complete packet, after it has been reassembled and placed in sequence
+func (b *Bluno) handlePacket(l *logging.Logger, p commsintconfig.Packet, resp []byte, wr func(commsintconfig.Packet)) {
+	printPacket(l, &p, resp)
+
+	switch p.Type {
+	case commsintconfig.Ack:
+		if b.HandshakeAcknowledged {
+			b.handleTimeSync(p)
+			return
+		}
+		b.Batched = p.Revision == commsintconfig.BatchedRevision
+		l.Info("handshake_successful", "batched", b.Batched)
+		b.setStatus(commsintconfig.Streaming, "handshake_acknowledged")
+		b.HandshakeAcknowledged = true
+		if b.Adapters != nil {
+			b.Adapters.Scheduler.Healthy(b.Address)
+		}
+		b.Continuity.Rebase()
+		b.Clock.Rebase()
+		if !b.Clock.AddSample(p.SensorTime, b.HandShakeInit, b.HandshakedAt) {
+			l.Debug("time_sync_handshake_rejected", "rtt", b.HandshakedAt.Sub(b.HandShakeInit))
+		}
+		b.publishClock()
+	case commsintconfig.Invalid:
+		b.PacketsInvalidType++
+	case commsintconfig.Liveness:
+		if b.HandshakeAcknowledged == false {
+			b.failHandshake(l)
+		} else {
+			b.PacketsImmSuccess++
+			b.resetLeftIndicator()
+			b.resetRightIndicator()
+		}
+	default:
+		if b.HandshakeAcknowledged == false {
+			b.failHandshake(l)
+			return
+		}
+		b.PacketsImmSuccess++
+		if p.Type == commsintconfig.DataEMG {
+			b.emgPackets++
+		}
+
+		c := b.Continuity.Observe(p.SensorTime, b.LastPacketReceivedAt)
+		switch {
+		case c.Duplicate:
+			l.Debug("continuity_duplicate", "sensor_time", p.SensorTime)
+			return
+		case c.Reset:
+			l.Warn("continuity_sensor_reset", "sensor_time", p.SensorTime)
+		case c.Backwards:
+			l.Warn("continuity_backwards", "sensor_time", p.SensorTime)
+		case c.Missing > 0 && b.Config.Get().BLE.InsertGapMarkers:
+			wr(b.gapMarker(p.SensorTime, c.Missing))
 		}
+		wr(p) // Send to output buffer
+	}
+}
+
+// gapMarker creates a packet marking the samples missing before the sample at the given sensor time
+func (b *Bluno) gapMarker(ts uint32, missing uint32) commsintconfig.Packet {
+	first := ts - missing*uint32(b.Continuity.Interval/time.Millisecond)
+	return commsintconfig.Packet{
+		Timestamp:   sensorTimeToUnix(b, first).UnixNano() / int64(time.Millisecond),
+		Type:        commsintconfig.Gap,
+		BlunoNumber: b.Num,
+		Gap:         missing,
+		SensorTime:  first,
 	}
 }
 
@@ -303,7 +587,16 @@ func decryptPacket(resp []byte) []byte {
 
 // formTimestamp takes in a bluno, a packet and performs unix timestamp creation
 func formTimestamp(b *Bluno, resp []byte, start uint8) time.Time {
-	ts := time.Millisecond * time.Duration(binary.LittleEndian.Uint32(resp[start:start+4]))
+	return sensorTimeToUnix(b, binary.LittleEndian.Uint32(resp[start:start+4]))
+}
+
+// sensorTimeToUnix converts a bluno's millis() timestamp to a unix timestamp
+// The drift corrected sensor clock is used once it is available, otherwise the timestamp is anchored to the handshake
+func sensorTimeToUnix(b *Bluno, ms uint32) time.Time {
+	if b.Clock != nil && b.Clock.Ready() {
+		return b.Clock.ToLocal(ms)
+	}
+	ts := time.Millisecond * time.Duration(ms)
 	delta := time.Duration(int64(b.HandshakedAt.Sub(b.HandShakeInit)) / 2)
 	return b.HandShakeInit.Add(delta).Add(ts)
 }
@@ -326,36 +619,51 @@ func getEMGSensorData(b *Bluno, resp []byte) (float32, float32, float32) {
 	return fourByteToFloat(resp, 4), fourByteToFloat(resp, 8), fourByteToFloat(resp, 12)
 }
 
-func checkValWithinThreshold(val int16) bool {
-	return (val < commsintconfig.IndicationThreshold) && (val > -commsintconfig.IndicationThreshold)
+// getRawEMGSamples takes in a packet and extracts the 6 raw ADC samples held in bytes 4 to 15
+func getRawEMGSamples(b *Bluno, resp []byte) []uint16 {
+	samples := make([]uint16, 0, 6)
+	for i := uint8(4); i < 16; i += 2 {
+		samples = append(samples, *getMuscleSensorReading(b, resp, i, i+1))
+	}
+	return samples
+}
+
+func checkValWithinThreshold(val int16, threshold int16) bool {
+	return (val < threshold) && (val > -threshold)
 
 }
 
+// updateBlunoMovementIndicator detects movements using the current movement settings, which may be reloaded while running
 func (b *Bluno) updateBlunoMovementIndicator(p *commsintconfig.Packet) {
-	if checkValWithinThreshold(p.Pitch) {
+	m := b.Config.Get().Movement
+	within := func(val int16) bool {
+		return checkValWithinThreshold(val, m.IndicationThreshold)
+	}
+
+	if within(p.Pitch) {
 		b.resetLeftIndicator()
 		b.resetRightIndicator()
 		b.NotSentIndication++
-		if b.NotSentIndication >= commsintconfig.IndicationNotSentActivationCount {
+		if b.NotSentIndication >= m.NotSentActivationCount {
 			b.lastSent = time.Unix(0, 0) // Reset back to unix
 		}
 
-	} else if p.Pitch < -commsintconfig.IndicationThreshold && checkValWithinThreshold(p.Roll) && checkValWithinThreshold(p.Yaw) { // Left
+	} else if p.Pitch < -m.IndicationThreshold && within(p.Roll) && within(p.Yaw) { // Left
 		b.resetRightIndicator()
 		b.resetNotSentIndicator()
 		b.LeftIndication++
-		if (time.Now().Sub(b.lastSent) < commsintconfig.ReducedThresholdAllowance && b.LeftIndication >= commsintconfig.IndicationLeftReducedActivationCount) ||
-			b.LeftIndication >= commsintconfig.IndicationLeftActivationCount {
+		if (time.Now().Sub(b.lastSent) < m.ReducedThresholdAllowance && b.LeftIndication >= m.LeftReducedActivationCount) ||
+			b.LeftIndication >= m.LeftActivationCount {
 			b.LeftSent++
 			p.Movement = int8(commsintconfig.LeftShift)
 			b.lastSent = time.Now()
 		}
-	} else if p.Pitch > commsintconfig.IndicationThreshold && checkValWithinThreshold(p.Roll) && checkValWithinThreshold(p.Yaw) { // Right
+	} else if p.Pitch > m.IndicationThreshold && within(p.Roll) && within(p.Yaw) { // Right
 		b.resetLeftIndicator()
 		b.resetNotSentIndicator()
 		b.RightIndication++
-		if (time.Now().Sub(b.lastSent) < commsintconfig.ReducedThresholdAllowance && b.RightIndication >= commsintconfig.IndicationRightReducedActivationCount) ||
-			(b.RightIndication >= commsintconfig.IndicationRightActivationCount) {
+		if (time.Now().Sub(b.lastSent) < m.ReducedThresholdAllowance && b.RightIndication >= m.RightReducedActivationCount) ||
+			(b.RightIndication >= m.RightActivationCount) {
 			b.RightSent++
 			p.Movement = int8(commsintconfig.RightShift)
 			b.lastSent = time.Now()
@@ -383,102 +691,128 @@ func constructPacket(b *Bluno, resp []byte) commsintconfig.Packet {
 	resp = decryptPacket(resp)
 
 	t := determinePacketType(resp)
-	if t == commsintconfig.Ack {
-		b.HandshakedAt = time.Now()
+	if t == commsintconfig.Ack && !b.HandshakeAcknowledged {
+		b.HandshakedAt = b.LastPacketReceivedAt
 	}
 
 	pkt := commsintconfig.Packet{
 		Timestamp:    formTimestamp(b, resp, 0).UnixNano() / int64(time.Millisecond),
-		X:            twoByteToNum(resp, 4),
-		Y:            twoByteToNum(resp, 6),
-		Z:            twoByteToNum(resp, 8),
-		Pitch:        twoByteToNum(resp, 10),
-		Roll:         twoByteToNum(resp, 12),
-		Yaw:          twoByteToNum(resp, 14),
+		SensorTime:   binary.LittleEndian.Uint32(resp[0:4]),
 		MuscleSensor: false,
 		Type:         t,
 		BlunoNumber:  b.Num,
 		Movement:     0,
+		Revision:     resp[17] & commsintconfig.RevisionMask,
 	}
 
-	if t == commsintconfig.DataEMG {
+	if pkt.IsSequenced() || pkt.IsTimeSyncReply() {
+		pkt.Sequence = resp[commsintconfig.SequenceNumberIndex]
+	}
+
+	// EMG packets reuse the IMU bytes for their own readings, so only IMU packets are decoded as such
+	switch t {
+	case commsintconfig.DataEMG:
 		pkt.MuscleSensor = true
-		pkt.MAV, pkt.RMS, pkt.MNF = getEMGSensorData(b, resp)
+		if b.Config.Get().BLE.EMGRawSamples {
+			pkt.EMGSamples = getRawEMGSamples(b, resp)
+		} else {
+			pkt.MAV, pkt.RMS, pkt.MNF = getEMGSensorData(b, resp)
+		}
+	case commsintconfig.Data:
+		pkt.X = twoByteToNum(resp, 4)
+		pkt.Y = twoByteToNum(resp, 6)
+		pkt.Z = twoByteToNum(resp, 8)
+		pkt.Pitch = twoByteToNum(resp, 10)
+		pkt.Roll = twoByteToNum(resp, 12)
+		pkt.Yaw = twoByteToNum(resp, 14)
+		b.updateBlunoMovementIndicator(&pkt)
 	}
 
-	b.updateBlunoMovementIndicator(&pkt)
 	return pkt
 }
 
-// PrintStats prints out transmission statistics for a given bluno
+// PrintStats logs transmission statistics for a given bluno, for the current connection and since the relay started
 // Each BLE 4.0 packet is between 31 (best) - 41 (worst case) bytes
 // -> implies each packet is between 248 - 328 bits
 // -> implies up to 351 - 464 packets can be received per second
+// Packets are counted once they are complete, i.e. reassembled fragments count once and each sample of a batch counts.
 func (b *Bluno) PrintStats() {
-	fmt.Printf("--------------------------------\nPrinting statistics for %s\n--------------------------------\n", b.Name)
-	elapsedTime := time.Now().Sub(b.StartTime).Seconds()
-
-	fmt.Printf("Received: %d\nImmediately successful: %d\nReconciled: %d\nInvalid: %d\nIncorrect length: %d\n\n",
-		b.PacketsReceived,
-		b.PacketsImmSuccess,
-		b.PacketsReconciled,
-		b.PacketsInvalidType,
-		b.PacketsIncorrectLength,
-	)
-
-	fmt.Println("Before fragmentated packet reconciliation:")
-	fmt.Printf("Successful Packets: %d\nElapsed time since connection: %f\nEffective packets per second: %f\n",
-		b.PacketsImmSuccess,
-		elapsedTime,
-		float64(b.PacketsImmSuccess)/elapsedTime,
-	)
-	fmt.Printf("Successful packet ratio: %f\nIncorrect length ratio: %f\nInvalid data ratio: %f\n\n",
-		float64(b.PacketsImmSuccess)/float64(b.PacketsReceived),
-		float64(b.PacketsIncorrectLength)/float64(b.PacketsReceived),
-		float64(b.PacketsInvalidType)/float64(b.PacketsReceived),
-	)
-
-	fmt.Println("After fragmentated packet reconciliation:")
-	// Reconciliation causes extra 1 InvalidType, 1 IncorrectLength and 1 PacketReceived
-	adjIncorrectLength := float64(b.PacketsIncorrectLength - 2*b.PacketsReconciled)
-	adjSuccessfulPackets := float64(b.PacketsImmSuccess + b.PacketsReconciled)
-
-	fmt.Printf("Successful Packets: %d\nElapsed time since connection: %f\nEffective packets per second: %f\n",
-		int(adjSuccessfulPackets),
-		elapsedTime,
-		adjSuccessfulPackets/elapsedTime,
-	)
-
-	fmt.Printf("Successful packet ratio: %f\nIncorrect length ratio: %f\nInvalid data ratio: %f\n\n",
-		adjSuccessfulPackets/float64(b.PacketsReceived),
-		float64(adjIncorrectLength)/float64(b.PacketsReceived),
-		float64(b.PacketsInvalidType)/float64(b.PacketsReceived),
-	)
-
-	fmt.Printf("Counts %d %d\n",
-		b.LeftSent,
-		b.RightSent,
+	b.publishStats()
+	s := b.Stats()
+	elapsed := time.Since(s.ConnectedAt).Seconds()
+	ratio := func(n uint32) float64 {
+		if s.Received == 0 {
+			return 0
+		}
+		return float64(n) / float64(s.Received)
+	}
+	session := b.SessionStats()
+
+	b.log().Info("stats",
+		"received", s.Received,
+		"packets", s.ImmediatelySuccessful,
+		"reassembled", s.Reassembled,
+		"batched", s.BatchedSamples,
+		"invalid", s.InvalidType,
+		"incorrect_length", s.IncorrectLength,
+		"elapsed_s", elapsed,
+		"packets_per_second", float64(s.ImmediatelySuccessful)/elapsed,
+		"invalid_ratio", ratio(s.InvalidType),
+		"incorrect_length_ratio", ratio(s.IncorrectLength),
+		"dropped_fragments", s.DroppedFragments,
+		"lost_to_gaps", s.LostToGaps,
+		"samples", s.Samples,
+		"missing_samples", s.MissingSamples,
+		"duplicates", s.Duplicates,
+		"backwards", s.Backwards,
+		"resets", s.Resets,
+		"rolling_loss", s.RollingLoss,
+		"total_loss", s.TotalLoss,
+		"time_syncs", s.TimeSyncs,
+		"time_syncs_rejected", s.TimeSyncsRejected,
+		"drift_ppm", s.DriftPPM,
+		"left_sent", s.LeftSent,
+		"right_sent", s.RightSent,
+		"rssi_mean", b.Link.RSSIMean,
+		"rssi_min", b.Link.RSSIMin,
+		"rssi_max", b.Link.RSSIMax,
+		"rssi_samples", b.Link.RSSISamples,
+		"rssi_failures", b.Link.RSSIFailures,
+		"conn_interval", b.Link.Interval,
+		"mtu", b.Link.MTU,
+		"session_connections", session.Connections,
+		"session_packets", session.Packets,
+		"session_total_loss", session.TotalLoss,
 	)
-
-	fmt.Printf("--------------------------------\nEnd of statistics for %s\n--------------------------------", b.Name)
 }
 
 // SetClient attaches an active client to the given bluno, and resets its statistics e.g. transmission counters
 func (b *Bluno) SetClient(c *ble.Client) {
 	b.Client = *c
+	b.Link = linkOf(*c)
 	b.PacketsInvalidType = 0
 	b.PacketsIncorrectLength = 0
 	b.PacketsReceived = 0
 	b.PacketsImmSuccess = 0
 	b.PacketsReconciled = 0
+	b.PacketsBatched = 0
+	b.emgPackets = 0
+	b.Batched = false
 	b.HandshakeAcknowledged = false
 	b.StartTime = time.Now()
 	b.LastPacketReceivedAt = time.Now()
-	b.Buffer = list.New()
+	cfg := b.Config.Get()
+	b.Reassembler = CreateReassembler(&cfg.BLE, b.log())
+	b.Continuity = CreateContinuityTracker(&cfg.BLE, b.sampleInterval)
+	b.Clock = CreateSensorClock(&cfg.BLE)
+	b.syncSentAt = time.Time{}
+	b.syncID = 0
 	b.resetLeftIndicator()
 	b.resetRightIndicator()
 	b.resetNotSentIndicator()
 	b.LeftSent = 0
 	b.RightSent = 0
 	b.lastSent = time.Now()
+	b.publishClock()
+	b.publishStats()
 }
@@ -1,29 +1,175 @@
 package bluno
 
 import (
-	"log"
+	"fmt"
+	"sort"
+	"time"
 
 	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+	"github.com/CG4002-AY2021S2-B16/comms-int/logging"
 )
 
-// ReconcilePacket attempts to recombine and parse packets that have been fragmented into two pieces, using a LIFO strategy
-// It works on a best effort basis and can allow false positives through (albeit unlikely based on observations)
-func (b *Bluno) ReconcilePacket(curr []byte) (commsintconfig.Packet, bool) {
-	// Successful reconciliation if buffer is non-empty, len(prev) + len(curr) == 19, and curr.first is an invalid packetType
-	if b.Buffer.Len() > 0 {
-		prev := b.Buffer.Remove(b.Buffer.Back()).([]byte)
-		if (len(prev)+len(curr)) == commsintconfig.ExpectedPacketSize && determinePacketType(append(prev, curr...)) != commsintconfig.Invalid {
-			if commsintconfig.DebugMode {
-				log.Printf("reconcile_packet|success|% x", append(prev, curr...))
+// fragment is a piece of a packet that did not arrive in a single notification
+type fragment struct {
+	data       []byte
+	receivedAt time.Time
+}
+
+// heldPacket is a sequenced packet held back while an earlier sequence number is missing
+type heldPacket struct {
+	p          commsintconfig.Packet
+	receivedAt time.Time
+}
+
+// Reassembler recombines packets that have been fragmented across several notifications,
+// and reorders sequenced packets so that gaps in transmission can be detected
+type Reassembler struct {
+	cfg       *config.BLE
+	log       *logging.Logger
+	fragments []fragment
+	pending   []heldPacket
+	nextSeq   uint8
+	seqInit   bool
+
+	Reassembled uint32 // Packets successfully recombined from 2 or more fragments
+	Dropped     uint32 // Fragments evicted for being too old or too many, and duplicate sequenced packets
+	LostToGaps  uint32 // Sequence numbers that never arrived
+}
+
+// CreateReassembler initializes and returns an empty reassembler, which logs to the given bluno's logger
+func CreateReassembler(cfg *config.BLE, l *logging.Logger) *Reassembler {
+	return &Reassembler{
+		cfg:       cfg,
+		log:       l,
+		fragments: make([]fragment, 0, cfg.MaxBufferedFragments),
+		pending:   make([]heldPacket, 0, cfg.ReorderWindow),
+	}
+}
+
+// Push adds a fragment to the buffer, and returns every complete packet that can be formed as a result.
+// A complete packet is formed by a run of consecutive fragments that add up to the expected packet size and pass the checksum.
+// Any fragments preceding a complete packet can no longer be completed, and are dropped.
+func (r *Reassembler) Push(curr []byte, t time.Time) [][]byte {
+	r.evict(t)
+	r.fragments = append(r.fragments, fragment{data: append([]byte(nil), curr...), receivedAt: t})
+
+	var complete [][]byte
+	for start := 0; start < len(r.fragments); start++ {
+		joined := make([]byte, 0, commsintconfig.ExpectedPacketSize)
+		for end := start; end < len(r.fragments); end++ {
+			joined = append(joined, r.fragments[end].data...)
+			if len(joined) > commsintconfig.ExpectedPacketSize {
+				break
+			}
+			if len(joined) == commsintconfig.ExpectedPacketSize && calculateChecksum(joined) {
+				if r.log.Enabled(logging.Debug) {
+					r.log.Debug("reassemble_packet", "fragments", end-start+1, "dropped", start, "packet", fmt.Sprintf("% x", joined))
+				}
+				complete = append(complete, joined)
+				r.Reassembled++
+				r.Dropped += uint32(start)
+				r.fragments = r.fragments[end+1:]
+				start = -1 // Restart search from the new head of the buffer
+				break
 			}
-			return constructPacket(b, append(prev, curr...)), true
 		}
-		b.Buffer.PushBack(prev)
 	}
-	// Otherwise the packet it is likely spliced into 2 pieces
-	// Add to buffer if it appears that the currently considered packet can be the first one
-	b.Buffer.PushBack(curr)
+	return complete
+}
+
+// evict removes fragments that are older than the max fragment age, and the oldest fragments
+// once the buffer holds the max number of fragments (leaving room for the incoming one)
+func (r *Reassembler) evict(t time.Time) {
+	var i int
+	for i < len(r.fragments) &&
+		(t.Sub(r.fragments[i].receivedAt) > r.cfg.MaxFragmentAge || len(r.fragments)-i >= r.cfg.MaxBufferedFragments) {
+		i++
+	}
+	if i > 0 {
+		r.log.Debug("reassemble_packet_evicted", "fragments", i)
+		r.Dropped += uint32(i)
+		r.fragments = r.fragments[i:]
+	}
+}
 
-	// Return a default invalid packet (to be discarded unless stored in buffer)
-	return commsintconfig.Packet{Type: commsintconfig.Invalid}, false
+// Restart discards held back packets and begins sequencing afresh from the next sequenced packet
+func (r *Reassembler) Restart() {
+	r.pending = r.pending[:0]
+	r.seqInit = false
+}
+
+// Sequence takes in a constructed packet received at t, and returns the packets that can be released in order.
+// Packets of the legacy revision are released immediately. Sequenced packets are held back while a
+// sequence number is missing, until the reorder window fills up or the oldest held packet is older than
+// the max fragment age, after which the gap is recorded as lost.
+func (r *Reassembler) Sequence(p commsintconfig.Packet, t time.Time) []commsintconfig.Packet {
+	if !p.IsSequenced() {
+		return []commsintconfig.Packet{p}
+	}
+
+	if !r.seqInit {
+		r.pending = r.pending[:0]
+		r.nextSeq = p.Sequence
+		r.seqInit = true
+	}
+
+	// Duplicates and stragglers that were already skipped over lie in the half of the sequence space behind nextSeq
+	if dist := p.Sequence - r.nextSeq; dist >= 128 {
+		r.Dropped++
+		return nil
+	}
+	for _, q := range r.pending {
+		if q.p.Sequence == p.Sequence {
+			r.Dropped++
+			return nil
+		}
+	}
+
+	r.pending = append(r.pending, heldPacket{p: p, receivedAt: t})
+	sort.SliceStable(r.pending, func(i, j int) bool {
+		return r.pending[i].p.Sequence-r.nextSeq < r.pending[j].p.Sequence-r.nextSeq
+	})
+	return r.release(t)
+}
+
+// Flush releases the packets held back for longer than the max fragment age, as of t
+// It is to be called periodically, so that held packets are released even if no further packet arrives.
+func (r *Reassembler) Flush(t time.Time) []commsintconfig.Packet {
+	if len(r.pending) == 0 {
+		return nil
+	}
+	return r.release(t)
+}
+
+// release returns the held packets that are next in sequence, skipping over missing sequence numbers
+// once the reorder window is full or a held packet has waited for longer than the max fragment age
+func (r *Reassembler) release(t time.Time) []commsintconfig.Packet {
+	var released []commsintconfig.Packet
+	for len(r.pending) > 0 {
+		head := r.pending[0].p
+		if head.Sequence != r.nextSeq {
+			if len(r.pending) < r.cfg.ReorderWindow && !r.expired(t) {
+				break
+			}
+			// Give up on the missing sequence numbers
+			lost := head.Sequence - r.nextSeq
+			r.LostToGaps += uint32(lost)
+			r.log.Debug("sequence_gap", "expected", r.nextSeq, "got", head.Sequence, "lost", lost)
+		}
+		released = append(released, head)
+		r.pending = r.pending[1:]
+		r.nextSeq = head.Sequence + 1
+	}
+	return released
+}
+
+// expired returns true if any held packet has waited for longer than the max fragment age as of t
+func (r *Reassembler) expired(t time.Time) bool {
+	for _, h := range r.pending {
+		if t.Sub(h.receivedAt) > r.cfg.MaxFragmentAge {
+			return true
+		}
+	}
+	return false
 }
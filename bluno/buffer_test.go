@@ -0,0 +1,154 @@
+package bluno
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+)
+
+// testReassembler returns a reassembler with the default limits: 8 fragments or packets held for up to 250ms
+func testReassembler() *Reassembler {
+	cfg := config.Default()
+	return CreateReassembler(&cfg.BLE, log)
+}
+
+// split cuts a packet into pieces of the given sizes, the last piece taking whatever remains
+func split(p []byte, sizes ...int) [][]byte {
+	var pieces [][]byte
+	for _, n := range sizes {
+		pieces = append(pieces, p[:n])
+		p = p[n:]
+	}
+	return append(pieces, p)
+}
+
+func TestReassemblerPush(t *testing.T) {
+	packets := concatenatedPackets(2)
+	first, second := packets[:commsintconfig.ExpectedPacketSize], packets[commsintconfig.ExpectedPacketSize:]
+	junk := []byte{0x01, 0x02}
+
+	tests := []struct {
+		name        string
+		fragments   [][]byte
+		gap         time.Duration // Between consecutive fragments
+		want        [][]byte
+		reassembled uint32
+		dropped     uint32
+	}{
+		{"whole packet", [][]byte{first}, 0, [][]byte{first}, 1, 0},
+		{"two pieces", split(first, 10), 10 * time.Millisecond, [][]byte{first}, 1, 0},
+		{"three pieces", split(first, 7, 7), 10 * time.Millisecond, [][]byte{first}, 1, 0},
+		{"more pieces than buffered", split(first, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1), 0, nil, 0, 11},
+		{"five pieces", split(first, 4, 4, 4, 4), 10 * time.Millisecond, [][]byte{first}, 1, 0},
+		{"after an incomplete fragment", append([][]byte{junk}, split(first, 6, 6)...), 10 * time.Millisecond, [][]byte{first}, 1, 1},
+		{"packets back to back", append(split(first, 9), split(second, 3, 3)...), 10 * time.Millisecond, [][]byte{first, second}, 2, 0},
+		{"pieces older than the max fragment age", split(first, 10), 300 * time.Millisecond, nil, 0, 1},
+		{
+			"more fragments than buffered",
+			[][]byte{junk, junk, junk, junk, junk, junk, junk, junk, first},
+			10 * time.Millisecond, [][]byte{first}, 1, 8,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testReassembler()
+			at := time.Now()
+			var got [][]byte
+			for _, f := range tt.fragments {
+				got = append(got, r.Push(f, at)...)
+				at = at.Add(tt.gap)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("Push returned %d packets, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if string(got[i]) != string(tt.want[i]) {
+					t.Errorf("packet %d = % x, want % x", i, got[i], tt.want[i])
+				}
+			}
+			if r.Reassembled != tt.reassembled || r.Dropped != tt.dropped {
+				t.Errorf("reassembled %d and dropped %d, want %d and %d", r.Reassembled, r.Dropped, tt.reassembled, tt.dropped)
+			}
+		})
+	}
+}
+
+// step is a sequenced packet arriving, or a flush if seq is negative, at the given milliseconds since the start
+type step struct {
+	seq int
+	at  int
+}
+
+func TestReassemblerSequence(t *testing.T) {
+	tests := []struct {
+		name    string
+		steps   []step
+		want    []uint8
+		lost    uint32
+		dropped uint32
+	}{
+		{"in order", []step{{0, 0}, {1, 8}, {2, 16}}, []uint8{0, 1, 2}, 0, 0},
+		{"out of order", []step{{0, 0}, {2, 8}, {1, 16}, {3, 24}}, []uint8{0, 1, 2, 3}, 0, 0},
+		{"wraparound", []step{{254, 0}, {255, 8}, {0, 16}, {1, 24}}, []uint8{254, 255, 0, 1}, 0, 0},
+		{"out of order across wraparound", []step{{254, 0}, {0, 8}, {255, 16}, {1, 24}}, []uint8{254, 255, 0, 1}, 0, 0},
+		{"starting mid sequence", []step{{100, 0}, {101, 8}}, []uint8{100, 101}, 0, 0},
+		{
+			"gap given up on once the reorder window is full",
+			[]step{{0, 0}, {2, 8}, {3, 16}, {4, 24}, {5, 32}, {6, 40}, {7, 48}, {8, 56}, {9, 64}},
+			[]uint8{0, 2, 3, 4, 5, 6, 7, 8, 9}, 1, 0,
+		},
+		{
+			"gap held within the reorder window",
+			[]step{{0, 0}, {2, 8}, {3, 16}, {4, 24}, {5, 32}, {6, 40}, {7, 48}, {8, 56}},
+			[]uint8{0}, 0, 0,
+		},
+		{"gap given up on after the max fragment age", []step{{0, 0}, {3, 8}, {-1, 300}}, []uint8{0, 3}, 2, 0},
+		{"gap held within the max fragment age", []step{{0, 0}, {3, 8}, {-1, 200}}, []uint8{0}, 0, 0},
+		{"gap given up on when the next packet arrives late", []step{{0, 0}, {3, 8}, {4, 300}}, []uint8{0, 3, 4}, 2, 0},
+		{"gap across wraparound", []step{{254, 0}, {1, 8}, {-1, 300}}, []uint8{254, 1}, 2, 0},
+		{"duplicate held packet", []step{{0, 0}, {2, 8}, {2, 16}, {1, 24}}, []uint8{0, 1, 2}, 0, 1},
+		{"duplicate released packet", []step{{0, 0}, {1, 8}, {1, 16}}, []uint8{0, 1}, 0, 1},
+		{"straggler after its gap was given up on", []step{{0, 0}, {2, 8}, {-1, 300}, {1, 308}}, []uint8{0, 2}, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testReassembler()
+			start := time.Now()
+			var got []uint8
+			for _, s := range tt.steps {
+				at := start.Add(time.Duration(s.at) * time.Millisecond)
+				var released []commsintconfig.Packet
+				if s.seq < 0 {
+					released = r.Flush(at)
+				} else {
+					released = r.Sequence(commsintconfig.Packet{
+						Type:     commsintconfig.Data,
+						Revision: commsintconfig.SequencedRevision,
+						Sequence: uint8(s.seq),
+					}, at)
+				}
+				for _, p := range released {
+					got = append(got, p.Sequence)
+				}
+			}
+
+			if string(got) != string(tt.want) {
+				t.Errorf("released %v, want %v", got, tt.want)
+			}
+			if r.LostToGaps != tt.lost || r.Dropped != tt.dropped {
+				t.Errorf("lost %d and dropped %d, want %d and %d", r.LostToGaps, r.Dropped, tt.lost, tt.dropped)
+			}
+		})
+	}
+}
+
+func TestReassemblerSequenceLegacy(t *testing.T) {
+	r := testReassembler()
+	p := commsintconfig.Packet{Type: commsintconfig.Data, Sequence: 7}
+	if got := r.Sequence(p, time.Now()); len(got) != 1 || len(r.pending) != 0 {
+		t.Errorf("legacy packet released as %v, with %d held, want it released immediately", got, len(r.pending))
+	}
+}
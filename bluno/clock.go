@@ -0,0 +1,142 @@
+package bluno
+
+import (
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+)
+
+// clockSample is a single time sync exchange with a bluno
+type clockSample struct {
+	sensor uint32        // millis() reported by the bluno
+	local  float64       // milliseconds since the clock's base, at the midpoint of the exchange
+	rtt    time.Duration // round trip time of the exchange
+}
+
+// SensorClock maps a bluno's millis() timestamps onto the relay's clock.
+// A line is fit by least squares over the most recent time sync exchanges, so that the
+// drift of the Beetle's crystal is corrected for over the course of a long session.
+type SensorClock struct {
+	cfg       *config.BLE
+	base      time.Time
+	samples   []clockSample
+	slope     float64
+	intercept float64
+
+	LastSyncSentAt     time.Time // Local time at which the latest accepted exchange was sent
+	LastSyncReceivedAt time.Time // Local time at which the latest accepted exchange was replied to
+	LastSyncSensorTime uint32    // Sensor time carried by the latest accepted reply
+	Syncs              uint32    // Number of accepted exchanges
+	Rejected           uint32    // Number of exchanges rejected for exceeding the max round trip time, or replying to an earlier request
+}
+
+// CreateSensorClock initializes and returns a clock without any exchanges
+func CreateSensorClock(cfg *config.BLE) *SensorClock {
+	return &SensorClock{
+		cfg:     cfg,
+		samples: make([]clockSample, 0, cfg.ClockSyncWindow),
+	}
+}
+
+// Rebase discards all previous exchanges, to be called when the sensor clock restarts e.g. upon handshake
+func (c *SensorClock) Rebase() {
+	c.samples = c.samples[:0]
+	c.base = time.Time{}
+	c.slope = 1
+	c.intercept = 0
+}
+
+// AddSample records a time sync exchange, where the request was sent at t0, the reply carrying
+// the sensor time was received at t3, and the sensor time is assumed to have been taken at the midpoint
+// Every exchange, the first included, is rejected if its round trip exceeds ble.clock_sync_max_rtt.
+func (c *SensorClock) AddSample(sensor uint32, t0 time.Time, t3 time.Time) bool {
+	rtt := t3.Sub(t0)
+	if rtt < 0 || rtt > c.cfg.ClockSyncMaxRTT {
+		c.Rejected++
+		return false
+	}
+
+	mid := t0.Add(rtt / 2)
+	if c.base.IsZero() {
+		c.base = mid
+	}
+	if len(c.samples) == c.cfg.ClockSyncWindow {
+		c.samples = append(c.samples[:0], c.samples[1:]...)
+	}
+	c.samples = append(c.samples, clockSample{
+		sensor: sensor,
+		local:  float64(mid.Sub(c.base)) / float64(time.Millisecond),
+		rtt:    rtt,
+	})
+
+	c.LastSyncSentAt = t0
+	c.LastSyncReceivedAt = t3
+	c.LastSyncSensorTime = sensor
+	c.Syncs++
+	c.fit()
+	return true
+}
+
+// fit performs a least squares fit of local time against sensor time.
+// With a single exchange, the sensor clock is assumed to run at the same rate as the local clock.
+func (c *SensorClock) fit() {
+	n := float64(len(c.samples))
+	var sx, sy, sxx, sxy float64
+	for _, s := range c.samples {
+		x := float64(s.sensor)
+		sx += x
+		sy += s.local
+		sxx += x * x
+		sxy += x * s.local
+	}
+
+	c.slope = 1
+	if denom := n*sxx - sx*sx; len(c.samples) >= c.cfg.ClockSyncMinSamples && denom != 0 {
+		c.slope = (n*sxy - sx*sy) / denom
+	}
+	c.intercept = (sy - c.slope*sx) / n
+}
+
+// Ready returns true once the clock holds enough exchanges to estimate the drift of the sensor clock
+// Until then, timestamps are anchored to the handshake instead.
+func (c *SensorClock) Ready() bool {
+	return len(c.samples) >= c.cfg.ClockSyncMinSamples
+}
+
+// ToLocal converts a sensor timestamp in milliseconds to the relay's clock
+func (c *SensorClock) ToLocal(sensor uint32) time.Time {
+	ms := c.intercept + c.slope*float64(sensor)
+	return c.base.Add(time.Duration(ms * float64(time.Millisecond)))
+}
+
+// DriftPPM returns the estimated drift of the sensor clock relative to the local clock, in parts per million
+func (c *SensorClock) DriftPPM() float64 {
+	return (c.slope - 1) * 1e6
+}
+
+// ToSensor converts a time on the relay's clock to the corresponding sensor timestamp in milliseconds
+func (c *SensorClock) ToSensor(t time.Time) float64 {
+	ms := float64(t.Sub(c.base)) / float64(time.Millisecond)
+	return (ms - c.intercept) / c.slope
+}
+
+// Offset returns the offset of the relay's clock (as unix milliseconds) from the sensor clock at time t,
+// such that unix_ms = sensor_ms + offset
+func (c *SensorClock) Offset(t time.Time) float64 {
+	return float64(t.UnixNano())/float64(time.Millisecond) - c.ToSensor(t)
+}
+
+// LastRTT returns the round trip time of the latest accepted exchange
+func (c *SensorClock) LastRTT() time.Duration {
+	if len(c.samples) == 0 {
+		return 0
+	}
+	return c.samples[len(c.samples)-1].rtt
+}
+
+// Copy returns a copy of the clock, which does not change along with it
+func (c *SensorClock) Copy() *SensorClock {
+	cp := *c
+	cp.samples = append([]clockSample(nil), c.samples...)
+	return &cp
+}
@@ -0,0 +1,70 @@
+package bluno
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+)
+
+func TestSensorClockAddSample(t *testing.T) {
+	cfg := config.Default().BLE
+	tests := []struct {
+		name  string
+		rtts  []time.Duration
+		syncs uint32
+	}{
+		{"within the max round trip", []time.Duration{10 * time.Millisecond, cfg.ClockSyncMaxRTT}, 2},
+		{"first sample beyond the max round trip", []time.Duration{cfg.ClockSyncMaxRTT + 1, 10 * time.Millisecond}, 1},
+		{"later sample beyond the max round trip", []time.Duration{10 * time.Millisecond, time.Second}, 1},
+		{"negative round trip", []time.Duration{-time.Millisecond}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := CreateSensorClock(&cfg)
+			c.Rebase()
+			t0 := time.Now()
+			for i, rtt := range tt.rtts {
+				c.AddSample(uint32(i*1000), t0, t0.Add(rtt))
+				t0 = t0.Add(time.Second)
+			}
+			if c.Syncs != tt.syncs || c.Rejected != uint32(len(tt.rtts))-tt.syncs {
+				t.Errorf("accepted %d and rejected %d, want %d accepted", c.Syncs, c.Rejected, tt.syncs)
+			}
+		})
+	}
+}
+
+func TestHandleTimeSync(t *testing.T) {
+	reply := func(revision byte, id uint8) commsintconfig.Packet {
+		return commsintconfig.Packet{Type: commsintconfig.Ack, Revision: revision, Sequence: id, SensorTime: 1000}
+	}
+	tests := []struct {
+		name     string
+		reply    commsintconfig.Packet
+		accepted bool
+	}{
+		{"reply to the latest request", reply(commsintconfig.TimeSyncRevision, 2), true},
+		{"reply to an earlier request", reply(commsintconfig.TimeSyncRevision, 1), false},
+		{"reply without an id", reply(commsintconfig.LegacyRevision, 0), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			b := CreateBluno(config.Device{Num: 1, Address: "AA:BB:CC:DD:EE:FF", User: "user"}, config.NewStore(&cfg, "", nil))
+			b.Clock = CreateSensorClock(&cfg.BLE)
+			b.syncID = 2
+			b.syncSentAt = time.Now()
+			b.LastPacketReceivedAt = b.syncSentAt.Add(20 * time.Millisecond)
+
+			b.handleTimeSync(tt.reply)
+			if accepted := b.Clock.Syncs == 1; accepted != tt.accepted || b.Clock.Rejected+b.Clock.Syncs != 1 {
+				t.Errorf("accepted %d and rejected %d, want accepted %v", b.Clock.Syncs, b.Clock.Rejected, tt.accepted)
+			}
+			if b.syncSentAt.IsZero() == !tt.accepted {
+				t.Errorf("request outstanding = %v, want %v", !b.syncSentAt.IsZero(), !tt.accepted)
+			}
+		})
+	}
+}
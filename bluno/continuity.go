@@ -0,0 +1,129 @@
+package bluno
+
+import (
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+)
+
+// Continuity is the outcome of checking a single sample's timestamp against the previous sample
+type Continuity struct {
+	Missing   uint32 // Number of samples that should have arrived between the previous sample and this one
+	Duplicate bool   // Sample carries the same timestamp as the previous sample
+	Backwards bool   // Sample carries a timestamp earlier than the previous sample
+	Reset     bool   // Sensor clock has restarted from 0 without a handshake, e.g. the Beetle rebooted
+}
+
+// lossBucket accumulates received and missing samples over one LossBucketSize
+type lossBucket struct {
+	start    time.Time
+	received uint32
+	missing  uint32
+}
+
+// ContinuityTracker uses the millis() timestamp embedded in each sample to detect dropped samples,
+// duplicates and sensor resets, given the interval at which the Beetle is expected to sample
+type ContinuityTracker struct {
+	Interval time.Duration
+	cfg      *config.BLE
+	last     uint32
+	init     bool
+	buckets  []lossBucket
+
+	Samples    uint32
+	Missing    uint32
+	Duplicates uint32
+	Backwards  uint32
+	Resets     uint32
+}
+
+// CreateContinuityTracker initializes and returns a tracker for samples spaced by the given interval,
+// or by the expected sample interval if none is given
+func CreateContinuityTracker(cfg *config.BLE, interval time.Duration) *ContinuityTracker {
+	if interval <= 0 {
+		interval = cfg.ExpectedSampleInterval
+	}
+	return &ContinuityTracker{
+		cfg:      cfg,
+		Interval: interval,
+		buckets:  make([]lossBucket, 0),
+	}
+}
+
+// Rebase forgets the previous sample, to be called when the sensor clock is expected to restart e.g. upon handshake
+func (c *ContinuityTracker) Rebase() {
+	c.init = false
+}
+
+// Observe checks the sensor timestamp of an incoming sample (in milliseconds) against the previous sample
+func (c *ContinuityTracker) Observe(ts uint32, t time.Time) Continuity {
+	var res Continuity
+	c.Samples++
+
+	if c.init {
+		interval := uint32(c.Interval / time.Millisecond)
+		switch {
+		case ts == c.last:
+			res.Duplicate = true
+			c.Duplicates++
+		case ts < c.last && ts <= uint32(c.cfg.SensorResetThreshold/time.Millisecond):
+			res.Reset = true
+			c.Resets++
+		case ts < c.last:
+			res.Backwards = true
+			c.Backwards++
+		case ts-c.last > interval+interval/2:
+			// Round to the nearest number of intervals to tolerate jitter in the Beetle's sampling loop
+			res.Missing = (ts-c.last+interval/2)/interval - 1
+			c.Missing += res.Missing
+		}
+	}
+
+	if !res.Backwards {
+		c.last = ts
+	}
+	c.init = true
+	c.record(t, res)
+	return res
+}
+
+// record adds the sample to the rolling loss window, discarding buckets that have fallen out of the window
+func (c *ContinuityTracker) record(t time.Time, res Continuity) {
+	if len(c.buckets) == 0 || t.Sub(c.buckets[len(c.buckets)-1].start) >= c.cfg.LossBucketSize {
+		c.buckets = append(c.buckets, lossBucket{start: t})
+	}
+
+	var i int
+	for i < len(c.buckets) && t.Sub(c.buckets[i].start) > c.cfg.LossWindow {
+		i++
+	}
+	c.buckets = c.buckets[i:]
+
+	curr := &c.buckets[len(c.buckets)-1]
+	if !res.Duplicate {
+		curr.received++
+	}
+	curr.missing += res.Missing
+}
+
+// RollingLoss returns the percentage of samples lost over the loss window
+func (c *ContinuityTracker) RollingLoss() float64 {
+	var received, missing uint32
+	for _, bk := range c.buckets {
+		received += bk.received
+		missing += bk.missing
+	}
+	if received+missing == 0 {
+		return 0
+	}
+	return 100 * float64(missing) / float64(received+missing)
+}
+
+// TotalLoss returns the percentage of samples lost since the tracker was created
+func (c *ContinuityTracker) TotalLoss() float64 {
+	received := c.Samples - c.Duplicates
+	if received+c.Missing == 0 {
+		return 0
+	}
+	return 100 * float64(c.Missing) / float64(received+c.Missing)
+}
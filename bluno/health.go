@@ -0,0 +1,239 @@
+package bluno
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+)
+
+// connectionSummary is how a single connection to a bluno went
+type connectionSummary struct {
+	endedAt    time.Time
+	handshaked bool
+	received   uint32
+	invalid    uint32
+	loss       float64 // Share of samples missing, only known if measured
+	measured   bool
+}
+
+// HealthTracker scores the recent connections to a bluno, and quarantines the bluno when the score drops too low
+// Unlike the statistics of a bluno, it is kept across reconnects.
+type HealthTracker struct {
+	sync.Mutex
+	history          []connectionSummary
+	quarantinedUntil time.Time
+	release          chan struct{}
+}
+
+// CreateHealthTracker initializes and returns a health tracker without any connections
+func CreateHealthTracker() *HealthTracker {
+	return &HealthTracker{}
+}
+
+// Record adds a connection that has ended, and quarantines the bluno if the resulting score is below the threshold
+// The returned report is degraded if the bluno was quarantined.
+func (h *HealthTracker) Record(s connectionSummary, cfg *config.Health) commsintconfig.HealthReport {
+	h.Lock()
+	defer h.Unlock()
+
+	h.history = append(h.history, s)
+	evict := 0
+	for evict < len(h.history) && s.endedAt.Sub(h.history[evict].endedAt) > cfg.Window {
+		evict++
+	}
+	h.history = h.history[evict:]
+
+	r := h.score(cfg)
+	r.Reason = "connection_ended"
+	if r.Score < cfg.QuarantineThreshold && r.Connections >= cfg.MinConnections {
+		h.quarantinedUntil = s.endedAt.Add(cfg.QuarantineCooldown)
+		h.release = make(chan struct{})
+		r.Reason = "quarantined"
+	}
+	h.fill(&r)
+	return r
+}
+
+// Quarantined returns true if the bluno is quarantined, along with when the quarantine ends
+func (h *HealthTracker) Quarantined() (time.Time, bool) {
+	h.Lock()
+	defer h.Unlock()
+	return h.quarantinedUntil, !h.quarantinedUntil.IsZero()
+}
+
+// Wait waits for the quarantine of the bluno to end, by cooling down or by being released
+// It returns false if the context is done first.
+func (h *HealthTracker) Wait(ctx context.Context) bool {
+	h.Lock()
+	until, release := h.quarantinedUntil, h.release
+	h.Unlock()
+	if until.IsZero() {
+		return true
+	}
+
+	t := time.NewTimer(time.Until(until))
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-release:
+	case <-ctx.Done():
+		return false
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if h.release == release { // Not quarantined again in the meantime
+		h.quarantinedUntil = time.Time{}
+		h.release = nil
+	}
+	return true
+}
+
+// Release ends the quarantine of the bluno, if any, and forgets its past connections so that it starts afresh
+// It returns false if the bluno was not quarantined.
+func (h *HealthTracker) Release() bool {
+	h.Lock()
+	defer h.Unlock()
+	h.history = h.history[:0]
+	if h.quarantinedUntil.IsZero() {
+		return false
+	}
+	h.quarantinedUntil = time.Time{}
+	close(h.release)
+	h.release = nil
+	return true
+}
+
+// Report returns the current health of the bluno
+func (h *HealthTracker) Report(cfg *config.Health, reason string) commsintconfig.HealthReport {
+	h.Lock()
+	defer h.Unlock()
+	r := h.score(cfg)
+	r.Reason = reason
+	h.fill(&r)
+	return r
+}
+
+// score computes the health score over the connections in the history
+// Each factor is between 0 and 1, and the score is their product, so that any single problem can make a bluno unhealthy.
+func (h *HealthTracker) score(cfg *config.Health) commsintconfig.HealthReport {
+	r := commsintconfig.HealthReport{Connections: len(h.history), Score: 1}
+	if len(h.history) == 0 {
+		return r
+	}
+
+	var received, invalid uint32
+	var loss float64
+	measured := 0
+	for _, s := range h.history {
+		received += s.received
+		invalid += s.invalid
+		if !s.handshaked {
+			r.HandshakeFailures++
+		} else if s.measured {
+			measured++
+			loss += s.loss
+		}
+	}
+	if received > 0 {
+		r.ChecksumFailureRatio = float64(invalid) / float64(received)
+	}
+	if measured > 0 {
+		r.LossRate = loss / float64(measured)
+	}
+
+	reconnects := 1 - math.Min(1, float64(len(h.history)-1)/float64(cfg.MaxReconnects))
+	handshakes := 1 - float64(r.HandshakeFailures)/float64(len(h.history))
+	r.Score = reconnects * handshakes * (1 - r.ChecksumFailureRatio) * (1 - math.Min(1, r.LossRate))
+	return r
+}
+
+// fill completes a report with the quarantine, if any
+func (h *HealthTracker) fill(r *commsintconfig.HealthReport) {
+	r.At = time.Now()
+	if !h.quarantinedUntil.IsZero() {
+		until := h.quarantinedUntil
+		r.QuarantinedUntil = &until
+		r.Degraded = true
+	}
+}
+
+// recordHealth adds the connection that has just ended to the health of the bluno, and reports it
+// A bluno that is quarantined as a result is not connected to again until the quarantine ends, see awaitQuarantine.
+func (b *Bluno) recordHealth() {
+	cfg := &b.Config.Get().Health
+	r := b.Health.Record(connectionSummary{
+		endedAt:    time.Now(),
+		handshaked: b.HandshakeAcknowledged,
+		received:   b.PacketsReceived,
+		invalid:    b.PacketsInvalidType,
+		loss:       b.Continuity.TotalLoss() / 100,
+		measured:   b.lossMeasured(),
+	}, cfg)
+	b.publishHealth(r)
+
+	if r.Degraded {
+		b.log().Warn("bluno_quarantined", "score", r.Score, "connections", r.Connections, "handshake_failures", r.HandshakeFailures,
+			"checksum_failure_ratio", r.ChecksumFailureRatio, "loss_rate", r.LossRate, "until", r.QuarantinedUntil)
+		b.setStatus(commsintconfig.Quarantined, "quarantined")
+	}
+}
+
+// lossMeasured returns true if the sample loss of the connection that has just ended can be relied upon
+// Loss is worked out from the interval between samples, which is only assumed for IMU samples. The interval of
+// EMG samples must be given by the device's sample_interval, otherwise their loss does not count towards its health.
+// A connection over which no samples arrived has no loss to speak of, rather than none at all.
+func (b *Bluno) lossMeasured() bool {
+	return b.Continuity.Samples > 0 && (b.emgPackets == 0 || b.sampleInterval > 0)
+}
+
+// awaitQuarantine waits for the quarantine of the bluno, if any, to end before it is connected to again
+// It returns false if the context is done first.
+func (b *Bluno) awaitQuarantine(ctx context.Context) bool {
+	until, ok := b.Health.Quarantined()
+	if !ok {
+		return true
+	}
+	b.log().Info("quarantine_wait", "until", until)
+	if !b.Health.Wait(ctx) {
+		return false
+	}
+
+	b.setStatus(commsintconfig.Disconnected, "quarantine_ended")
+	b.publishHealth(b.Health.Report(&b.Config.Get().Health, "quarantine_ended"))
+	b.log().Info("quarantine_ended")
+	return true
+}
+
+// Unquarantine lets a quarantined bluno be connected to again straight away, returning false if it was not quarantined
+func (b *Bluno) Unquarantine() bool {
+	if !b.Health.Release() {
+		return false
+	}
+	b.log().Info("unquarantined")
+	return true
+}
+
+// publishHealth hands a health report over to the app state, replacing any not yet picked up, and sends it upstream
+func (b *Bluno) publishHealth(r commsintconfig.HealthReport) {
+	r.Bluno = b.Num
+	r.User = b.User
+	if b.HealthUpdateChan != nil {
+		select {
+		case b.HealthUpdateChan <- r:
+		default:
+			select {
+			case <-b.HealthUpdateChan:
+			default:
+			}
+			b.HealthUpdateChan <- r
+		}
+	}
+	if b.WriteHealth != nil {
+		b.WriteHealth(r)
+	}
+}
@@ -0,0 +1,37 @@
+package bluno
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+)
+
+func TestLossMeasured(t *testing.T) {
+	tests := []struct {
+		name           string
+		samples        uint32
+		emgPackets     uint32
+		sampleInterval time.Duration
+		want           bool
+	}{
+		{"no samples", 0, 0, 0, false},
+		{"no samples with a known interval", 0, 0, 128 * time.Millisecond, false},
+		{"imu samples", 10, 0, 0, true},
+		{"emg samples without an interval", 10, 10, 0, false},
+		{"emg samples with an interval", 10, 10, 128 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			b := CreateBluno(config.Device{Num: 1, Address: "AA:BB:CC:DD:EE:FF", User: "user"}, config.NewStore(&cfg, "", nil))
+			b.sampleInterval = tt.sampleInterval
+			b.Continuity = CreateContinuityTracker(&cfg.BLE, b.sampleInterval)
+			b.Continuity.Samples = tt.samples
+			b.emgPackets = tt.emgPackets
+			if got := b.lossMeasured(); got != tt.want {
+				t.Errorf("lossMeasured() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package bluno
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/linux/hci"
+	"github.com/go-ble/ble/linux/hci/cmd"
+	"github.com/go-ble/ble/linux/hci/evt"
+)
+
+// LinkController issues the HCI commands concerning a connection that go-ble does not provide
+type LinkController interface {
+	// ReadRSSI reads the signal strength of the connection with the given handle, in dBm
+	ReadRSSI(handle uint16) (int, error)
+	// UpdateConnection requests new parameters for the connection with the given handle
+	UpdateConnection(handle uint16, intervalMin, intervalMax time.Duration, latency uint16, supervisionTimeout time.Duration) error
+}
+
+// hciLinkController controls connections through an HCI device
+type hciLinkController struct {
+	h *hci.HCI
+}
+
+// HCILinkController returns a LinkController which sends its commands to an HCI device
+// ble.Client.ReadRSSI is not implemented by go-ble on linux, and always returns 0.
+func HCILinkController(h *hci.HCI) LinkController {
+	return &hciLinkController{h: h}
+}
+
+func (c *hciLinkController) ReadRSSI(handle uint16) (int, error) {
+	var rp cmd.ReadRSSIRP
+	if err := c.h.Send(&cmd.ReadRSSI{Handle: handle}, &rp); err != nil {
+		return 0, err
+	}
+	if rp.Status != 0 {
+		return 0, fmt.Errorf("read rssi: hci status 0x%02X", rp.Status)
+	}
+	return int(rp.RSSI), nil
+}
+
+// UpdateConnection returns once the controller has accepted the request, the new parameters then take effect
+// once the bluno agrees to them. go-ble drops the event reporting that, so whether it did is not known.
+func (c *hciLinkController) UpdateConnection(handle uint16, intervalMin, intervalMax time.Duration, latency uint16, supervisionTimeout time.Duration) error {
+	return c.h.Send(&cmd.LEConnectionUpdate{
+		ConnectionHandle:   handle,
+		ConnIntervalMin:    uint16(intervalMin / (1250 * time.Microsecond)),
+		ConnIntervalMax:    uint16(intervalMax / (1250 * time.Microsecond)),
+		ConnLatency:        latency,
+		SupervisionTimeout: uint16(supervisionTimeout / (10 * time.Millisecond)),
+	}, nil)
+}
+
+// connectionComplete returns the LE Connection Complete event with which a connection was established
+// go-ble keeps the event, which holds the connection handle and parameters, in an unexported field of
+// its connections without exposing them, so it is read by reflection.
+func connectionComplete(c ble.Conn) (evt.LEConnectionComplete, bool) {
+	v := reflect.ValueOf(c)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return nil, false
+	}
+	f := v.Elem().FieldByName("param")
+	if !f.IsValid() || f.Type() != reflect.TypeOf(evt.LEConnectionComplete(nil)) || f.Len() < 19 {
+		return nil, false
+	}
+	return evt.LEConnectionComplete(f.Bytes()), true
+}
+
+// linkOf returns the telemetry of a newly established connection, with its connection parameters filled in
+func linkOf(c ble.Client) commsintconfig.LinkTelemetry {
+	link := commsintconfig.LinkTelemetry{ConnectedAt: time.Now()}
+	conn := c.Conn()
+	if conn == nil {
+		return link
+	}
+	link.TxMTU = conn.TxMTU()
+	link.RxMTU = conn.RxMTU()
+	link.MTU = minInt(link.TxMTU, link.RxMTU)
+	if e, ok := connectionComplete(conn); ok {
+		link.Handle = e.ConnectionHandle()
+		link.Interval = time.Duration(e.ConnInterval()) * 1250 * time.Microsecond
+		link.Latency = e.ConnLatency()
+		link.SupervisionTimeout = time.Duration(e.SupervisionTimeout()) * 10 * time.Millisecond
+	}
+	return link
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// negotiateLink requests a larger MTU and a shorter connection interval, so that more samples can be streamed,
+// and records the outcome in the link telemetry
+// Blunos that do not support either keep the defaults, which the relay works with as before.
+func (b *Bluno) negotiateLink() {
+	cfg := &b.Config.Get().BLE
+	l := b.log()
+
+	if cfg.RequestMTU > ble.DefaultMTU {
+		if txMTU, err := b.Client.ExchangeMTU(cfg.RequestMTU); err != nil {
+			l.Debug("exchange_mtu", "requested", cfg.RequestMTU, "err", err)
+		} else {
+			b.Link.TxMTU = txMTU
+			b.Link.RxMTU = cfg.RequestMTU
+			b.Link.MTU = minInt(txMTU, cfg.RequestMTU)
+		}
+	}
+
+	if cfg.ConnIntervalMin > 0 && b.LinkController != nil && b.Link.Interval != 0 && b.Link.Interval > cfg.ConnIntervalMax {
+		b.Link.IntervalRequested = cfg.ConnIntervalMax
+		err := b.LinkController.UpdateConnection(b.Link.Handle, cfg.ConnIntervalMin, cfg.ConnIntervalMax, 0, cfg.ConnSupervisionTimeout)
+		if err != nil {
+			b.Link.IntervalRequestErr = err.Error()
+		}
+	}
+
+	l.Info("link_negotiated", "mtu", b.Link.MTU, "max_payload", b.Link.MaxPayload(), "conn_interval", b.Link.Interval,
+		"conn_interval_requested", b.Link.IntervalRequested, "conn_interval_request_err", b.Link.IntervalRequestErr)
+	b.publishLink()
+}
+
+// concatenated returns true if a notification holds several whole packets, which blunos send once a larger MTU is negotiated
+// A notification cannot exceed the payload the MTU allows, so longer ones are fragments run together and left to the reassembler.
+func concatenated(resp []byte, maxPayload int) bool {
+	return len(resp) > commsintconfig.ExpectedPacketSize && len(resp)%commsintconfig.ExpectedPacketSize == 0 && len(resp) <= maxPayload
+}
+
+// splitConcatenated splits a notification holding several whole packets into the packets
+func splitConcatenated(resp []byte) [][]byte {
+	frames := make([][]byte, 0, len(resp)/commsintconfig.ExpectedPacketSize)
+	for i := 0; i < len(resp); i += commsintconfig.ExpectedPacketSize {
+		frames = append(frames, resp[i:i+commsintconfig.ExpectedPacketSize:i+commsintconfig.ExpectedPacketSize])
+	}
+	return frames
+}
+
+// sampleRSSI reads the current signal strength of the connection and adds it to the link telemetry
+func (b *Bluno) sampleRSSI() {
+	if b.LinkController == nil || b.Link.Interval == 0 { // Without the connection parameters the handle is unknown
+		return
+	}
+	rssi, err := b.LinkController.ReadRSSI(b.Link.Handle)
+	if err != nil {
+		b.Link.RSSIFailures++
+		b.log().Debug("read_rssi", "handle", b.Link.Handle, "err", err)
+		return
+	}
+
+	l := &b.Link
+	if l.RSSISamples == 0 || rssi < l.RSSIMin {
+		l.RSSIMin = rssi
+	}
+	if l.RSSISamples == 0 || rssi > l.RSSIMax {
+		l.RSSIMax = rssi
+	}
+	l.RSSISamples++
+	l.RSSIMean += (float64(rssi) - l.RSSIMean) / float64(l.RSSISamples)
+	l.RSSI = rssi
+	l.SampledAt = time.Now()
+	b.publishLink()
+}
+
+// publishLink hands the latest link telemetry over to the app state, replacing any not yet picked up
+// It never blocks, so that sampling does not hold up packet handling.
+func (b *Bluno) publishLink() {
+	if b.LinkUpdateChan == nil {
+		return
+	}
+	select {
+	case b.LinkUpdateChan <- b.Link:
+	default:
+		select {
+		case <-b.LinkUpdateChan:
+		default:
+		}
+		b.LinkUpdateChan <- b.Link
+	}
+}
+
+// linkFields returns the link telemetry as log fields, to correlate connection events with the signal strength
+func (b *Bluno) linkFields() []interface{} {
+	return []interface{}{
+		"rssi", b.Link.RSSI,
+		"rssi_min", b.Link.RSSIMin,
+		"rssi_max", b.Link.RSSIMax,
+		"rssi_mean", b.Link.RSSIMean,
+		"conn_interval", b.Link.Interval,
+		"conn_latency", b.Link.Latency,
+		"supervision_timeout", b.Link.SupervisionTimeout,
+		"mtu", b.Link.MTU,
+	}
+}
@@ -1,30 +1,21 @@
 package bluno
 
 import (
-	"log"
-
-	"github.com/fatih/color"
+	"fmt"
 
 	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/CG4002-AY2021S2-B16/comms-int/logging"
 )
 
-func printPacket(p *commsintconfig.Packet, resp []byte) {
-	cf := color.New(color.FgCyan).SprintFunc()
-
-	switch p.BlunoNumber {
-	case 1:
-		cf = color.New(color.FgRed).SprintFunc()
-	case 2:
-		cf = color.New(color.FgGreen).SprintFunc()
-	case 3:
-		cf = color.New(color.FgBlue).SprintFunc()
-	case 4:
-		cf = color.New(color.FgYellow).SprintFunc()
-	case 5:
-		cf = color.New(color.FgCyan).SprintFunc()
-	default:
-		cf = color.New(color.FgMagenta).SprintFunc()
+// printPacket logs a processed packet together with the response it was decoded from
+// Packets carrying a movement event are logged at info level, every other packet at debug level.
+func printPacket(l *logging.Logger, p *commsintconfig.Packet, resp []byte) {
+	lvl := logging.Debug
+	if p.Movement != 0 {
+		lvl = logging.Info
 	}
-
-	log.Printf("packet processed %v for resp [ % X ]\n", cf(p), resp)
+	if !l.Enabled(lvl) {
+		return
+	}
+	l.Log(lvl, "packet_processed", "packet", p.String(), "resp", fmt.Sprintf("% X", resp))
 }
@@ -0,0 +1,67 @@
+package bluno
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/go-ble/ble"
+)
+
+// Discovered is a bluno found while scanning, advertising the bluno serial service
+type Discovered struct {
+	Address  string    `json:"address"`
+	Name     string    `json:"name"`
+	RSSI     int       `json:"rssi"` // Strongest signal strength seen, in dBm
+	Seen     int       `json:"seen"` // Number of advertisements received
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Scan listens for advertisements of the bluno serial service for the given duration,
+// returning every bluno found from strongest to weakest signal
+func Scan(pCtx context.Context, d time.Duration) ([]Discovered, error) {
+	ctx, cancel := context.WithTimeout(pCtx, d)
+	defer cancel()
+
+	var mu sync.Mutex
+	found := make(map[string]*Discovered)
+	svc := ble.UUID16(commsintconfig.BlunoServiceReducedUUID)
+
+	err := ble.Scan(ctx, true, func(a ble.Advertisement) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		addr := strings.ToUpper(a.Addr().String())
+		f, ok := found[addr]
+		if !ok {
+			f = &Discovered{Address: addr, RSSI: a.RSSI()}
+			found[addr] = f
+			log.Debug("scan_discovered", "addr", addr, "name", a.LocalName(), "rssi", a.RSSI())
+		}
+		if a.LocalName() != "" {
+			f.Name = a.LocalName()
+		}
+		if a.RSSI() > f.RSSI {
+			f.RSSI = a.RSSI()
+		}
+		f.Seen++
+		f.LastSeen = time.Now()
+	}, func(a ble.Advertisement) bool {
+		return ble.Contains(a.Services(), svc) || ble.Contains(a.Services(), ble.MustParse(commsintconfig.BlunoServiceUUID))
+	})
+	if err != nil && ctx.Err() == nil { // Scanning always ends with the context, any other error is a failure
+		return nil, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	out := make([]Discovered, 0, len(found))
+	for _, f := range found {
+		out = append(out, *f)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].RSSI > out[j].RSSI })
+	return out, nil
+}
@@ -0,0 +1,220 @@
+package bluno
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+)
+
+// dialTurn is a bluno waiting for, or taking, its turn to connect through an adapter
+type dialTurn struct {
+	addr     string
+	adapter  *Adapter
+	queuedAt time.Time
+	granted  chan struct{}
+}
+
+// dialHealth is how well connecting to a bluno has gone recently
+type dialHealth struct {
+	failures        int       // Attempts failed since the bluno last streamed, including connections dropped before streaming
+	lastStreamingAt time.Time // When the bluno last started or stopped streaming
+}
+
+// Scheduler decides which bluno connects next, in place of a first come first served queue
+// Each adapter establishes a single connection at a time. Blunos that have been transmitting recently go first,
+// while blunos that keep failing to connect wait behind them, although less so the longer they have waited.
+// Across every adapter, connection attempts are started at most once every ble.dial_interval.
+type Scheduler struct {
+	sync.Mutex
+	cfg        *config.Store
+	waiting    []*dialTurn
+	dialing    map[*Adapter]*dialTurn
+	health     map[string]*dialHealth
+	lastDialAt time.Time
+	timer      *time.Timer
+}
+
+// CreateScheduler initializes and returns a scheduler with no blunos waiting
+func CreateScheduler(cfg *config.Store) *Scheduler {
+	return &Scheduler{
+		cfg:     cfg,
+		dialing: make(map[*Adapter]*dialTurn),
+		health:  make(map[string]*dialHealth),
+	}
+}
+
+// Acquire waits for the turn of the bluno with the given address to connect through the adapter
+// An error is returned if the context is done first, in which case the bluno no longer waits.
+func (s *Scheduler) Acquire(ctx context.Context, addr string, a *Adapter) error {
+	t := &dialTurn{addr: addr, adapter: a, queuedAt: time.Now(), granted: make(chan struct{})}
+	s.Lock()
+	s.waiting = append(s.waiting, t)
+	s.dispatch()
+	s.Unlock()
+
+	select {
+	case <-t.granted:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	select {
+	case <-t.granted: // Granted in the meantime, hand the turn on
+		delete(s.dialing, a)
+		s.dispatch()
+	default:
+		for i, w := range s.waiting {
+			if w == t {
+				s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+				break
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// Release ends the turn of the bluno with the given address, counting a failure if it did not connect
+func (s *Scheduler) Release(addr string, a *Adapter, connected bool) {
+	s.Lock()
+	defer s.Unlock()
+	if !connected {
+		s.healthOf(addr).failures++
+	}
+	delete(s.dialing, a)
+	s.dispatch()
+}
+
+// Healthy records that the bluno with the given address is streaming, so that it goes first should it drop
+func (s *Scheduler) Healthy(addr string) {
+	s.Lock()
+	defer s.Unlock()
+	h := s.healthOf(addr)
+	h.failures = 0
+	h.lastStreamingAt = time.Now()
+}
+
+// Dropped records that the connection to the bluno with the given address has ended
+// A connection that ended before the bluno was streaming counts as a failure, as if it had not connected at all.
+func (s *Scheduler) Dropped(addr string, streamed bool) {
+	s.Lock()
+	defer s.Unlock()
+	h := s.healthOf(addr)
+	if streamed {
+		h.lastStreamingAt = time.Now()
+	} else {
+		h.failures++
+	}
+}
+
+// Queue returns the connection attempts in progress and the blunos waiting, for debugging
+func (s *Scheduler) Queue() commsintconfig.DialQueue {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	s.sortWaiting(now)
+
+	q := commsintconfig.DialQueue{
+		Dialing:    make([]commsintconfig.QueuedDial, 0, len(s.dialing)),
+		Waiting:    make([]commsintconfig.QueuedDial, 0, len(s.waiting)),
+		LastDialAt: s.lastDialAt,
+	}
+	for _, t := range s.dialing {
+		q.Dialing = append(q.Dialing, s.describe(t, now))
+	}
+	sort.Slice(q.Dialing, func(i, j int) bool { return q.Dialing[i].Adapter < q.Dialing[j].Adapter })
+	for _, t := range s.waiting {
+		q.Waiting = append(q.Waiting, s.describe(t, now))
+	}
+	return q
+}
+
+func (s *Scheduler) healthOf(addr string) *dialHealth {
+	h, ok := s.health[addr]
+	if !ok {
+		h = &dialHealth{}
+		s.health[addr] = h
+	}
+	return h
+}
+
+// priority returns the priority of a waiting bluno, lower going first
+// Every ble.dial_priority_aging waited counts as one failure fewer.
+func (s *Scheduler) priority(t *dialTurn, now time.Time) int {
+	p := s.healthOf(t.addr).failures
+	if aging := s.cfg.Get().BLE.DialPriorityAging; aging > 0 {
+		p -= int(now.Sub(t.queuedAt) / aging)
+	}
+	return p
+}
+
+// sortWaiting orders the waiting blunos by priority, then by most recently streaming, then by longest waiting
+func (s *Scheduler) sortWaiting(now time.Time) {
+	sort.SliceStable(s.waiting, func(i, j int) bool {
+		a, b := s.waiting[i], s.waiting[j]
+		if pa, pb := s.priority(a, now), s.priority(b, now); pa != pb {
+			return pa < pb
+		}
+		if ca, cb := s.healthOf(a.addr).lastStreamingAt, s.healthOf(b.addr).lastStreamingAt; !ca.Equal(cb) {
+			return ca.After(cb)
+		}
+		return a.queuedAt.Before(b.queuedAt)
+	})
+}
+
+// dispatch gives turns to the waiting blunos with the highest priority whose adapters are free, as the dial rate allows
+// It is called with the lock held whenever a bluno starts waiting or a turn ends.
+func (s *Scheduler) dispatch() {
+	interval := s.cfg.Get().BLE.DialInterval
+	for len(s.waiting) > 0 {
+		now := time.Now()
+		if wait := s.lastDialAt.Add(interval).Sub(now); wait > 0 {
+			if s.timer == nil {
+				s.timer = time.AfterFunc(wait, func() {
+					s.Lock()
+					defer s.Unlock()
+					s.timer = nil
+					s.dispatch()
+				})
+			}
+			return
+		}
+
+		s.sortWaiting(now)
+		next := -1
+		for i, t := range s.waiting {
+			if _, busy := s.dialing[t.adapter]; !busy {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			return
+		}
+
+		t := s.waiting[next]
+		s.waiting = append(s.waiting[:next], s.waiting[next+1:]...)
+		s.dialing[t.adapter] = t
+		s.lastDialAt = now
+		log.Debug("dial_turn", "addr", t.addr, "adapter", t.adapter.Name, "waited", now.Sub(t.queuedAt),
+			"failures", s.healthOf(t.addr).failures, "still_waiting", len(s.waiting))
+		close(t.granted)
+	}
+}
+
+func (s *Scheduler) describe(t *dialTurn, now time.Time) commsintconfig.QueuedDial {
+	h := s.healthOf(t.addr)
+	return commsintconfig.QueuedDial{
+		Address:         t.addr,
+		Adapter:         t.adapter.Name,
+		QueuedAt:        t.queuedAt,
+		Failures:        h.failures,
+		LastStreamingAt: h.lastStreamingAt,
+		Priority:        s.priority(t, now),
+	}
+}
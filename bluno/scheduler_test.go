@@ -0,0 +1,213 @@
+package bluno
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+)
+
+// testScheduler returns a scheduler with the given dial interval, and priorities aged every second
+func testScheduler(interval time.Duration) *Scheduler {
+	cfg := config.Default()
+	cfg.BLE.DialInterval = interval
+	cfg.BLE.DialPriorityAging = time.Second
+	return CreateScheduler(config.NewStore(&cfg, "", nil))
+}
+
+// waiter is a bluno waiting to connect, queued the given seconds before now
+type waiter struct {
+	addr      string
+	failures  int
+	streamed  int // Seconds before now that the bluno last streamed, 0 if it never has
+	queuedFor int
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		waiting []waiter
+		want    []string
+	}{
+		{
+			"fewest failures first",
+			[]waiter{{"a", 2, 0, 0}, {"b", 0, 0, 0}, {"c", 1, 0, 0}},
+			[]string{"b", "c", "a"},
+		},
+		{
+			"failures offset by waiting",
+			[]waiter{{"a", 0, 0, 0}, {"b", 3, 0, 4}, {"c", 1, 0, 0}},
+			[]string{"b", "a", "c"},
+		},
+		{
+			"most recently streaming on a tie",
+			[]waiter{{"a", 0, 30, 0}, {"b", 0, 0, 0}, {"c", 0, 10, 0}},
+			[]string{"c", "a", "b"},
+		},
+		{
+			"longest waiting on a tie",
+			[]waiter{{"a", 1, 5, 0}, {"b", 1, 5, 0}, {"c", 0, 5, 0}},
+			[]string{"c", "a", "b"},
+		},
+		{
+			"failures before streaming",
+			[]waiter{{"a", 1, 1, 0}, {"b", 0, 60, 0}},
+			[]string{"b", "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testScheduler(0)
+			now := time.Now()
+			for i, w := range tt.waiting {
+				h := s.healthOf(w.addr)
+				h.failures = w.failures
+				if w.streamed > 0 {
+					h.lastStreamingAt = now.Add(-time.Duration(w.streamed) * time.Second)
+				}
+				// Queued a nanosecond apart in the order given, so that ties are broken by that order
+				queuedAt := now.Add(-time.Duration(w.queuedFor)*time.Second - time.Duration(len(tt.waiting)-i))
+				s.waiting = append(s.waiting, &dialTurn{addr: w.addr, queuedAt: queuedAt})
+			}
+
+			s.sortWaiting(now)
+			for i, w := range s.waiting {
+				if w.addr != tt.want[i] {
+					got := make([]string, len(s.waiting))
+					for j, w := range s.waiting {
+						got[j] = w.addr
+					}
+					t.Fatalf("order = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	s := testScheduler(0)
+	now := time.Now()
+	s.healthOf("a").failures = 3
+	tests := []struct {
+		waited time.Duration
+		want   int
+	}{
+		{0, 3},
+		{999 * time.Millisecond, 3},
+		{time.Second, 2},
+		{5 * time.Second, -2},
+	}
+	for _, tt := range tests {
+		if got := s.priority(&dialTurn{addr: "a", queuedAt: now.Add(-tt.waited)}, now); got != tt.want {
+			t.Errorf("priority after waiting %s = %d, want %d", tt.waited, got, tt.want)
+		}
+	}
+}
+
+// granted reports whether the channel is closed within the given time
+func granted(c <-chan error, within time.Duration) bool {
+	select {
+	case <-c:
+		return true
+	case <-time.After(within):
+		return false
+	}
+}
+
+func acquire(s *Scheduler, addr string, a *Adapter) <-chan error {
+	c := make(chan error, 1)
+	go func() { c <- s.Acquire(context.Background(), addr, a) }()
+	return c
+}
+
+func TestSchedulerOneDialPerAdapter(t *testing.T) {
+	s := testScheduler(0)
+	hci0, hci1 := &Adapter{Name: "hci0"}, &Adapter{Name: "hci1"}
+
+	if !granted(acquire(s, "a", hci0), time.Second) {
+		t.Fatal("first bluno not granted a turn")
+	}
+	b := acquire(s, "b", hci0)
+	if granted(b, 50*time.Millisecond) {
+		t.Fatal("second bluno granted a turn on a busy adapter")
+	}
+	if !granted(acquire(s, "c", hci1), time.Second) {
+		t.Fatal("bluno on a free adapter not granted a turn")
+	}
+
+	s.Release("a", hci0, false)
+	if !granted(b, time.Second) {
+		t.Fatal("second bluno not granted a turn once the adapter was released")
+	}
+	if q := s.Queue(); len(q.Dialing) != 2 || q.Dialing[0].Address != "b" || q.Dialing[1].Address != "c" {
+		t.Errorf("dialing = %+v, want b then c", q.Dialing)
+	}
+	if f := s.healthOf("a").failures; f != 1 {
+		t.Errorf("failures after not connecting = %d, want 1", f)
+	}
+}
+
+func TestSchedulerDialRateLimit(t *testing.T) {
+	const interval = 100 * time.Millisecond
+	s := testScheduler(interval)
+
+	start := time.Now()
+	if !granted(acquire(s, "a", &Adapter{Name: "hci0"}), time.Second) {
+		t.Fatal("first bluno not granted a turn")
+	}
+	b := acquire(s, "b", &Adapter{Name: "hci1"})
+	if granted(b, interval/2) {
+		t.Fatal("second bluno granted a turn within the dial interval")
+	}
+	if !granted(b, time.Second) {
+		t.Fatal("second bluno not granted a turn after the dial interval")
+	}
+	if elapsed := time.Since(start); elapsed < interval {
+		t.Errorf("second turn granted after %s, want at least %s", elapsed, interval)
+	}
+}
+
+func TestSchedulerAcquireCancelled(t *testing.T) {
+	s := testScheduler(0)
+	hci0 := &Adapter{Name: "hci0"}
+	if !granted(acquire(s, "a", hci0), time.Second) {
+		t.Fatal("first bluno not granted a turn")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan error, 1)
+	go func() { c <- s.Acquire(ctx, "b", hci0) }()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-c:
+		if err != context.Canceled {
+			t.Errorf("Acquire = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Acquire did not return once cancelled")
+	}
+	if q := s.Queue(); len(q.Waiting) != 0 {
+		t.Errorf("waiting = %+v after cancelling, want none", q.Waiting)
+	}
+}
+
+func TestSchedulerHealth(t *testing.T) {
+	s := testScheduler(0)
+	s.Dropped("a", false)
+	s.Dropped("a", false)
+	if f := s.healthOf("a").failures; f != 2 {
+		t.Fatalf("failures after dropping before streaming = %d, want 2", f)
+	}
+	s.Healthy("a")
+	if h := s.healthOf("a"); h.failures != 0 || h.lastStreamingAt.IsZero() {
+		t.Fatalf("health after streaming = %+v, want no failures", h)
+	}
+	before := s.healthOf("a").lastStreamingAt
+	time.Sleep(time.Millisecond)
+	s.Dropped("a", true)
+	if h := s.healthOf("a"); h.failures != 0 || !h.lastStreamingAt.After(before) {
+		t.Errorf("health after dropping while streaming = %+v, want no failures and a later streaming time", h)
+	}
+}
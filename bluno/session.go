@@ -0,0 +1,129 @@
+package bluno
+
+import (
+	"sync"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+)
+
+// sessionStartedAt is when the relay started, which the session statistics are counted from
+var sessionStartedAt = time.Now()
+
+// SessionTracker keeps the statistics of every connection to a bluno since the relay started
+// Unlike the statistics of a bluno, which are reset by SetClient, they are kept across reconnects.
+type SessionTracker struct {
+	sync.Mutex
+	history      []commsintconfig.ConnectionRecord
+	dialFailures int
+	connected    bool
+}
+
+// CreateSessionTracker initializes and returns a session tracker without any connections
+func CreateSessionTracker() *SessionTracker {
+	return &SessionTracker{history: make([]commsintconfig.ConnectionRecord, 0)}
+}
+
+// DialFailed counts a connection attempt that failed
+func (t *SessionTracker) DialFailed() {
+	t.Lock()
+	defer t.Unlock()
+	t.dialFailures++
+}
+
+// Begin marks a connection as being in progress, so that its live statistics are included in reports
+func (t *SessionTracker) Begin() {
+	t.Lock()
+	defer t.Unlock()
+	t.connected = true
+}
+
+// End adds a connection that has ended to the history
+func (t *SessionTracker) End(r commsintconfig.ConnectionRecord) {
+	t.Lock()
+	defer t.Unlock()
+	t.history = append(t.history, r)
+	t.connected = false
+}
+
+// Report sums up every connection, including the one in progress if any, whose statistics are returned by current
+// current is called with the lock held, so that it cannot return those of a connection that has ended or not yet begun.
+func (t *SessionTracker) Report(current func() commsintconfig.ConnectionStats) commsintconfig.BlunoSessionStats {
+	t.Lock()
+	defer t.Unlock()
+
+	s := commsintconfig.BlunoSessionStats{
+		DialFailures: t.dialFailures,
+		History:      append([]commsintconfig.ConnectionRecord(nil), t.history...),
+	}
+	add := func(c commsintconfig.ConnectionStats, d time.Duration) {
+		s.Connections++
+		if c.HandshakeAcknowledged {
+			s.HandshakedConnections++
+		}
+		s.ConnectedFor += d
+		s.Received += c.Received
+		s.Packets += c.ImmediatelySuccessful
+		s.Reassembled += c.Reassembled
+		s.BatchedSamples += c.BatchedSamples
+		s.InvalidType += c.InvalidType
+		s.IncorrectLength += c.IncorrectLength
+		s.Samples += c.Samples
+		s.MissingSamples += c.MissingSamples
+		s.Duplicates += c.Duplicates
+	}
+	for _, r := range t.history {
+		add(r.ConnectionStats, r.EndedAt.Sub(r.ConnectedAt))
+	}
+	if t.connected {
+		c := current()
+		s.Current = &c
+		add(c, time.Since(c.ConnectedAt))
+	}
+
+	if s.ConnectedFor > 0 {
+		s.PacketsPerSecond = float64(s.Packets) / s.ConnectedFor.Seconds()
+	}
+	if s.Received > 0 {
+		s.InvalidRatio = float64(s.InvalidType) / float64(s.Received)
+	}
+	if received := s.Samples - s.Duplicates; received+s.MissingSamples > 0 {
+		s.TotalLoss = 100 * float64(s.MissingSamples) / float64(received+s.MissingSamples)
+	}
+	return s
+}
+
+// endSession adds the connection that has just ended to the session statistics of the bluno
+func (b *Bluno) endSession() {
+	b.publishStats()
+	b.Session.End(commsintconfig.ConnectionRecord{
+		ConnectionStats: b.Stats(),
+		EndedAt:         time.Now(),
+		EndReason:       b.dropReason,
+		Link:            b.Link,
+	})
+}
+
+// SessionStats returns the statistics of the bluno over every connection made to it since the relay started
+func (b *Bluno) SessionStats() commsintconfig.BlunoSessionStats {
+	s := b.Session.Report(b.Stats)
+	s.Bluno = b.Num
+	s.User = b.User
+	s.Name = b.Name
+	s.Address = b.Address
+	return s
+}
+
+// SessionReport returns the statistics of every given bluno since the relay started
+func SessionReport(blunos []*Bluno) commsintconfig.SessionReport {
+	r := commsintconfig.SessionReport{
+		Session:     commsintconfig.SessionID,
+		StartedAt:   sessionStartedAt,
+		GeneratedAt: time.Now(),
+		Blunos:      make([]commsintconfig.BlunoSessionStats, 0, len(blunos)),
+	}
+	for _, b := range blunos {
+		r.Blunos = append(r.Blunos, b.SessionStats())
+	}
+	return r
+}
@@ -0,0 +1,129 @@
+package bluno
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+)
+
+// maxPendingTransitions is the number of transitions kept for the app state before the oldest are dropped,
+// so that a bluno never blocks on, nor grows without bound for, an app state that is not picking them up
+const maxPendingTransitions = 64
+
+// StateMachine tracks the status of a bluno, only allowing the transitions in commsintconfig.CanTransition
+// Every transition is queued until drained, and Updated is signalled without blocking the bluno.
+type StateMachine struct {
+	sync.Mutex
+	num         uint8
+	user        string
+	status      commsintconfig.BlunoStatus
+	enteredAt   time.Time
+	durations   map[commsintconfig.BlunoStatus]time.Duration // Time spent in every status left so far
+	transitions uint64
+	rejected    uint64
+	pending     []commsintconfig.StatusTransition
+	dropped     uint64
+	updated     chan struct{}
+}
+
+// CreateStateMachine initializes and returns a disconnected state machine for the given bluno
+func CreateStateMachine(num uint8, user string) *StateMachine {
+	return &StateMachine{
+		num:       num,
+		user:      user,
+		status:    commsintconfig.Disconnected,
+		enteredAt: time.Now(),
+		durations: make(map[commsintconfig.BlunoStatus]time.Duration),
+		updated:   make(chan struct{}, 1),
+	}
+}
+
+// Transition moves the bluno to the given status, for the given reason
+// Moving to the current status does nothing, while a transition that is not allowed is rejected with an error.
+func (m *StateMachine) Transition(to commsintconfig.BlunoStatus, reason string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	from := m.status
+	if to == from {
+		return nil
+	}
+	if !commsintconfig.CanTransition(from, to) {
+		m.rejected++
+		return fmt.Errorf("%s cannot move to %s", from, to)
+	}
+
+	now := time.Now()
+	t := commsintconfig.StatusTransition{
+		Bluno:     m.num,
+		User:      m.user,
+		From:      from,
+		To:        to,
+		Reason:    reason,
+		Duration:  now.Sub(m.enteredAt),
+		Timestamp: now.UnixNano() / int64(time.Millisecond),
+	}
+	m.durations[from] += t.Duration
+	m.status = to
+	m.enteredAt = now
+	m.transitions++
+
+	if len(m.pending) == maxPendingTransitions {
+		m.pending = m.pending[1:]
+		m.dropped++
+	}
+	m.pending = append(m.pending, t)
+	select {
+	case m.updated <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Current returns the current status of the bluno
+func (m *StateMachine) Current() commsintconfig.BlunoStatus {
+	m.Lock()
+	defer m.Unlock()
+	return m.status
+}
+
+// Updated is signalled whenever transitions are waiting to be drained
+func (m *StateMachine) Updated() <-chan struct{} {
+	return m.updated
+}
+
+// Drain returns the transitions made since the last drain, oldest first, along with how many were dropped in between
+func (m *StateMachine) Drain() ([]commsintconfig.StatusTransition, uint64) {
+	m.Lock()
+	defer m.Unlock()
+	pending, dropped := m.pending, m.dropped
+	m.pending, m.dropped = nil, 0
+	return pending, dropped
+}
+
+// Report returns the current status of the bluno, and the time spent in every status so far
+func (m *StateMachine) Report() commsintconfig.StatusReport {
+	m.Lock()
+	defer m.Unlock()
+	r := commsintconfig.StatusReport{
+		Status:      m.status,
+		EnteredAt:   m.enteredAt,
+		Durations:   make(map[string]time.Duration, len(m.durations)+1),
+		Transitions: m.transitions,
+		Rejected:    m.rejected,
+	}
+	for s, d := range m.durations {
+		r.Durations[s.String()] = d
+	}
+	r.Durations[m.status.String()] += time.Since(m.enteredAt)
+	return r
+}
+
+// setStatus moves the bluno to the given status, logging a transition that is not allowed
+func (b *Bluno) setStatus(s commsintconfig.BlunoStatus, reason string) {
+	if err := b.State.Transition(s, reason); err != nil {
+		b.log().Warn("status_transition_rejected", "reason", reason, "err", err)
+	}
+}
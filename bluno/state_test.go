@@ -0,0 +1,106 @@
+package bluno
+
+import (
+	"testing"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+)
+
+func TestStateMachineTransition(t *testing.T) {
+	const (
+		disconnected = commsintconfig.Disconnected
+		dialing      = commsintconfig.Dialing
+		discovering  = commsintconfig.Discovering
+		subscribing  = commsintconfig.Subscribing
+		handshaking  = commsintconfig.Handshaking
+		streaming    = commsintconfig.Streaming
+		stalled      = commsintconfig.Stalled
+		quarantined  = commsintconfig.Quarantined
+		stopping     = commsintconfig.Stopping
+	)
+	tests := []struct {
+		name     string
+		to       []commsintconfig.BlunoStatus
+		want     commsintconfig.BlunoStatus
+		made     uint64
+		rejected uint64
+	}{
+		{"connecting", []commsintconfig.BlunoStatus{dialing, discovering, subscribing, handshaking, streaming}, streaming, 5, 0},
+		{"stalling and recovering", []commsintconfig.BlunoStatus{dialing, discovering, subscribing, handshaking, streaming, stalled, streaming}, streaming, 7, 0},
+		{"dropping while connecting", []commsintconfig.BlunoStatus{dialing, discovering, disconnected}, disconnected, 3, 0},
+		{"quarantined and released", []commsintconfig.BlunoStatus{quarantined, disconnected, dialing}, dialing, 3, 0},
+		{"stopping", []commsintconfig.BlunoStatus{dialing, stopping, disconnected}, disconnected, 3, 0},
+		{"same status", []commsintconfig.BlunoStatus{disconnected, dialing, dialing}, dialing, 1, 0},
+		{"streaming without connecting", []commsintconfig.BlunoStatus{streaming}, disconnected, 0, 1},
+		{"skipping the handshake", []commsintconfig.BlunoStatus{dialing, discovering, subscribing, streaming}, subscribing, 3, 1},
+		{"stalling before streaming", []commsintconfig.BlunoStatus{dialing, stalled}, dialing, 1, 1},
+		{"dialing while quarantined", []commsintconfig.BlunoStatus{quarantined, dialing}, quarantined, 1, 1},
+		{"leaving stopping other than disconnected", []commsintconfig.BlunoStatus{stopping, dialing, quarantined}, stopping, 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := CreateStateMachine(1, "user")
+			var rejected uint64
+			for _, to := range tt.to {
+				from := m.Current()
+				err := m.Transition(to, "test")
+				if allowed := from == to || commsintconfig.CanTransition(from, to); allowed != (err == nil) {
+					t.Errorf("%s to %s returned %v", from, to, err)
+				}
+				if err != nil {
+					rejected++
+					if m.Current() != from {
+						t.Errorf("rejected %s to %s moved the bluno to %s", from, to, m.Current())
+					}
+				}
+			}
+
+			r := m.Report()
+			if r.Status != tt.want || r.Transitions != tt.made || r.Rejected != tt.rejected || rejected != tt.rejected {
+				t.Errorf("report = %s after %d transitions with %d rejected, want %s after %d with %d rejected",
+					r.Status, r.Transitions, r.Rejected, tt.want, tt.made, tt.rejected)
+			}
+			if pending, _ := m.Drain(); uint64(len(pending)) != tt.made {
+				t.Errorf("%d transitions drained, want %d", len(pending), tt.made)
+			}
+		})
+	}
+}
+
+func TestStateMachineDrain(t *testing.T) {
+	m := CreateStateMachine(3, "user")
+	m.Transition(commsintconfig.Dialing, "dial")
+	m.Transition(commsintconfig.Disconnected, "dial_failed")
+
+	select {
+	case <-m.Updated():
+	default:
+		t.Fatal("not signalled after transitions")
+	}
+	pending, dropped := m.Drain()
+	if len(pending) != 2 || dropped != 0 {
+		t.Fatalf("drained %d transitions with %d dropped, want 2 with none dropped", len(pending), dropped)
+	}
+	if p := pending[1]; p.Bluno != 3 || p.User != "user" || p.From != commsintconfig.Dialing ||
+		p.To != commsintconfig.Disconnected || p.Reason != "dial_failed" {
+		t.Errorf("second transition = %+v", p)
+	}
+	if pending, _ := m.Drain(); len(pending) != 0 {
+		t.Errorf("drained %d transitions again, want none", len(pending))
+	}
+
+	for i := 0; i < maxPendingTransitions+5; i++ {
+		if i%2 == 0 {
+			m.Transition(commsintconfig.Dialing, "dial")
+		} else {
+			m.Transition(commsintconfig.Disconnected, "dial_failed")
+		}
+	}
+	pending, dropped = m.Drain()
+	if len(pending) != maxPendingTransitions || dropped != 5 {
+		t.Fatalf("drained %d transitions with %d dropped, want %d with 5 dropped", len(pending), dropped, maxPendingTransitions)
+	}
+	if pending[0].To != commsintconfig.Disconnected {
+		t.Errorf("oldest transition kept is to %s, want the oldest ones dropped", pending[0].To)
+	}
+}
@@ -0,0 +1,62 @@
+package bluno
+
+import "github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+
+// Stats returns the statistics of the bluno's current or last connection, as of the latest notification
+// Unlike the fields of the bluno, it is safe to call from any goroutine.
+func (b *Bluno) Stats() commsintconfig.ConnectionStats {
+	if s, ok := b.stats.Load().(*commsintconfig.ConnectionStats); ok {
+		return *s
+	}
+	return commsintconfig.ConnectionStats{}
+}
+
+// ClockSnapshot returns a copy of the bluno's sensor clock, or nil if it has never connected
+// Unlike the clock of the bluno, it is safe to call from any goroutine.
+func (b *Bluno) ClockSnapshot() *SensorClock {
+	c, _ := b.clock.Load().(*SensorClock)
+	return c
+}
+
+// publishStats makes the current statistics available to Stats
+// It is called by the goroutine owning the connection, whenever they change.
+func (b *Bluno) publishStats() {
+	b.stats.Store(&commsintconfig.ConnectionStats{
+		ConnectedAt:           b.StartTime,
+		HandshakeAcknowledged: b.HandshakeAcknowledged,
+		HandshakedAt:          b.HandshakedAt,
+		LastPacketReceivedAt:  b.LastPacketReceivedAt,
+		Batched:               b.Batched,
+
+		Received:              b.PacketsReceived,
+		ImmediatelySuccessful: b.PacketsImmSuccess,
+		Reconciled:            b.PacketsReconciled,
+		BatchedSamples:        b.PacketsBatched,
+		InvalidType:           b.PacketsInvalidType,
+		IncorrectLength:       b.PacketsIncorrectLength,
+
+		Reassembled:      b.Reassembler.Reassembled,
+		DroppedFragments: b.Reassembler.Dropped,
+		LostToGaps:       b.Reassembler.LostToGaps,
+
+		Samples:        b.Continuity.Samples,
+		MissingSamples: b.Continuity.Missing,
+		Duplicates:     b.Continuity.Duplicates,
+		Backwards:      b.Continuity.Backwards,
+		Resets:         b.Continuity.Resets,
+		RollingLoss:    b.Continuity.RollingLoss(),
+		TotalLoss:      b.Continuity.TotalLoss(),
+
+		TimeSyncs:         b.Clock.Syncs,
+		TimeSyncsRejected: b.Clock.Rejected,
+		DriftPPM:          b.Clock.DriftPPM(),
+
+		LeftSent:  b.LeftSent,
+		RightSent: b.RightSent,
+	})
+}
+
+// publishClock makes a copy of the sensor clock available to ClockSnapshot, whenever it changes
+func (b *Bluno) publishClock() {
+	b.clock.Store(b.Clock.Copy())
+}
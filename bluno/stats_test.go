@@ -0,0 +1,90 @@
+package bluno
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+)
+
+// TestStatsWhileHandlingNotifications reads the statistics of a bluno while its notifications are being handled,
+// which the race detector flags should either touch the state owned by the connection's goroutine
+func TestStatsWhileHandlingNotifications(t *testing.T) {
+	const notifications = 2000
+
+	cfg := config.Default()
+	b := CreateBluno(config.Device{Num: 1, Address: "AA:BB:CC:DD:EE:FF", User: "user"}, config.NewStore(&cfg, "", nil))
+	b.Reassembler = CreateReassembler(&cfg.BLE, b.log())
+	b.Continuity = CreateContinuityTracker(&cfg.BLE, b.sampleInterval)
+	b.Clock = CreateSensorClock(&cfg.BLE)
+	b.StartTime = time.Now()
+	b.HandshakeAcknowledged = true
+	b.Batched = true
+	b.batchSamples = cfg.BLE.BatchSamples
+	b.Session.Begin()
+	b.publishStats()
+	b.publishClock()
+
+	ns := make(chan notification, notificationBacklog)
+	stopped := make(chan struct{})
+	receive := receiveNotifications(ns, stopped)
+
+	// Whole packets, batches and fragments, as delivered by the go-ble callback
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < notifications; i++ {
+			switch i % 3 {
+			case 0:
+				receive(concatenatedPackets(1))
+			case 1:
+				receive(encodeBatch(3, uint8(i), steadySamples(3)))
+			default:
+				receive(concatenatedPackets(1)[:7])
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			b.Stats()
+			if c := b.ClockSnapshot(); c != nil && c.Ready() {
+				c.Offset(time.Now())
+			}
+			b.SessionStats()
+		}
+	}()
+
+	l := b.log()
+	for i := 0; i < notifications; i++ {
+		b.handleNotification(l, <-ns, func(commsintconfig.Packet) {})
+		if i%100 == 0 {
+			now := time.Now()
+			b.Clock.AddSample(uint32(i), now, now)
+			b.publishClock()
+		}
+	}
+	close(done)
+	close(stopped)
+	receive(concatenatedPackets(1)) // Dropped rather than blocking once the connection has stopped
+	wg.Wait()
+
+	if s := b.Stats(); s.Received != notifications || s.BatchedSamples == 0 {
+		t.Errorf("stats received %d notifications and %d batched samples, want %d notifications and batches",
+			s.Received, s.BatchedSamples, notifications)
+	}
+	if s := b.SessionStats(); s.Current == nil || s.Current.Received != notifications {
+		t.Errorf("session stats = %+v, want the current connection with %d notifications", s.Current, notifications)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/bluno"
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+)
+
+// axisStats accumulates the range, mean and deviation of a single IMU axis
+type axisStats struct {
+	n        int
+	min, max int16
+	sum, sq  float64
+}
+
+func (a *axisStats) add(v int16) {
+	if a.n == 0 || v < a.min {
+		a.min = v
+	}
+	if a.n == 0 || v > a.max {
+		a.max = v
+	}
+	a.n++
+	a.sum += float64(v)
+	a.sq += float64(v) * float64(v)
+}
+
+func (a *axisStats) String() string {
+	if a.n == 0 {
+		return "no samples"
+	}
+	mean := a.sum / float64(a.n)
+	sd := math.Sqrt(math.Max(a.sq/float64(a.n)-mean*mean, 0))
+	return fmt.Sprintf("min %6d max %6d mean %8.1f sd %7.1f", a.min, a.max, mean, sd)
+}
+
+// calibrateCommand measures the IMU readings of resting blunos, to check them against the movement detection threshold
+func calibrateCommand(fs *flag.FlagSet) func(cfg *config.Store) {
+	num := fs.Int("bluno", 0, "number of the bluno to calibrate, 0 for every enabled bluno")
+	duration := fs.Duration("duration", 10*time.Second, "how long to measure for, once transmitting")
+
+	return func(cfg *config.Store) {
+		adapters := openAdapters(cfg)
+		defer adapters.Stop()
+
+		var blunos []*bluno.Bluno
+		for _, b := range newBlunos(cfg, adapters) {
+			if *num == 0 || int(b.Num) == *num {
+				blunos = append(blunos, b)
+			}
+		}
+		if len(blunos) == 0 {
+			log.Fatal("calibrate", "err", "no enabled bluno with that number", "bluno", *num)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		as := newAppState(ctx, cfg.Get(), blunos)
+		as.SetState(commsintconfig.Running)
+
+		var mu sync.Mutex
+		stats := make(map[uint8]*[3]axisStats)
+		var started sync.Once
+
+		wr := func(p commsintconfig.Packet) {
+			if p.Type != commsintconfig.Data {
+				return
+			}
+			started.Do(func() {
+				log.Info("calibrate_measuring", "duration", *duration)
+				time.AfterFunc(*duration, as.HaltAppState)
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			s, ok := stats[p.BlunoNumber]
+			if !ok {
+				s = &[3]axisStats{}
+				stats[p.BlunoNumber] = s
+			}
+			s[0].add(p.Pitch)
+			s[1].add(p.Roll)
+			s[2].add(p.Yaw)
+		}
+
+		log.Info("calibrate_connecting", "blunos", len(blunos))
+		startApp(as, blunos, wr)
+
+		threshold := int(cfg.Get().Movement.IndicationThreshold)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, b := range blunos {
+			fmt.Fprintf(os.Stdout, "%s (%d, %s), movement threshold %d\n", b.Name, b.Num, b.User, threshold)
+			s, ok := stats[b.Num]
+			if !ok {
+				fmt.Fprintln(os.Stdout, "  no samples received")
+				continue
+			}
+			for i, axis := range []string{"pitch", "roll", "yaw"} {
+				margin := threshold - int(math.Max(math.Abs(float64(s[i].min)), math.Abs(float64(s[i].max))))
+				fmt.Fprintf(os.Stdout, "  %-5s %s  margin %d\n", axis, s[i].String(), margin)
+			}
+		}
+	}
+}
@@ -2,132 +2,186 @@ package main
 
 import (
 	"context"
-	"log"
-	"sync"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
 
-	"github.com/CG4002-AY2021S2-B16/comms-int/appstate"
+	"github.com/CG4002-AY2021S2-B16/comms-int/analysis"
 	"github.com/CG4002-AY2021S2-B16/comms-int/bluno"
 	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
-	"github.com/CG4002-AY2021S2-B16/comms-int/constants"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+	"github.com/CG4002-AY2021S2-B16/comms-int/emg"
+	"github.com/CG4002-AY2021S2-B16/comms-int/logging"
 	"github.com/CG4002-AY2021S2-B16/comms-int/upstream"
 	"github.com/go-ble/ble"
-	"github.com/go-ble/ble/linux"
 )
 
+var log = logging.For("cmd")
+
+// command is a subcommand of the relay binary
+// setup registers the subcommand's own flags, and returns the function that runs it with the resolved config once flags are parsed.
+type command struct {
+	summary string
+	setup   func(fs *flag.FlagSet) func(cfg *config.Store)
+}
+
+var commands = map[string]command{
+	"run":       {"relay packets from every bluno upstream (default)", runCommand},
+	"scan":      {"list nearby blunos and their signal strength", scanCommand},
+	"record":    {"record packets from every bluno to a file, without relaying them", recordCommand},
+	"replay":    {"relay packets from a recording upstream, as if they were live", replayCommand},
+	"status":    {"print the status of a running relay", statusCommand},
+	"calibrate": {"measure a resting bluno to calibrate movement detection", calibrateCommand},
+}
+
 func main() {
-	if commsintconfig.DebugMode {
-		log.SetFlags(log.Ldate | log.Lmicroseconds)
+	name, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		usage()
+		fmt.Fprintf(os.Stderr, "\nflags of %s:\n", name)
+		fs.PrintDefaults()
 	}
-	d, err := linux.NewDevice()
+	s := registerSettings(fs)
+	run := cmd.setup(fs)
+	fs.Parse(args)
+
+	cfg, err := s.resolve()
 	if err != nil {
-		log.Fatal("Can't create new device ", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	initLogging(&cfg.Logging)
+	s.print(os.Stderr, cfg)
+
+	// Hot settings are reloaded whenever the config file changes, or upon the reload instruction
+	store := config.NewStore(cfg, *s.configPath, s.resolve)
+	store.Subscribe(reloadLogging)
+	if store.Path() != "" && cfg.Reload.WatchInterval > 0 {
+		go store.Watch(context.Background(), cfg.Reload.WatchInterval, logReload)
 	}
-	ble.SetDefaultDevice(d)
-	defer d.Stop()
 
-	// Setup application state and upstream connection
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	run(store)
+}
 
-	var as *appstate.AppState = appstate.CreateAppState(ctx)
-	var us *upstream.IOHandler
+// usage prints every subcommand
+func usage() {
+	names := make([]string, 0, len(commands))
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", os.Args[0])
+	for _, n := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", n, commands[n].summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun '%s <command> -h' for the flags of a command\n", os.Args[0])
+}
 
-	log.Println("waiting for incoming socket communication...")
-	us, err = upstream.NewUpstreamConnection()
+// openAdapters opens every configured HCI adapter, setting the first as the default for BLE operations not concerning a single bluno
+func openAdapters(store *config.Store) *bluno.Adapters {
+	cfg := store.Get()
+	adapters, err := bluno.OpenAdapters(cfg.BLE.Adapters, store)
 	if err != nil {
-		log.Fatalf("Error occurred during socket setup| err=%s", err)
+		log.Fatal("create_device", "err", err)
 	}
-	outBuf := upstream.CreateOutputBuffer()
+	ble.SetDefaultDevice(adapters.Default().Device)
+	log.Info("adapters_opened", "adapters", cfg.BLE.Adapters)
+	return adapters
+}
 
-	log.Println("Setup successful, sockets successfully connected.")
+// initLogging applies the configured log level and format, and attaches the session id to every log entry
+// Both have already been validated along with the rest of the config.
+func initLogging(cfg *config.Logging) {
+	logging.SetGlobalFields("session", commsintconfig.SessionID)
+	f, _ := logging.ParseFormat(cfg.Format)
+	logging.SetFormat(f)
+	setLogLevel("", cfg.Level)
+}
 
-	// Append all Blunos to the monitoring goroutine
-	for _, blno := range constants.RetrieveValidBlunos() {
-		newBlnoState := appstate.CreateBlunoState(blno.Name, blno.Address)
-		as.BlunoStates = append(as.BlunoStates, newBlnoState)
-		blno.StateUpdateChan = newBlnoState.UpdateChan
+// reloadLogging applies changes to the log level and format made by a config reload
+// Changing the default level also clears the levels of subsystems set by the loglevel instruction.
+func reloadLogging(prev *config.Config, next *config.Config) {
+	if next.Logging.Format != prev.Logging.Format {
+		f, _ := logging.ParseFormat(next.Logging.Format)
+		logging.SetFormat(f)
 	}
+	if next.Logging.Level != prev.Logging.Level {
+		setLogLevel("", next.Logging.Level)
+	}
+}
 
-	// Start monitoring goroutine
-	go as.MonitorBlunos()
-
-	// Upon receiving new message, check if app should be running or stopped
-	for {
-		select {
-		case msg := <-us.ReadChan:
-			if as.GetState() == commsintconfig.Waiting && msg.Cmd == constants.UpstreamResumeMsg {
-				as.SetState(commsintconfig.Running)
+// logReload logs the outcome of a config reload, warning of changed settings that need a restart
+func logReload(r config.Reloaded, err error) {
+	switch {
+	case err != nil:
+		log.Error("config_reload", "err", err)
+	case len(r.Refused) > 0:
+		log.Warn("config_reload", "applied", r.Applied, "refused", r.Refused, "hint", "refused settings need a restart")
+	default:
+		log.Info("config_reload", "applied", r.Applied)
+	}
+}
 
-				// Start up goroutines
-				go outBuf.EnqueueChannelProcessor(as.MasterCtx)
-				go outBuf.DequeueProcessor(as.MasterCtx, us)
+// setLogLevel changes the log level of a subsystem, or the default level if no subsystem is given
+func setLogLevel(subsystem string, level string) {
+	l, err := logging.ParseLevel(level)
+	if err != nil {
+		log.Warn("log_level", "subsystem", subsystem, "err", err)
+		return
+	}
+	logging.SetLevel(subsystem, l)
+	log.Info("log_level", "subsystem", subsystem, "level", l)
+}
 
-				// Write out number of blunos
-				us.WriteBlunoMapping()
+// newBlunos creates a bluno for every enabled device, connected through the given adapters if any
+func newBlunos(cfg *config.Store, adapters *bluno.Adapters) []*bluno.Bluno {
+	devices := cfg.Get().EnabledDevices()
+	blunos := make([]*bluno.Bluno, 0, len(devices))
+	for _, d := range devices {
+		b := bluno.CreateBluno(d, cfg)
+		b.Adapters = adapters
+		blunos = append(blunos, b)
+	}
+	return blunos
+}
 
-				// Start application
-				go startApp(as, outBuf.EnqueueBuffer)
+// blunoUsers maps each enabled bluno's number to its user
+func blunoUsers(cfg *config.Config) map[uint8]string {
+	users := make(map[uint8]string)
+	for _, d := range cfg.EnabledDevices() {
+		users[d.Num] = d.User
+	}
+	return users
+}
 
-			} else if as.GetState() == commsintconfig.Running && msg.Cmd == constants.UpstreamResumeMsg {
-				// Send time sync packets
-				us.WriteTimestamp(msg.Data)
-			}
+// withEMGProcessing passes every outgoing packet through EMG validation and fatigue computation before it is written out
+func withEMGProcessing(cfg *config.Config, us *upstream.IOHandler, wr func(commsintconfig.Packet)) func(commsintconfig.Packet) {
+	ep := emg.CreateProcessor(&cfg.EMG, blunoUsers(cfg), us.WriteFatigue)
+	return func(p commsintconfig.Packet) {
+		for _, out := range ep.Process(p) {
+			wr(out)
 		}
-		log.Printf("Application is now in state %d", as.GetState())
 	}
 }
 
-func startApp(as *appstate.AppState, wr func(commsintconfig.Packet)) {
-	// Only one BT Client connection can be performed at a time safely via a single device
-	// Use a FIFO Semaphore (channel of size 1 in golang to ensure non-starvation in reconnection queue)
-	clientCreation := make(chan bool, 1)
-	clientCreation <- true
-	wg := sync.WaitGroup{}
-
-	for _, bs := range as.BlunoStates {
-		go bs.UpdateBlunoStatus(as.MasterCtx)
-	}
-
-	for _, b := range constants.RetrieveValidBlunos() {
-		// 1 master goroutine per bluno
-		// Asynchronously establish connection to Bluno and listen to incoming messages from peripheral
-		wg.Add(1)
-
-		go func(blno *bluno.Bluno) {
-			log.Printf("Master goroutine started for %s, addr=%s, stateUpdateChan=%v", blno.Name, blno.Address, blno.StateUpdateChan)
-			var connected bool = false
-
-			for {
-				connChan := make(chan bool, 1)
-				if !connected {
-					go blno.Connect(as.MasterCtx, clientCreation, connChan)
-
-					select {
-					case success := <-connChan:
-						connected = success
-					case <-as.MasterCtx.Done():
-						<-connChan // Await safe termination of connect attempt
-						wg.Done()
-						return
-					}
-				} else {
-					go blno.Listen(as.MasterCtx, wr, connChan)
-
-					select {
-					case success := <-connChan:
-						if success {
-							wg.Done()
-							return
-						}
-						connected = false
-					}
-				}
-			}
-		}(b)
-	}
-
-	log.Println("Waiting on goroutines...")
-	wg.Wait()
-	<-clientCreation // Drain the HCI mutex
-	log.Println("All goroutines finalized. Exiting...")
+// withSyncAnalysis passes every outgoing packet through the dancer sync analysis stage before it is written out
+func withSyncAnalysis(cfg *config.Config, us *upstream.IOHandler, wr func(commsintconfig.Packet)) func(commsintconfig.Packet) {
+	sa := analysis.CreateSyncAnalyzer(&cfg.Analysis, blunoUsers(cfg), us.WriteSyncDelay)
+	return func(p commsintconfig.Packet) {
+		sa.Observe(p)
+		wr(p)
+	}
 }
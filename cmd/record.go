@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+	"github.com/CG4002-AY2021S2-B16/comms-int/recording"
+)
+
+// recordCommand records packets from every enabled bluno to a file until interrupted, without an upstream consumer
+func recordCommand(fs *flag.FlagSet) func(cfg *config.Store) {
+	out := fs.String("out", "recording.jsonl", "file to record packets to")
+
+	return func(cfg *config.Store) {
+		adapters := openAdapters(cfg)
+		defer adapters.Stop()
+
+		rec, err := recording.CreateRecorder(*out)
+		if err != nil {
+			log.Fatal("create_recorder", "path", *out, "err", err)
+		}
+		defer rec.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		blunos := newBlunos(cfg, adapters)
+		as := newAppState(ctx, cfg.Get(), blunos)
+		as.SetState(commsintconfig.Running)
+		go as.MonitorBlunos()
+
+		log.Info("recording", "path", *out)
+		startApp(as, blunos, rec.Write)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/appstate"
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+	"github.com/CG4002-AY2021S2-B16/comms-int/recording"
+)
+
+// replayCommand relays packets from a recording upstream, so that upstream can be exercised without any blunos
+func replayCommand(fs *flag.FlagSet) func(cfg *config.Store) {
+	in := fs.String("in", "recording.jsonl", "recording to replay")
+	speed := fs.Float64("speed", 1, "replay speed relative to the recording, 0 to replay as fast as possible")
+
+	return func(cfg *config.Store) {
+		// The enabled blunos are never connected to, but are still announced upstream in the bluno mapping
+		serve(cfg, newBlunos(cfg, nil), func(as *appstate.AppState, wr func(commsintconfig.Packet)) {
+			n, err := recording.Replay(as.MasterCtx, *in, *speed, wr)
+			if err != nil {
+				log.Error("replay", "path", *in, "packets", n, "err", err)
+				return
+			}
+			log.Info("replay_finished", "path", *in, "packets", n)
+		})
+	}
+}
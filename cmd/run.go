@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/appstate"
+	"github.com/CG4002-AY2021S2-B16/comms-int/bluno"
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+	"github.com/CG4002-AY2021S2-B16/comms-int/constants"
+	"github.com/CG4002-AY2021S2-B16/comms-int/recording"
+	"github.com/CG4002-AY2021S2-B16/comms-int/upstream"
+)
+
+// runCommand relays packets from every enabled bluno upstream, recording them if recording.file is set
+func runCommand(fs *flag.FlagSet) func(cfg *config.Store) {
+	return func(cfg *config.Store) {
+		adapters := openAdapters(cfg)
+		defer adapters.Stop()
+
+		rec := newSwitchedRecorder(cfg)
+		defer rec.Close()
+
+		blunos := newBlunos(cfg, adapters)
+		serve(cfg, blunos, func(as *appstate.AppState, wr func(commsintconfig.Packet)) {
+			startApp(as, blunos, withRecorder(rec, wr))
+		})
+	}
+}
+
+// serve sets up the upstream connection and waits for the resume instruction, upon which
+// source is started to produce packets for the given blunos. Instructions from upstream are handled until
+// the app is halted, after which serve waits for source to return.
+func serve(store *config.Store, blunos []*bluno.Bluno, source func(as *appstate.AppState, wr func(commsintconfig.Packet))) {
+	// Setup application state and upstream connection
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := store.Get()
+	as := newAppState(ctx, cfg, blunos)
+
+	log.Info("awaiting_upstream")
+	us, err := upstream.NewUpstreamConnection(cfg, blunos)
+	if err != nil {
+		log.Fatal("upstream_setup", "err", err)
+	}
+	defer us.Close()
+	outBuf := upstream.CreateOutputBuffer(store)
+	for _, b := range blunos {
+		b.WriteHealth = us.WriteHealth
+	}
+	for _, bs := range as.BlunoStates {
+		bs.OnTransition = us.WriteStatus
+	}
+
+	log.Info("upstream_connected")
+
+	// Start monitoring goroutine
+	go as.MonitorBlunos()
+
+	finished := make(chan struct{})
+
+	// Upon receiving new message, check if app should be running or stopped
+	for {
+		select {
+		case msg := <-us.ReadChan:
+			if as.GetState() == commsintconfig.Waiting && msg.Cmd == constants.UpstreamResumeMsg {
+				as.SetState(commsintconfig.Running)
+
+				// Start up goroutines
+				go outBuf.EnqueueChannelProcessor(as.MasterCtx)
+				go outBuf.DequeueProcessor(as.MasterCtx, us)
+
+				// Write out number of blunos
+				us.WriteBlunoMapping()
+
+				// Start application
+				wr := withEMGProcessing(cfg, us, outBuf.EnqueueBuffer)
+				if cfg.Analysis.SyncEnabled {
+					wr = withSyncAnalysis(cfg, us, wr)
+				}
+				go func() {
+					source(as, wr)
+					close(finished)
+				}()
+
+			} else if as.GetState() == commsintconfig.Running && msg.Cmd == constants.UpstreamResumeMsg {
+				// Send time sync packets (legacy, superseded by timesync)
+				us.WriteTimestamp(msg.Data)
+			} else if msg.Cmd == constants.UpstreamTimeSyncMsg {
+				us.WriteTimeSync(msg)
+			} else if msg.Cmd == constants.UpstreamCreditMsg {
+				outBuf.AddCredits(msg.Credits)
+			} else if msg.Cmd == constants.UpstreamAckMsg {
+				us.Ack(msg.Stream, msg.Seq)
+			} else if msg.Cmd == constants.UpstreamLogLevelMsg {
+				setLogLevel(msg.Subsystem, msg.Level)
+			} else if msg.Cmd == constants.UpstreamReloadMsg {
+				r, err := store.Reload()
+				logReload(r, err)
+				us.WriteReload(r, err)
+			} else if msg.Cmd == constants.UpstreamUnquarantineMsg {
+				unquarantine(blunos, msg.Bluno)
+			} else if msg.Cmd == constants.UpstreamStatsMsg {
+				us.WriteStats(bluno.SessionReport(blunos))
+			}
+		case <-as.MasterCtx.Done():
+			if as.GetState() == commsintconfig.Running {
+				<-finished
+			}
+			if path := store.Get().Status.StatsFile; path != "" {
+				if err := writeSessionReport(path, bluno.SessionReport(blunos)); err != nil {
+					log.Error("write_stats", "path", path, "err", err)
+				} else {
+					log.Info("stats_written", "path", path)
+				}
+			}
+			return
+		}
+		log.Debug("app_state", "state", as.GetState())
+	}
+}
+
+// unquarantine lets the bluno with the given number, or every bluno if none is given, be connected to again straight away
+func unquarantine(blunos []*bluno.Bluno, num uint8) {
+	found := false
+	for _, b := range blunos {
+		if num == 0 || b.Num == num {
+			found = true
+			if !b.Unquarantine() {
+				log.Info("unquarantine", "bluno", b.Num, "err", "not quarantined")
+			}
+		}
+	}
+	if !found {
+		log.Warn("unquarantine", "bluno", num, "err", "no enabled bluno with that number")
+	}
+}
+
+// writeSessionReport atomically replaces the file at path with the given session statistics
+func writeSessionReport(path string, r commsintconfig.SessionReport) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// newAppState creates the app state, tracking the status of every given bluno
+func newAppState(ctx context.Context, cfg *config.Config, blunos []*bluno.Bluno) *appstate.AppState {
+	as := appstate.CreateAppState(ctx, cfg)
+	for _, blno := range blunos {
+		newBlnoState := appstate.CreateBlunoState(blno.Name, blno.Address, blno.State)
+		as.BlunoStates = append(as.BlunoStates, newBlnoState)
+		blno.LinkUpdateChan = newBlnoState.LinkUpdateChan
+		blno.HealthUpdateChan = newBlnoState.HealthUpdateChan
+	}
+	if len(blunos) > 0 && blunos[0].Adapters != nil { // Every bluno shares the same adapters
+		as.DialQueue = blunos[0].Adapters.Scheduler.Queue
+	}
+	return as
+}
+
+// switchedRecorder records packets to the file given by the recording settings, switching files
+// (or stopping) when they are reloaded
+type switchedRecorder struct {
+	sync.Mutex
+	path string
+	rec  *recording.Recorder
+}
+
+// newSwitchedRecorder starts recording to the configured file, if any
+func newSwitchedRecorder(cfg *config.Store) *switchedRecorder {
+	s := &switchedRecorder{}
+	if err := s.open(cfg.Get().Recording.File); err != nil {
+		log.Fatal("create_recorder", "path", cfg.Get().Recording.File, "err", err)
+	}
+	cfg.Subscribe(func(prev *config.Config, next *config.Config) {
+		if next.Recording.File != prev.Recording.File {
+			if err := s.open(next.Recording.File); err != nil {
+				log.Error("create_recorder", "path", next.Recording.File, "err", err)
+			}
+		}
+	})
+	return s
+}
+
+// open closes the current recording, and starts recording to path unless it is empty
+func (s *switchedRecorder) open(path string) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.rec != nil {
+		s.rec.Close()
+		s.rec = nil
+	}
+	s.path = path
+	if path == "" {
+		return nil
+	}
+
+	rec, err := recording.CreateRecorder(path)
+	if err != nil {
+		return err
+	}
+	s.rec = rec
+	log.Info("recording", "path", path)
+	return nil
+}
+
+// Write records a packet, if recording
+func (s *switchedRecorder) Write(p commsintconfig.Packet) {
+	s.Lock()
+	defer s.Unlock()
+	if s.rec != nil {
+		s.rec.Write(p)
+	}
+}
+
+// Close stops recording
+func (s *switchedRecorder) Close() {
+	s.open("")
+}
+
+// withRecorder records every packet received from the blunos before it is processed
+func withRecorder(rec *switchedRecorder, wr func(commsintconfig.Packet)) func(commsintconfig.Packet) {
+	return func(p commsintconfig.Packet) {
+		rec.Write(p)
+		wr(p)
+	}
+}
+
+// startApp connects to and listens to the given blunos until the app is halted
+func startApp(as *appstate.AppState, blunos []*bluno.Bluno, wr func(commsintconfig.Packet)) {
+	// Connections are established one at a time per adapter, see bluno.Adapter
+	wg := sync.WaitGroup{}
+
+	for _, bs := range as.BlunoStates {
+		go bs.UpdateBlunoStatus(as.MasterCtx)
+	}
+
+	for _, b := range blunos {
+		// 1 master goroutine per bluno
+		// Asynchronously establish connection to Bluno and listen to incoming messages from peripheral
+		wg.Add(1)
+
+		go func(blno *bluno.Bluno) {
+			log.Info("master_goroutine_started", "bluno", blno.Num, "name", blno.Name, "addr", blno.Address)
+			var connected bool = false
+
+			for {
+				connChan := make(chan bool, 1)
+				if !connected {
+					go blno.Connect(as.MasterCtx, connChan)
+
+					select {
+					case success := <-connChan:
+						connected = success
+						if !success && as.MasterCtx.Err() != nil { // Cut short by stopping, rather than retried
+							wg.Done()
+							return
+						}
+					case <-as.MasterCtx.Done():
+						<-connChan // Await safe termination of connect attempt
+						wg.Done()
+						return
+					}
+				} else {
+					go blno.Listen(as.MasterCtx, wr, connChan)
+
+					select {
+					case success := <-connChan:
+						if success {
+							wg.Done()
+							return
+						}
+						connected = false
+					}
+				}
+			}
+		}(b)
+	}
+
+	log.Info("awaiting_goroutines")
+	wg.Wait()
+	log.Info("goroutines_finalized")
+}
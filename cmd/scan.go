@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/bluno"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+)
+
+// scanCommand lists nearby blunos, marking those which are configured, and optionally enrolls them into the device registry
+// The device registry is the devices list of the config file, which may start out empty.
+func scanCommand(fs *flag.FlagSet) func(cfg *config.Store) {
+	duration := fs.Duration("duration", 5*time.Second, "how long to scan for")
+	enroll := fs.String("enroll", "", "address of a discovered bluno to enroll into the config file")
+	num := fs.Uint("num", 0, "number of the bluno to enroll")
+	user := fs.String("user", "", "user wearing the bluno to enroll")
+	name := fs.String("name", "", "name of the bluno to enroll (default Bluno<num>)")
+	interactive := fs.Bool("interactive", false, "prompt for the number and user of every discovered bluno, to enroll them")
+
+	return func(cfg *config.Store) {
+		if (*enroll != "" || *interactive) && cfg.Path() == "" {
+			log.Fatal("scan", "err", "enrolling needs a config file, given with -config or "+envPrefix+"CONFIG")
+		}
+		if *enroll != "" && (*num == 0 || *num > 255 || *user == "") {
+			log.Fatal("scan", "err", "enrolling needs -num within [1, 255] and -user")
+		}
+
+		adapters := openAdapters(cfg)
+		defer adapters.Stop()
+
+		found, err := bluno.Scan(context.Background(), *duration)
+		if err != nil {
+			log.Fatal("scan", "err", err)
+		}
+		configured := configuredDevices(cfg.Get())
+		printDiscovered(os.Stdout, found, configured)
+
+		switch {
+		case *enroll != "":
+			addr := strings.ToUpper(*enroll)
+			if !discovered(found, addr) {
+				log.Fatal("enroll", "addr", addr, "err", "bluno was not discovered, move it closer or scan for longer")
+			}
+			if err := enrollDevice(cfg.Path(), config.Device{Num: uint8(*num), Name: *name, Address: addr, User: *user, Enabled: true}); err != nil {
+				log.Fatal("enroll", "addr", addr, "path", cfg.Path(), "err", err)
+			}
+		case *interactive:
+			enrollInteractively(os.Stdin, os.Stdout, cfg.Path(), found, configured)
+		}
+	}
+}
+
+// configuredDevices maps the address of every configured device to the device
+func configuredDevices(cfg *config.Config) map[string]config.Device {
+	configured := make(map[string]config.Device)
+	for _, d := range cfg.Devices {
+		configured[strings.ToUpper(d.Address)] = d
+	}
+	return configured
+}
+
+// discovered returns true if a bluno with the given address was found while scanning
+func discovered(found []bluno.Discovered, addr string) bool {
+	for _, f := range found {
+		if f.Address == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// printDiscovered prints every bluno found while scanning, with the device it is configured as if any
+func printDiscovered(w io.Writer, found []bluno.Discovered, configured map[string]config.Device) {
+	fmt.Fprintf(w, "%-18s %-16s %6s %6s  %s\n", "ADDRESS", "NAME", "RSSI", "SEEN", "CONFIGURED")
+	for _, f := range found {
+		c := "-"
+		if d, ok := configured[f.Address]; ok {
+			c = fmt.Sprintf("%s (%d, %s)", d.Name, d.Num, d.User)
+			if !d.Enabled {
+				c += " disabled"
+			}
+		}
+		fmt.Fprintf(w, "%-18s %-16s %6d %6d  %s\n", f.Address, f.Name, f.RSSI, f.Seen, c)
+	}
+}
+
+// enrollDevice adds a device to the config file, naming it after its number if no name is given
+func enrollDevice(path string, d config.Device) error {
+	if d.Name == "" {
+		d.Name = fmt.Sprintf("Bluno%d", d.Num)
+	}
+	if err := config.Enroll(path, d); err != nil {
+		return err
+	}
+	log.Info("enrolled", "num", d.Num, "name", d.Name, "addr", d.Address, "user", d.User, "path", path)
+	return nil
+}
+
+// enrollInteractively prompts for the number and user of every discovered bluno, and enrolls those given a number
+func enrollInteractively(r io.Reader, w io.Writer, path string, found []bluno.Discovered, configured map[string]config.Device) {
+	in := bufio.NewScanner(r)
+	prompt := func(format string, args ...interface{}) (string, bool) {
+		fmt.Fprintf(w, format, args...)
+		if !in.Scan() {
+			return "", false
+		}
+		return strings.TrimSpace(in.Text()), true
+	}
+
+	for _, f := range found {
+		current := "not configured"
+		if d, ok := configured[f.Address]; ok {
+			current = fmt.Sprintf("configured as %s (%d, %s)", d.Name, d.Num, d.User)
+		}
+
+		var num uint64
+		for {
+			s, ok := prompt("\n%s %s, %d dBm, %s\nnum to enroll as (blank to skip): ", f.Address, f.Name, f.RSSI, current)
+			if !ok {
+				return
+			}
+			if s == "" {
+				break
+			}
+			n, err := strconv.ParseUint(s, 10, 8)
+			if err == nil && n > 0 {
+				num = n
+				break
+			}
+			fmt.Fprintln(w, "num must be within [1, 255]")
+		}
+		if num == 0 {
+			continue
+		}
+
+		user, ok := prompt("user: ")
+		if !ok {
+			return
+		}
+		name, ok := prompt("name (blank for Bluno%d): ", num)
+		if !ok {
+			return
+		}
+		if err := enrollDevice(path, config.Device{Num: uint8(num), Name: name, Address: f.Address, User: user, Enabled: true}); err != nil {
+			fmt.Fprintf(w, "not enrolled: %v\n", err)
+		}
+	}
+}
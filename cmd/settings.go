@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+)
+
+// envPrefix is prepended to the upper-cased path of a setting to form its environment variable
+const envPrefix = "COMMS_INT_"
+
+// Sources of a setting's value, from lowest to highest precedence
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+// settingFlag is the flag of a single setting, which holds on to the given value
+// until the config file has been loaded, since flags take precedence over the file
+type settingFlag struct {
+	field config.Field // Field of a default config, used to check values and display defaults
+	given *string
+}
+
+func (s *settingFlag) String() string {
+	if s.given != nil {
+		return *s.given
+	}
+	return s.field.String()
+}
+
+func (s *settingFlag) Set(v string) error {
+	if err := s.field.Set(v); err != nil {
+		return err
+	}
+	s.given = &v
+	return nil
+}
+
+func (s *settingFlag) IsBoolFlag() bool {
+	return s.field.IsBool()
+}
+
+// settings holds the flags of every setting and the source each resolved value came from
+type settings struct {
+	configPath *string
+	flags      map[string]*settingFlag
+	sources    map[string]string
+}
+
+// registerSettings adds a flag for every setting, and for the config file, to a flag set
+func registerSettings(fs *flag.FlagSet) *settings {
+	s := &settings{flags: make(map[string]*settingFlag), sources: make(map[string]string)}
+	defaults := config.Default()
+	for _, f := range defaults.Fields() {
+		sf := &settingFlag{field: f}
+		s.flags[f.Path] = sf
+		fs.Var(sf, f.Flag(), fmt.Sprintf("%s (env %s)", f.Usage, f.Env(envPrefix)))
+	}
+	s.configPath = fs.String("config", os.Getenv(envPrefix+"CONFIG"), "yaml config file (env "+envPrefix+"CONFIG)")
+	return s
+}
+
+// resolve loads the configuration once flags are parsed
+// Flags take precedence over environment variables, which take precedence over the config file.
+// The result is validated, so that every problem with it is reported before anything is started.
+func (s *settings) resolve() (*config.Config, error) {
+	cfg := config.Default()
+	fromFile := make(map[string]bool)
+	if *s.configPath != "" {
+		var err error
+		if cfg, err = config.Load(*s.configPath); err != nil {
+			return nil, err
+		}
+		listed, err := config.DefinesDevices(*s.configPath)
+		if err != nil {
+			return nil, err
+		}
+		if !listed { // Load falls back to the default devices
+			log.Warn("config_default_devices", "path", *s.configPath, "enabled", len(cfg.EnabledDevices()))
+		}
+		def := config.Default()
+		defaults := def.Fields()
+		for i, f := range cfg.Fields() {
+			fromFile[f.Path] = f.String() != defaults[i].String()
+		}
+	}
+
+	for _, f := range cfg.Fields() {
+		s.sources[f.Path] = sourceDefault
+		if fromFile[f.Path] {
+			s.sources[f.Path] = sourceFile
+		}
+
+		if sf := s.flags[f.Path]; sf.given != nil {
+			f.Set(*sf.given) // Already checked when the flag was parsed
+			s.sources[f.Path] = sourceFlag
+			continue
+		}
+		if v, ok := os.LookupEnv(f.Env(envPrefix)); ok {
+			if err := f.Set(v); err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %w", f.Env(envPrefix), v, err)
+			}
+			s.sources[f.Path] = sourceEnv
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// print prints the fully resolved value of every setting together with where it came from, and every enabled device
+func (s *settings) print(w io.Writer, cfg *config.Config) {
+	fmt.Fprintf(w, "session %s, resolved configuration:\n", commsintconfig.SessionID)
+	for _, f := range cfg.Fields() {
+		fmt.Fprintf(w, "  %-45s %-30s (%s)\n", f.Path, f.String(), s.sources[f.Path])
+	}
+	fmt.Fprintln(w, "  devices:")
+	for _, d := range cfg.EnabledDevices() {
+		adapter := d.Adapter
+		if adapter == "" {
+			adapter = "least loaded adapter"
+		}
+		fmt.Fprintf(w, "    %d %-12s %s %-12s via %s\n", d.Num, d.Name, d.Address, d.User, adapter)
+	}
+}
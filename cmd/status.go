@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/appstate"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+)
+
+// statusCommand prints the status last written by a running relay to the status file
+func statusCommand(fs *flag.FlagSet) func(store *config.Store) {
+	asJSON := fs.Bool("json", false, "print the status as json")
+
+	return func(store *config.Store) {
+		cfg := store.Get()
+		if cfg.Status.File == "" {
+			log.Fatal("status", "err", "status file is disabled")
+		}
+		s, err := appstate.ReadStatus(cfg.Status.File)
+		if err != nil {
+			log.Fatal("status", "path", cfg.Status.File, "err", err)
+		}
+
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(s)
+			return
+		}
+
+		age := time.Since(s.UpdatedAt).Round(time.Second)
+		fmt.Fprintf(os.Stdout, "session %s is %s (updated %s ago)\n", s.Session, s.State, age)
+		if age > 2*cfg.Status.Interval {
+			fmt.Fprintln(os.Stdout, "warning: status is stale, the relay may no longer be running")
+		}
+		for _, b := range s.Blunos {
+			link := fmt.Sprintf("for %s", time.Since(b.State.EnteredAt).Round(time.Second))
+			if b.Link != nil {
+				link += fmt.Sprintf(", via %s, rssi %d dBm (mean %.1f, min %d), interval %s, mtu %d, connected %s ago",
+					b.Link.Adapter, b.Link.RSSI, b.Link.RSSIMean, b.Link.RSSIMin, b.Link.Interval, b.Link.MTU,
+					time.Since(b.Link.ConnectedAt).Round(time.Second))
+				if b.Link.IntervalRequestErr != "" {
+					link += fmt.Sprintf(", interval request failed: %s", b.Link.IntervalRequestErr)
+				} else if b.Link.IntervalRequested != 0 {
+					link += fmt.Sprintf(", requested interval %s", b.Link.IntervalRequested)
+				}
+			}
+			if h := b.Health; h != nil {
+				link += fmt.Sprintf(", health %.2f over %d connections", h.Score, h.Connections)
+				if h.QuarantinedUntil != nil {
+					link += fmt.Sprintf(", quarantined for %s", time.Until(*h.QuarantinedUntil).Round(time.Second))
+				}
+			}
+			fmt.Fprintf(os.Stdout, "  %-18s %-12s %-15s %s\n", b.Address, b.Name, b.Status, link)
+		}
+		if q := s.DialQueue; q != nil && len(q.Dialing)+len(q.Waiting) > 0 {
+			fmt.Fprintln(os.Stdout, "connection attempts")
+			for _, d := range q.Dialing {
+				fmt.Fprintf(os.Stdout, "  %-18s dialing via %s, %d failures\n", d.Address, d.Adapter, d.Failures)
+			}
+			for i, d := range q.Waiting {
+				fmt.Fprintf(os.Stdout, "  %-18s #%d waiting %s for %s, %d failures, priority %d\n",
+					d.Address, i+1, time.Since(d.QueuedAt).Round(time.Millisecond), d.Adapter, d.Failures, d.Priority)
+			}
+		}
+	}
+}
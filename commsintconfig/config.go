@@ -4,18 +4,11 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"fmt"
+	"strconv"
 	"time"
+	"unsafe"
 )
 
-// DebugMode enables debug log messages
-var DebugMode bool = true
-
-// ProcessedPacketDisplay allows output packets to be displayed in a colored manner
-var ProcessedPacketDisplay bool = true
-
-// FineDebugMode enables debug mode at a stricter level
-var FineDebugMode bool = false
-
 // BlunoServiceUUID is the single (predecided) Service used for Serial communications from the bluno beetle
 var BlunoServiceUUID string = "0000dfb0-0000-1000-8000-00805f9b34fb"
 
@@ -49,6 +42,14 @@ var ClientCharacteristicConfig uint16 = 0x2902
 // InitHandshakeSymbol is the symbol used for handshake initialization
 var InitHandshakeSymbol byte = 'A'
 
+// TimeSyncSymbol is the symbol used to request the bluno's current time after the handshake, followed by the id of the request.
+// The bluno replies with an Ack packet carrying its current millis(), without restarting its clock.
+var TimeSyncSymbol byte = 'T'
+
+// MaxTimeSyncID is the largest id of a time sync request. Ids stay below the handshake symbols,
+// so that a Beetle which does not read the id skips over it.
+var MaxTimeSyncID byte = 0x3F
+
 // RespHandshakeSymbol is the symbol received from a successful handshake attempt
 // We can OR the 17th byte received with this to see if it returns the same value.
 // If so, the packet is indeed an ACK packet.
@@ -76,6 +77,59 @@ var ADCmask byte = 0x03
 // ExpectedPacketSize refers to the number of useful bytes of data within an incoming packet
 var ExpectedPacketSize int = 19
 
+// RevisionMask is used to extract the packet revision from the upper 4 bits of the 18th byte
+var RevisionMask byte = 0xF0
+
+// LegacyRevision refers to the original packet revision, which carries no sequence number
+var LegacyRevision byte = 0x00
+
+// SequencedRevision refers to the packet revision which carries an 8-bit sequence number in the 17th byte.
+// The sequence number wraps around after 255 and is reset to 0 by the Beetle on every handshake.
+var SequencedRevision byte = 0x10
+
+// SequenceNumberIndex is the index of the byte containing the sequence number of a sequenced packet
+var SequenceNumberIndex int = 16
+
+// BatchHandshakeSymbol follows the InitHandshakeSymbol to ask the bluno for batched notifications, along with the
+// most samples that may be batched into one. Beetles that do not support batching ignore it.
+var BatchHandshakeSymbol byte = 'B'
+
+// BatchedRevision is carried by the Ack of a bluno which agreed to send batched notifications.
+// A batched notification holds several IMU samples: a header, a delta per further sample and a checksum.
+// The header holds the number of samples (1 byte), the sensor time of the first sample (4 bytes), its sequence number
+// (1 byte) and its 6 IMU values (12 bytes), and is encrypted like the first 18 bytes of a packet.
+// Every further sample is given relative to the one before it, by the milliseconds elapsed (1 byte) and the change in
+// each IMU value (6 signed bytes), and takes the next sequence number.
+var BatchedRevision byte = 0x20
+
+// TimeSyncRevision is carried by the Ack replying to a time sync request, which echoes the id of the request in the 17th byte,
+// so that a late reply is never mistaken for the reply to a later request.
+// Beetles that do not echo the id reply with an Ack of the legacy or batched revision.
+var TimeSyncRevision byte = 0x30
+
+// BatchHeaderSize refers to the number of bytes of the header of a batched notification
+var BatchHeaderSize int = 18
+
+// BatchDeltaSize refers to the number of bytes of every further sample of a batched notification
+var BatchDeltaSize int = 7
+
+// BatchSize returns the number of bytes of a batched notification holding the given number of samples
+func BatchSize(samples int) int {
+	return BatchHeaderSize + (samples-1)*BatchDeltaSize + 1
+}
+
+// MaxBatchSamples returns the most samples a batched notification can hold within the given payload
+func MaxBatchSamples(payload int) int {
+	if payload < BatchSize(1) {
+		return 0
+	}
+	n := (payload-BatchSize(1))/BatchDeltaSize + 1
+	if n > 255 {
+		return 255
+	}
+	return n
+}
+
 // PacketType is an enum type which signifies the type of packet received from the Bluno
 type PacketType uint8
 
@@ -90,6 +144,8 @@ const (
 	Liveness PacketType = 3
 	// Invalid is a PacketType that we are not sure about
 	Invalid PacketType = 4
+	// Gap is a PacketType that marks samples which were expected but never received
+	Gap PacketType = 5
 )
 
 // Packet is constructed from a complete bluetooth response
@@ -104,10 +160,92 @@ type Packet struct {
 	Type         PacketType `json:"-"`
 	BlunoNumber  uint8      `json:"bluno"`
 	Movement     int8       `json:"movement"`
-	MuscleSensor bool       `json:"muscle_sensor"` // If this key is present, ignore the 6 IMU values - they are dummy readings.
+	MuscleSensor bool       `json:"muscle_sensor"` // If this key is true, the 6 IMU values are not present and are left as 0.
 	MAV          float32    `json:"mean_absolute_value,omitempty"`
 	RMS          float32    `json:"root_mean_square,omitempty"`
 	MNF          float32    `json:"mean_frequency,omitempty"`
+	Gap          uint32     `json:"gap,omitempty"` // If this key is present, the packet is a marker for this number of missing samples
+	EMGSamples   []uint16   `json:"-"`
+	SensorTime   uint32     `json:"-"`
+	Revision     byte       `json:"-"`
+	Sequence     uint8      `json:"-"` // Or the id of the time sync request that a time sync reply answers
+}
+
+// PacketOverhead is the estimated memory held by a queued packet, excluding its raw EMG samples
+const PacketOverhead = int(unsafe.Sizeof(Packet{}))
+
+// IsSequenced returns true if the packet carries a valid sequence number
+func (p Packet) IsSequenced() bool {
+	return p.Type != Invalid && p.Revision == SequencedRevision
+}
+
+// IsTimeSyncReply returns true if the packet is an Ack carrying the id of the time sync request it replies to
+func (p Packet) IsTimeSyncReply() bool {
+	return p.Type == Ack && p.Revision == TimeSyncRevision
+}
+
+// IMUSample is the output representation of a Data packet
+type IMUSample struct {
+	Timestamp   int64 `json:"unix_timestamp_milliseconds"`
+	X           int16 `json:"x"`
+	Y           int16 `json:"y"`
+	Z           int16 `json:"z"`
+	Pitch       int16 `json:"pitch"`
+	Roll        int16 `json:"roll"`
+	Yaw         int16 `json:"yaw"`
+	BlunoNumber uint8 `json:"bluno"`
+	Movement    int8  `json:"movement"`
+}
+
+// EMGSample is the output representation of a DataEMG packet, carrying EMG features
+type EMGSample struct {
+	Timestamp   int64   `json:"unix_timestamp_milliseconds"`
+	BlunoNumber uint8   `json:"bluno"`
+	MAV         float32 `json:"mean_absolute_value"`
+	RMS         float32 `json:"root_mean_square"`
+	MNF         float32 `json:"mean_frequency"`
+}
+
+// GapMarker is the output representation of a Gap packet
+type GapMarker struct {
+	Timestamp   int64  `json:"unix_timestamp_milliseconds"`
+	BlunoNumber uint8  `json:"bluno"`
+	Missing     uint32 `json:"missing"`
+}
+
+// IMUSample converts a Data packet to its output representation
+func (p Packet) IMUSample() IMUSample {
+	return IMUSample{
+		Timestamp:   p.Timestamp,
+		X:           p.X,
+		Y:           p.Y,
+		Z:           p.Z,
+		Pitch:       p.Pitch,
+		Roll:        p.Roll,
+		Yaw:         p.Yaw,
+		BlunoNumber: p.BlunoNumber,
+		Movement:    p.Movement,
+	}
+}
+
+// EMGSample converts a DataEMG packet to its output representation
+func (p Packet) EMGSample() EMGSample {
+	return EMGSample{
+		Timestamp:   p.Timestamp,
+		BlunoNumber: p.BlunoNumber,
+		MAV:         p.MAV,
+		RMS:         p.RMS,
+		MNF:         p.MNF,
+	}
+}
+
+// GapMarker converts a Gap packet to its output representation
+func (p Packet) GapMarker() GapMarker {
+	return GapMarker{
+		Timestamp:   p.Timestamp,
+		BlunoNumber: p.BlunoNumber,
+		Missing:     p.Gap,
+	}
 }
 
 func (p Packet) String() string {
@@ -135,17 +273,6 @@ func (p Packet) String() string {
 	return s
 }
 
-// Connection timeout parameters
-
-// ConnectionEstablishTimeout is the timeout for establishing connection, and then refreshed for handshake
-var ConnectionEstablishTimeout time.Duration = 1500 * time.Millisecond
-
-// ConnectionLivenessCheckInterval is the intervals in which it is checked whether a reconnection should be triggered
-var ConnectionLivenessCheckInterval time.Duration = 40 * time.Millisecond
-
-// ConnectionLivenessTimeout is the max leeway, after which reconnection is attempted
-var ConnectionLivenessTimeout time.Duration = 2000 * time.Millisecond
-
 // State indicates current program status
 type State int
 
@@ -156,31 +283,277 @@ const (
 	Running State = 2
 )
 
+func (s State) String() string {
+	switch s {
+	case Waiting:
+		return "waiting"
+	case Running:
+		return "running"
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
 // BLEResetString refer to the string version of "AT+RESTART<CR+LF>"
 var BLEResetString string = "AT+VERSION=?\r\n" //"AT+RESTART\r\n"
 
-// OutputSize refers to the number of packets accumulated before output is sent over to the ext comms interface
-// low number -> stream-like data
-// high number -> windowed data
-var OutputSize int = 4
-
-// OutputDequeueInterval wakes up the dequeue goroutine to send data over via ext comms interface
-var OutputDequeueInterval time.Duration = 5 * time.Millisecond
+// SessionID uniquely identifies this run of the relay, and prefixes the idempotency key of every message
+var SessionID string = strconv.FormatInt(time.Now().UnixNano(), 36)
 
 // BlunoStatus indicates the current status of blunos being managed by the int comm server
+// A bluno only moves between statuses as allowed by CanTransition.
 type BlunoStatus uint8
 
 const (
-	// NotConnected refers to a bluno that is not connected
-	NotConnected BlunoStatus = 0
+	// Disconnected refers to a bluno that is not connected, nor being connected to
+	Disconnected BlunoStatus = 0
 
-	// NotHandshaked refers to a bluno that is connected but has not had a successful handshake
-	NotHandshaked BlunoStatus = 1
+	// Dialing refers to a bluno waiting for its turn to connect, or being connected to
+	Dialing BlunoStatus = 1
 
-	// Transmitting refers to a bluno that is connected and transmitting data
-	Transmitting BlunoStatus = 2
+	// Discovering refers to a bluno that is connected, whose link is negotiated and whose characteristic is looked up
+	Discovering BlunoStatus = 2
+
+	// Subscribing refers to a bluno whose notifications are being subscribed to
+	Subscribing BlunoStatus = 3
+
+	// Handshaking refers to a bluno that has been sent the handshake, but has not acknowledged it yet
+	Handshaking BlunoStatus = 4
+
+	// Streaming refers to a bluno that is connected and transmitting data
+	Streaming BlunoStatus = 5
+
+	// Stalled refers to a bluno that is still connected, but has not transmitted anything for half of the connection liveness timeout
+	Stalled BlunoStatus = 6
+
+	// Quarantined refers to a bluno that is left alone for a while, since its connections keep failing
+	Quarantined BlunoStatus = 7
+
+	// Stopping refers to a bluno that is being disconnected from, since the relay is stopping
+	Stopping BlunoStatus = 8
 )
 
+var blunoStatusNames = [...]string{
+	Disconnected: "disconnected",
+	Dialing:      "dialing",
+	Discovering:  "discovering",
+	Subscribing:  "subscribing",
+	Handshaking:  "handshaking",
+	Streaming:    "streaming",
+	Stalled:      "stalled",
+	Quarantined:  "quarantined",
+	Stopping:     "stopping",
+}
+
+// blunoTransitions lists the statuses a bluno may move to from each status
+// Every status except Stopping may move to Stopping, and every connected status may drop to Disconnected.
+var blunoTransitions = map[BlunoStatus][]BlunoStatus{
+	Disconnected: {Dialing, Quarantined, Stopping},
+	Dialing:      {Discovering, Disconnected, Stopping},
+	Discovering:  {Subscribing, Disconnected, Stopping},
+	Subscribing:  {Handshaking, Disconnected, Stopping},
+	Handshaking:  {Streaming, Disconnected, Stopping},
+	Streaming:    {Stalled, Disconnected, Stopping},
+	Stalled:      {Streaming, Disconnected, Stopping},
+	Quarantined:  {Disconnected, Stopping},
+	Stopping:     {Disconnected},
+}
+
+func (s BlunoStatus) String() string {
+	if int(s) < len(blunoStatusNames) {
+		return blunoStatusNames[s]
+	}
+	return fmt.Sprintf("status(%d)", uint8(s))
+}
+
+// MarshalText encodes the status by name, so that consumers need not know the numbering
+func (s BlunoStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes a status from its name
+func (s *BlunoStatus) UnmarshalText(b []byte) error {
+	for i, n := range blunoStatusNames {
+		if n == string(b) {
+			*s = BlunoStatus(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown bluno status %q", b)
+}
+
+// CanTransition returns true if a bluno may move from one status to the other
+func CanTransition(from BlunoStatus, to BlunoStatus) bool {
+	for _, s := range blunoTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusTransition is a bluno moving from one status to another, sent upstream so that consumers can
+// mask the samples of a bluno that is not streaming instead of guessing from gaps
+type StatusTransition struct {
+	Bluno     uint8         `json:"bluno"`
+	User      string        `json:"user"`
+	From      BlunoStatus   `json:"from"`
+	To        BlunoStatus   `json:"to"`
+	Reason    string        `json:"reason"`
+	Duration  time.Duration `json:"duration"` // Time spent in From
+	Timestamp int64         `json:"unix_timestamp_milliseconds"`
+}
+
+// StatusReport is the status of a bluno, along with when it was entered and the time spent in every status so far
+type StatusReport struct {
+	Status      BlunoStatus              `json:"status"`
+	EnteredAt   time.Time                `json:"entered_at"`
+	Durations   map[string]time.Duration `json:"durations"` // By status name, including the time in the current status
+	Transitions uint64                   `json:"transitions"`
+	Rejected    uint64                   `json:"rejected"` // Transitions that were not allowed, and so were not made
+}
+
+// ConnectionStats are the transmission statistics of a single connection to a bluno
+type ConnectionStats struct {
+	ConnectedAt           time.Time `json:"connected_at"`
+	HandshakeAcknowledged bool      `json:"handshake_acknowledged"`
+	HandshakedAt          time.Time `json:"handshaked_at"`
+	LastPacketReceivedAt  time.Time `json:"last_packet_received_at"`
+	Batched               bool      `json:"batched"` // Whether the bluno sends batched notifications
+
+	Received              uint32 `json:"received"` // Notifications
+	ImmediatelySuccessful uint32 `json:"immediately_successful"`
+	Reconciled            uint32 `json:"reconciled"`
+	BatchedSamples        uint32 `json:"batched_samples"`
+	InvalidType           uint32 `json:"invalid_type"`
+	IncorrectLength       uint32 `json:"incorrect_length"`
+
+	Reassembled      uint32 `json:"reassembled"`
+	DroppedFragments uint32 `json:"dropped_fragments"`
+	LostToGaps       uint32 `json:"lost_to_gaps"`
+
+	Samples        uint32  `json:"samples"`
+	MissingSamples uint32  `json:"missing_samples"`
+	Duplicates     uint32  `json:"duplicates"`
+	Backwards      uint32  `json:"backwards"`
+	Resets         uint32  `json:"resets"`
+	RollingLoss    float64 `json:"rolling_loss"` // Percentage of samples lost over the loss window
+	TotalLoss      float64 `json:"total_loss"`   // Percentage of samples lost over the connection
+
+	TimeSyncs         uint32  `json:"time_syncs"`
+	TimeSyncsRejected uint32  `json:"time_syncs_rejected"`
+	DriftPPM          float64 `json:"drift_ppm"`
+
+	LeftSent  uint8 `json:"left_sent"`
+	RightSent uint8 `json:"right_sent"`
+}
+
+// ConnectionRecord is a connection to a bluno that has ended, kept in the session statistics
+type ConnectionRecord struct {
+	ConnectionStats
+	EndedAt   time.Time     `json:"ended_at"`
+	EndReason string        `json:"end_reason"`
+	Link      LinkTelemetry `json:"link"`
+}
+
+// BlunoSessionStats are the statistics of a bluno over every connection made to it since the relay started
+// The totals include the connection in progress, if any.
+type BlunoSessionStats struct {
+	Bluno   uint8  `json:"bluno"`
+	User    string `json:"user"`
+	Name    string `json:"name"`
+	Address string `json:"address"`
+
+	Connections           int           `json:"connections"` // Including the one in progress
+	HandshakedConnections int           `json:"handshaked_connections"`
+	DialFailures          int           `json:"dial_failures"`
+	ConnectedFor          time.Duration `json:"connected_for"`
+
+	Received         uint32  `json:"received"` // Notifications
+	Packets          uint32  `json:"packets"`  // Complete packets acted upon, after reassembly and batches are unpacked
+	Reassembled      uint32  `json:"reassembled"`
+	BatchedSamples   uint32  `json:"batched_samples"`
+	InvalidType      uint32  `json:"invalid_type"`
+	IncorrectLength  uint32  `json:"incorrect_length"` // Fragments, reassembled or not
+	Samples          uint32  `json:"samples"`
+	MissingSamples   uint32  `json:"missing_samples"`
+	Duplicates       uint32  `json:"duplicates"`
+	PacketsPerSecond float64 `json:"packets_per_second"` // While connected
+	InvalidRatio     float64 `json:"invalid_ratio"`      // Of the notifications received
+	TotalLoss        float64 `json:"total_loss"`         // Percentage of samples lost
+
+	Current *ConnectionStats   `json:"current,omitempty"` // The connection in progress
+	History []ConnectionRecord `json:"history"`           // Connections that have ended, oldest first
+}
+
+// SessionReport is the statistics of every bluno since the relay started
+type SessionReport struct {
+	Session     string              `json:"session"`
+	StartedAt   time.Time           `json:"started_at"`
+	GeneratedAt time.Time           `json:"generated_at"`
+	Blunos      []BlunoSessionStats `json:"blunos"`
+}
+
+// LinkTelemetry describes the radio link to a connected bluno
+// The connection parameters are those in effect when the connection was established, along with the
+// outcome of negotiating a larger MTU and shorter interval, while the RSSI is sampled periodically for as long as it lasts.
+type LinkTelemetry struct {
+	Adapter            string        `json:"adapter,omitempty"` // HCI adapter the bluno is connected through
+	ConnectedAt        time.Time     `json:"connected_at"`
+	Handle             uint16        `json:"handle"`
+	Interval           time.Duration `json:"interval"`            // Connection interval, 0 if unknown
+	Latency            uint16        `json:"latency"`             // Connection events the bluno may skip
+	SupervisionTimeout time.Duration `json:"supervision_timeout"` // Silence after which the link is lost, 0 if unknown
+	TxMTU              int           `json:"tx_mtu"`
+	RxMTU              int           `json:"rx_mtu"`
+	MTU                int           `json:"mtu"`                              // ATT MTU in effect, the lesser of TxMTU and RxMTU
+	IntervalRequested  time.Duration `json:"interval_requested"`               // Longest interval requested, 0 if none was
+	IntervalRequestErr string        `json:"interval_request_error,omitempty"` // Why the controller refused the request
+	RSSI               int           `json:"rssi"`                             // Latest sample, in dBm
+	RSSIMin            int           `json:"rssi_min"`
+	RSSIMax            int           `json:"rssi_max"`
+	RSSIMean           float64       `json:"rssi_mean"`
+	RSSISamples        uint32        `json:"rssi_samples"`
+	RSSIFailures       uint32        `json:"rssi_failures"`
+	SampledAt          time.Time     `json:"sampled_at"`
+}
+
+// MaxPayload returns the largest notification payload the link can carry, e.g. 20 bytes with the default MTU of 23
+func (l LinkTelemetry) MaxPayload() int {
+	return l.MTU - 3
+}
+
+// HealthReport describes how well the recent connections to a bluno went, and whether it is quarantined as a result
+type HealthReport struct {
+	Bluno                uint8      `json:"bluno"`
+	User                 string     `json:"user"`
+	Score                float64    `json:"score"`       // From 1 for a healthy bluno down to 0
+	Connections          int        `json:"connections"` // Within the health window
+	HandshakeFailures    int        `json:"handshake_failures"`
+	ChecksumFailureRatio float64    `json:"checksum_failure_ratio"`
+	LossRate             float64    `json:"loss_rate"` // Share of samples missing, over connections whose sample interval is known
+	Degraded             bool       `json:"degraded"`  // Quarantined, so its samples are missing until it is connected again
+	QuarantinedUntil     *time.Time `json:"quarantined_until,omitempty"`
+	Reason               string     `json:"reason"` // What prompted the report
+	At                   time.Time  `json:"at"`
+}
+
+// DialQueue describes the connection attempts in progress, and the blunos waiting for their turn to make one
+type DialQueue struct {
+	Dialing    []QueuedDial `json:"dialing"`
+	Waiting    []QueuedDial `json:"waiting"` // In the order they are given a turn, as their adapters become free
+	LastDialAt time.Time    `json:"last_dial_at"`
+}
+
+// QueuedDial is a connection attempt of a single bluno within a DialQueue
+type QueuedDial struct {
+	Address         string    `json:"address"`
+	Adapter         string    `json:"adapter"`
+	QueuedAt        time.Time `json:"queued_at"`
+	Failures        int       `json:"failures"` // Attempts failed since the bluno last transmitted
+	LastStreamingAt time.Time `json:"last_streaming_at"`
+	Priority        int       `json:"priority"` // Lower goes first
+}
+
 // AESSize refers to the standard size of the buffers used
 var AESSize int = 16
 
@@ -203,14 +576,3 @@ const (
 
 	NoShiftIndicated LateralShift = 0
 )
-
-const IndicationThreshold = 1200
-
-const (
-	IndicationLeftActivationCount         = 5
-	IndicationRightActivationCount        = 8
-	IndicationNotSentActivationCount      = 8
-	IndicationLeftReducedActivationCount  = 4
-	IndicationRightReducedActivationCount = 4
-	ReducedThresholdAllowance             = 6 * time.Second
-)
@@ -0,0 +1,355 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every tunable setting of the relay
+// It is loaded upon startup, and passed explicitly to the components that need it through a Store.
+// Settings tagged reload:"hot" may be changed while running, every other setting needs a restart.
+// Settings fixed by the Beetle firmware (UUIDs, symbols, packet layout) remain in commsintconfig.
+type Config struct {
+	Logging   Logging   `yaml:"logging" reload:"hot"`
+	BLE       BLE       `yaml:"ble"`
+	Movement  Movement  `yaml:"movement" reload:"hot"`
+	Upstream  Upstream  `yaml:"upstream"`
+	Output    Output    `yaml:"output"`
+	Analysis  Analysis  `yaml:"analysis"`
+	EMG       EMG       `yaml:"emg"`
+	Status    Status    `yaml:"status"`
+	Health    Health    `yaml:"health" reload:"hot"`
+	Recording Recording `yaml:"recording" reload:"hot"`
+	Reload    Reload    `yaml:"reload"`
+	Devices   []Device  `yaml:"devices"`
+}
+
+// Logging configures log messages
+type Logging struct {
+	Level  string `yaml:"level" usage:"default log level: trace, debug, info, warn or error"`
+	Format string `yaml:"format" usage:"log format: text for terminals, json for log aggregation"`
+}
+
+// BLE configures connections to the blunos, and the handling of the packets they send
+type BLE struct {
+	Adapters                        []string      `yaml:"adapters" usage:"HCI adapters to connect to the blunos through, comma separated e.g. hci0,hci1"`
+	ConnectionEstablishTimeout      time.Duration `yaml:"connection_establish_timeout" usage:"timeout for connecting to a bluno, and then for its handshake"`
+	DialInterval                    time.Duration `yaml:"dial_interval" usage:"shortest time between the start of any two connection attempts, across every adapter"`
+	DialPriorityAging               time.Duration `yaml:"dial_priority_aging" usage:"wait after which a bluno waiting to connect is treated as having failed one fewer time, 0 to disable"`
+	ConnectionLivenessCheckInterval time.Duration `yaml:"connection_liveness_check_interval" usage:"interval between checks of whether a bluno is still alive"`
+	ConnectionLivenessTimeout       time.Duration `yaml:"connection_liveness_timeout" usage:"silence after which a bluno connection is dropped"`
+	BeetleLivenessInterval          time.Duration `yaml:"beetle_liveness_interval" usage:"silence after which the Beetle firmware sends a liveness packet (LIVENESS_TIMEOUT)"`
+	MaxFragmentAge                  time.Duration `yaml:"max_fragment_age" usage:"age after which an unreassembled fragment is dropped, or a packet held back for a missing sequence number is released"`
+	MaxBufferedFragments            int           `yaml:"max_buffered_fragments" usage:"fragments buffered per bluno for reassembly"`
+	ReorderWindow                   int           `yaml:"reorder_window" usage:"out of order packets held back per bluno before a gap is declared"`
+	ExpectedSampleInterval          time.Duration `yaml:"expected_sample_interval" usage:"interval between samples taken by a Beetle"`
+	SensorResetThreshold            time.Duration `yaml:"sensor_reset_threshold" usage:"sensor time under which a backwards jump is treated as a Beetle restart"`
+	InsertGapMarkers                bool          `yaml:"insert_gap_markers" usage:"send markers for samples that were never received"`
+	LossWindow                      time.Duration `yaml:"loss_window" usage:"window over which the rolling sample loss is computed"`
+	LossBucketSize                  time.Duration `yaml:"loss_bucket_size" usage:"granularity of the rolling sample loss"`
+	ContinuityReportInterval        time.Duration `yaml:"continuity_report_interval" usage:"interval between sample continuity reports"`
+	TimeSyncInterval                time.Duration `yaml:"time_sync_interval" usage:"interval between time syncs with every bluno"`
+	RSSISampleInterval              time.Duration `yaml:"rssi_sample_interval" usage:"interval between samples of the signal strength of every connected bluno, 0 to disable"`
+	RequestMTU                      int           `yaml:"request_mtu" usage:"ATT MTU requested from every bluno, 23 to keep the default"`
+	ConnIntervalMin                 time.Duration `yaml:"conn_interval_min" usage:"shortest connection interval requested, a multiple of 1.25ms, 0 to keep the interval"`
+	ConnIntervalMax                 time.Duration `yaml:"conn_interval_max" usage:"longest connection interval requested, a multiple of 1.25ms"`
+	ConnSupervisionTimeout          time.Duration `yaml:"conn_supervision_timeout" usage:"supervision timeout requested along with the connection interval, a multiple of 10ms"`
+	BatchSamples                    int           `yaml:"batch_samples" usage:"most IMU samples requested in a single notification from every bluno, 1 for one sample per notification"`
+	ClockSyncWindow                 int           `yaml:"clock_sync_window" usage:"time sync samples used to estimate a bluno's clock"`
+	ClockSyncMinSamples             int           `yaml:"clock_sync_min_samples" usage:"time sync samples required before a bluno's clock estimate is used"`
+	ClockSyncMaxRTT                 time.Duration `yaml:"clock_sync_max_rtt" usage:"round trip time above which a time sync sample is rejected"`
+	EMGRawSamples                   bool          `yaml:"emg_raw_samples" usage:"decode raw EMG samples and compute features on the relay"`
+}
+
+// Movement configures detection of left and right movements from the pitch, roll and yaw of a bluno
+type Movement struct {
+	IndicationThreshold         int16         `yaml:"indication_threshold" usage:"pitch beyond which a sample indicates a movement"`
+	LeftActivationCount         uint8         `yaml:"left_activation_count" usage:"consecutive left indications that make a left movement"`
+	RightActivationCount        uint8         `yaml:"right_activation_count" usage:"consecutive right indications that make a right movement"`
+	NotSentActivationCount      uint8         `yaml:"not_sent_activation_count" usage:"consecutive resting samples that reset indications"`
+	LeftReducedActivationCount  uint8         `yaml:"left_reduced_activation_count" usage:"left indications required shortly after a movement"`
+	RightReducedActivationCount uint8         `yaml:"right_reduced_activation_count" usage:"right indications required shortly after a movement"`
+	ReducedThresholdAllowance   time.Duration `yaml:"reduced_threshold_allowance" usage:"time after a movement during which reduced counts apply"`
+}
+
+// Upstream configures the sockets to the upstream consumer and delivery over them
+type Upstream struct {
+	DataSock               string        `yaml:"data_sock" usage:"unix socket on which data is sent upstream"`
+	NotifSock              string        `yaml:"notif_sock" usage:"unix socket on which instructions are received from upstream"`
+	NotifBufferSize        int           `yaml:"notif_buffer_size" usage:"maximum size of an instruction from upstream"`
+	WriteTimeout           time.Duration `yaml:"write_timeout" usage:"deadline of every write upstream"`
+	WriterWindowQueueSize  int           `yaml:"writer_window_queue_size" usage:"windows queued for the writer without a spool"`
+	WriterControlQueueSize int           `yaml:"writer_control_queue_size" usage:"control messages queued for the writer"`
+	RetentionWindow        int           `yaml:"retention_window" usage:"unacknowledged messages retained per stream for retransmission"`
+	SpoolDir               string        `yaml:"spool_dir" usage:"directory in which undelivered windows are spooled, empty to disable"`
+	SpoolSegmentSize       int64         `yaml:"spool_segment_size" usage:"size of every spool file"`
+	SpoolMaxBytes          int64         `yaml:"spool_max_bytes" usage:"size of the spool beyond which unacknowledged windows are discarded"`
+	SpoolSyncInterval      time.Duration `yaml:"spool_sync_interval" usage:"interval at which spooled windows are flushed to disk, 0 to flush every window"`
+}
+
+// Output configures how packets are buffered and grouped into windows
+type Output struct {
+	Size                int           `yaml:"size" reload:"hot" usage:"number of packets in every window sent upstream"`
+	DequeueInterval     time.Duration `yaml:"dequeue_interval" reload:"hot" usage:"interval between windows being formed"`
+	LegacyFormat        bool          `yaml:"legacy_format" usage:"send windows as flat packet lists"`
+	MaxQueuedPackets    int           `yaml:"max_queued_packets" usage:"packets buffered before the oldest are discarded"`
+	MaxQueuedBytes      int           `yaml:"max_queued_bytes" usage:"bytes buffered before the oldest packets are discarded"`
+	ShedWatermark       float64       `yaml:"shed_watermark" usage:"fraction of the buffer beyond which low priority packets are shed"`
+	ShedLivenessDerived bool          `yaml:"shed_liveness_derived" usage:"shed gap markers beyond the watermark"`
+	ShedThinIMUFactor   int           `yaml:"shed_thin_imu_factor" usage:"keep 1 in this many IMU samples without movement beyond the watermark"`
+	ShedReportInterval  time.Duration `yaml:"shed_report_interval" usage:"interval between reports of shed packets"`
+	CreditFlowControl   bool          `yaml:"credit_flow_control" usage:"only send windows for which the consumer has granted credits"`
+	InitialCredits      int           `yaml:"initial_credits" usage:"credits granted to the consumer upon startup"`
+}
+
+// Analysis configures measurement of the sync delay between dancers
+type Analysis struct {
+	SyncEnabled             bool          `yaml:"sync_enabled" usage:"measure the sync delay between dancers"`
+	OnsetEnergyThreshold    float64       `yaml:"onset_energy_threshold" usage:"motion energy above which a dancer is moving"`
+	MotionEnergySmoothing   float64       `yaml:"motion_energy_smoothing" usage:"smoothing factor of motion energy"`
+	MotionBaselineSmoothing float64       `yaml:"motion_baseline_smoothing" usage:"smoothing factor of the resting IMU magnitude"`
+	OnsetQuietPeriod        time.Duration `yaml:"onset_quiet_period" usage:"rest required before a new movement onset"`
+	OnsetWindow             time.Duration `yaml:"onset_window" usage:"window within which onsets of every dancer make one movement"`
+	DancerActiveTimeout     time.Duration `yaml:"dancer_active_timeout" usage:"silence after which a dancer is left out of sync analysis"`
+}
+
+// EMG configures EMG feature extraction and fatigue scoring
+type EMG struct {
+	SampleRate                float64 `yaml:"sample_rate" usage:"rate at which the Beetle samples EMG, in Hz"`
+	WindowSize                int     `yaml:"window_size" usage:"raw EMG samples per feature window, a power of 2"`
+	FeatureWindow             int     `yaml:"feature_window" usage:"feature windows over which fatigue is smoothed"`
+	MaxAmplitude              float64 `yaml:"max_amplitude" usage:"largest valid EMG amplitude"`
+	MaxFrequency              float64 `yaml:"max_frequency" usage:"largest valid EMG frequency, in Hz"`
+	BaselineWindows           int     `yaml:"baseline_windows" usage:"feature windows forming a dancer's fresh baseline"`
+	FrequencyWeight           float64 `yaml:"frequency_weight" usage:"weight of the frequency shift in the fatigue score"`
+	AmplitudeWeight           float64 `yaml:"amplitude_weight" usage:"weight of the amplitude rise in the fatigue score"`
+	FullFatigueFrequencyShift float64 `yaml:"full_fatigue_frequency_shift" usage:"fractional frequency drop that alone is full fatigue"`
+	FullFatigueAmplitudeRise  float64 `yaml:"full_fatigue_amplitude_rise" usage:"fractional amplitude rise that alone is full fatigue"`
+}
+
+// Status configures the periodic status report of the relay, and the session statistics written when it stops
+type Status struct {
+	File      string        `yaml:"file" usage:"file to which the relay status is written, empty to disable"`
+	Interval  time.Duration `yaml:"interval" usage:"interval between bluno status reports"`
+	StatsFile string        `yaml:"stats_file" usage:"file to which the statistics of every bluno since the relay started are written upon stopping, empty to disable"`
+}
+
+// Health configures the health score of every bluno, and the quarantine of those that keep dropping
+// The score is the product of a factor for each of reconnects, handshake failures, checksum failures and sample loss,
+// over the connections within the window, from 1 for a healthy bluno down to 0.
+type Health struct {
+	Window              time.Duration `yaml:"window" usage:"period over which connections count towards a bluno's health score"`
+	MaxReconnects       int           `yaml:"max_reconnects" usage:"reconnects within the window at which the reconnect factor reaches 0"`
+	MinConnections      int           `yaml:"min_connections" usage:"connections within the window before a bluno can be quarantined"`
+	QuarantineThreshold float64       `yaml:"quarantine_threshold" usage:"health score under which a bluno is quarantined"`
+	QuarantineCooldown  time.Duration `yaml:"quarantine_cooldown" usage:"time a quarantined bluno is left alone before connecting to it again"`
+}
+
+// Recording configures the recording of every packet received by the run command, for later replay
+type Recording struct {
+	File string `yaml:"file" usage:"file to which every packet received is recorded, empty to disable"`
+}
+
+// Reload configures how changes to the config file are picked up while running
+type Reload struct {
+	WatchInterval time.Duration `yaml:"watch_interval" usage:"interval between checks of the config file for changes, 0 to only reload upon instruction"`
+}
+
+// Device is a bluno that the relay may connect to
+type Device struct {
+	Num     uint8  `yaml:"num"`
+	Name    string `yaml:"name"`
+	Address string `yaml:"address"`
+	User    string `yaml:"user"`
+	Enabled bool   `yaml:"enabled"`
+	Adapter string `yaml:"adapter,omitempty"` // Adapter the bluno is always connected through, otherwise the least loaded one
+
+	SampleInterval time.Duration `yaml:"sample_interval,omitempty"` // Interval between samples taken by the Beetle e.g. 128ms for EMG, otherwise ble.expected_sample_interval
+}
+
+// Default returns the default configuration
+func Default() Config {
+	return Config{
+		Logging: Logging{
+			Level:  "info",
+			Format: "text",
+		},
+		BLE: BLE{
+			Adapters:                        []string{"hci0"},
+			ConnectionEstablishTimeout:      1500 * time.Millisecond,
+			DialInterval:                    100 * time.Millisecond,
+			DialPriorityAging:               5 * time.Second,
+			ConnectionLivenessCheckInterval: 40 * time.Millisecond,
+			ConnectionLivenessTimeout:       2000 * time.Millisecond,
+			BeetleLivenessInterval:          800 * time.Millisecond,
+			MaxFragmentAge:                  250 * time.Millisecond,
+			MaxBufferedFragments:            8,
+			ReorderWindow:                   8,
+			ExpectedSampleInterval:          20 * time.Millisecond,
+			SensorResetThreshold:            5 * time.Second,
+			InsertGapMarkers:                false,
+			LossWindow:                      10 * time.Second,
+			LossBucketSize:                  1 * time.Second,
+			ContinuityReportInterval:        5 * time.Second,
+			TimeSyncInterval:                10 * time.Second,
+			RSSISampleInterval:              1 * time.Second,
+			RequestMTU:                      185,
+			ConnIntervalMin:                 7500 * time.Microsecond,
+			ConnIntervalMax:                 15 * time.Millisecond,
+			ConnSupervisionTimeout:          2 * time.Second,
+			BatchSamples:                    8,
+			ClockSyncWindow:                 16,
+			ClockSyncMinSamples:             3,
+			ClockSyncMaxRTT:                 150 * time.Millisecond,
+			EMGRawSamples:                   false,
+		},
+		Movement: Movement{
+			IndicationThreshold:         1200,
+			LeftActivationCount:         5,
+			RightActivationCount:        8,
+			NotSentActivationCount:      8,
+			LeftReducedActivationCount:  4,
+			RightReducedActivationCount: 4,
+			ReducedThresholdAllowance:   6 * time.Second,
+		},
+		Upstream: Upstream{
+			DataSock:               "/tmp/www/comms/data.sock",
+			NotifSock:              "/tmp/www/comms/notif.sock",
+			NotifBufferSize:        1000,
+			WriteTimeout:           500 * time.Millisecond,
+			WriterWindowQueueSize:  4,
+			WriterControlQueueSize: 64,
+			RetentionWindow:        256,
+			SpoolDir:               "",
+			SpoolSegmentSize:       1 << 20,
+			SpoolMaxBytes:          64 << 20,
+			SpoolSyncInterval:      time.Second,
+		},
+		Output: Output{
+			Size:                4,
+			DequeueInterval:     5 * time.Millisecond,
+			LegacyFormat:        false,
+			MaxQueuedPackets:    2048,
+			MaxQueuedBytes:      1 << 20,
+			ShedWatermark:       0.75,
+			ShedLivenessDerived: true,
+			ShedThinIMUFactor:   2,
+			ShedReportInterval:  5 * time.Second,
+			CreditFlowControl:   false,
+			InitialCredits:      8,
+		},
+		Analysis: Analysis{
+			SyncEnabled:             false,
+			OnsetEnergyThreshold:    1500,
+			MotionEnergySmoothing:   0.3,
+			MotionBaselineSmoothing: 0.02,
+			OnsetQuietPeriod:        500 * time.Millisecond,
+			OnsetWindow:             3 * time.Second,
+			DancerActiveTimeout:     2 * time.Second,
+		},
+		EMG: EMG{
+			SampleRate:                500,
+			WindowSize:                256,
+			FeatureWindow:             20,
+			MaxAmplitude:              1023,
+			MaxFrequency:              500,
+			BaselineWindows:           5,
+			FrequencyWeight:           0.7,
+			AmplitudeWeight:           0.3,
+			FullFatigueFrequencyShift: 0.25,
+			FullFatigueAmplitudeRise:  0.5,
+		},
+		Status: Status{
+			File:      "/tmp/www/comms/status.json",
+			Interval:  5000 * time.Millisecond,
+			StatsFile: "/tmp/www/comms/stats.json",
+		},
+		Health: Health{
+			Window:              5 * time.Minute,
+			MaxReconnects:       10,
+			MinConnections:      4,
+			QuarantineThreshold: 0.5,
+			QuarantineCooldown:  2 * time.Minute,
+		},
+		Recording: Recording{
+			File: "",
+		},
+		Reload: Reload{
+			WatchInterval: 2 * time.Second,
+		},
+		Devices: []Device{
+			{Num: 1, Name: "BlunoOne", Address: "80:30:DC:E9:1C:34", User: "elston"},
+			{Num: 2, Name: "BlunoTwo", Address: "80:30:DC:D9:0C:B2", User: "tamelly", Enabled: true},
+			{Num: 3, Name: "BlunoThree", Address: "80:30:DC:D9:1F:F0", User: "matthew"},
+			{Num: 4, Name: "BlunoFour", Address: "34:B1:F7:D2:37:0C", User: "sujay"},
+			{Num: 5, Name: "BlunoFive", Address: "80:30:DC:D9:23:4C", User: "ziyun", Enabled: true},
+			{Num: 6, Name: "BlunoSix", Address: "80:30:DC:D9:23:40", User: "denise", Enabled: true},
+		},
+	}
+}
+
+// Load reads the yaml config file at the given path over the default configuration
+// Settings missing from the file keep their defaults, while unknown settings are an error.
+// The result is not validated, so that it can be overridden before Validate is called.
+func Load(path string) (Config, error) {
+	c := Default()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, fmt.Errorf("reading config file: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil && err != io.EOF { // An empty file keeps every default
+		return c, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// DefinesDevices returns true if the yaml config file at path lists devices, otherwise Load gives the default devices
+func DefinesDevices(path string) (bool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("reading config file: %w", err)
+	}
+	_, ok, err := fileDevices(b)
+	if err != nil {
+		return false, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return ok, nil
+}
+
+// fileDevices returns the devices listed by a yaml config file, and whether it lists devices at all
+func fileDevices(b []byte) ([]Device, bool, error) {
+	var f struct {
+		Devices *[]Device `yaml:"devices"`
+	}
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return nil, false, err
+	}
+	if f.Devices == nil {
+		return nil, false, nil
+	}
+	return *f.Devices, true, nil
+}
+
+// EnabledDevices returns the devices that the relay should connect to
+func (c *Config) EnabledDevices() []Device {
+	var out []Device
+	for _, d := range c.Devices {
+		if d.Enabled {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// Marshal returns the configuration as yaml, e.g. to print the resolved configuration or to write a config file
+func (c *Config) Marshal() ([]byte, error) {
+	return yaml.Marshal(c)
+}
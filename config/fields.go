@@ -0,0 +1,144 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Field is a single scalar setting within a configuration, addressed by its dotted yaml path e.g. output.size
+// Hot settings are safe to change while running, see Store.Apply.
+type Field struct {
+	Path  string
+	Usage string
+	Hot   bool
+	value reflect.Value
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	stringsType  = reflect.TypeOf([]string(nil))
+)
+
+// Fields returns every scalar setting of the configuration, in declaration order
+// The fields refer to the configuration they were taken from, so that setting them changes it.
+// Lists of strings are given comma separated, other lists, such as the devices, are left out since they can only be given in a config file.
+func (c *Config) Fields() []Field {
+	var out []Field
+	walk(reflect.ValueOf(c).Elem(), "", false, &out)
+	return out
+}
+
+// Field returns the setting with the given path
+func (c *Config) Field(path string) (Field, bool) {
+	for _, f := range c.Fields() {
+		if f.Path == path {
+			return f, true
+		}
+	}
+	return Field{}, false
+}
+
+// walk appends every scalar setting within a struct, which are hot if they, or a struct containing them, are tagged reload:"hot"
+func walk(v reflect.Value, prefix string, hot bool, out *[]Field) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name := strings.Split(sf.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		path := prefix + name
+		fv := v.Field(i)
+		fieldHot := hot || sf.Tag.Get("reload") == "hot"
+
+		switch {
+		case fv.Kind() == reflect.Struct:
+			walk(fv, path+".", fieldHot, out)
+		case (fv.Kind() == reflect.Slice && fv.Type() != stringsType) || fv.Kind() == reflect.Map:
+			continue
+		default:
+			*out = append(*out, Field{Path: path, Usage: sf.Tag.Get("usage"), Hot: fieldHot, value: fv})
+		}
+	}
+}
+
+// Env returns the environment variable that overrides the setting, e.g. COMMS_INT_OUTPUT_SIZE
+func (f Field) Env(prefix string) string {
+	return prefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(f.Path))
+}
+
+// Flag returns the command line flag that overrides the setting, e.g. output.size
+func (f Field) Flag() string {
+	return strings.Replace(f.Path, "_", "-", -1)
+}
+
+// IsBool returns true if the setting is a boolean
+func (f Field) IsBool() bool {
+	return f.value.Kind() == reflect.Bool
+}
+
+func (f Field) String() string {
+	if !f.value.IsValid() {
+		return ""
+	}
+	if f.value.Type() == durationType {
+		return time.Duration(f.value.Int()).String()
+	}
+	if f.value.Type() == stringsType {
+		return strings.Join(f.value.Interface().([]string), ",")
+	}
+	return fmt.Sprint(f.value.Interface())
+}
+
+// Set parses a value and assigns it to the setting
+func (f Field) Set(s string) error {
+	v := f.value
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Type() == stringsType:
+		var list []string
+		for _, e := range strings.Split(s, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				list = append(list, e)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() >= reflect.Int && v.Kind() <= reflect.Int64:
+		n, err := strconv.ParseInt(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case v.Kind() >= reflect.Uint && v.Kind() <= reflect.Uint64:
+		n, err := strconv.ParseUint(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
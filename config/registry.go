@@ -0,0 +1,87 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Enroll adds a device to the device registry, i.e. the devices of the config file at path,
+// replacing any device with the same address or number
+// Only the devices are rewritten, so every other setting in the file (and its comments) is kept as is.
+// The file is created if it does not exist. A missing or empty file starts without any devices, rather than the defaults.
+// The resulting configuration is validated before the file is written.
+func Enroll(path string, d Device) error {
+	doc := yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	cfg := Default()
+	cfg.Devices = nil
+
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return fmt.Errorf("reading config file: %w", err)
+	case len(bytes.TrimSpace(b)) == 0:
+	default:
+		if cfg, err = Load(path); err != nil {
+			return err
+		}
+		if cfg.Devices, _, err = fileDevices(b); err != nil { // Not the default devices, which Load gives if none are listed
+			return fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+		if err := yaml.Unmarshal(b, &doc); err != nil {
+			return fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("config file %s is not a yaml mapping", path)
+	}
+
+	d.Address = strings.ToUpper(d.Address)
+	devices := make([]Device, 0, len(cfg.Devices)+1)
+	for _, e := range cfg.Devices {
+		if strings.ToUpper(e.Address) == d.Address || e.Num == d.Num {
+			continue
+		}
+		devices = append(devices, e)
+	}
+	cfg.Devices = append(devices, d)
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	var list yaml.Node
+	if err := list.Encode(cfg.Devices); err != nil {
+		return err
+	}
+	setKey(root, "devices", &list)
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	enc.Close()
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, out.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// setKey sets the value of a key within a yaml mapping, appending the key if it is missing
+func setKey(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
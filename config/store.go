@@ -0,0 +1,134 @@
+package config
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Store holds the running configuration, whose hot settings may be replaced while running
+// Every configuration handed out by Get is immutable, so it can be read without locking.
+// Components read hot settings through Get whenever they are used, while other settings
+// may be kept from the configuration the component was created with.
+type Store struct {
+	sync.Mutex  // Serializes Apply
+	current     atomic.Value
+	path        string
+	source      func() (*Config, error)
+	subscribers []func(prev *Config, next *Config)
+}
+
+// Reloaded reports the result of applying a new configuration
+type Reloaded struct {
+	Applied []string `json:"applied"` // Hot settings that were changed
+	Refused []string `json:"refused"` // Settings that were changed, but need a restart to take effect
+}
+
+// NewStore creates a store holding the given configuration, loaded from the config file at path if one was given
+// source resolves the configuration afresh upon Reload, e.g. from the config file and any overrides of it.
+func NewStore(c *Config, path string, source func() (*Config, error)) *Store {
+	s := &Store{path: path, source: source}
+	s.current.Store(c)
+	return s
+}
+
+// Path returns the path of the config file, or an empty string if there is none
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Get returns the current configuration, which must not be modified
+func (s *Store) Get() *Config {
+	return s.current.Load().(*Config)
+}
+
+// Subscribe registers a function to be called after hot settings have been changed
+func (s *Store) Subscribe(f func(prev *Config, next *Config)) {
+	s.Lock()
+	defer s.Unlock()
+	s.subscribers = append(s.subscribers, f)
+}
+
+// Apply replaces the hot settings of the current configuration with those of next
+// Every other setting that differs, including the device list, is left unchanged and reported as refused.
+// The resulting configuration is validated before it replaces the current one.
+func (s *Store) Apply(next Config) (Reloaded, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.apply(next)
+}
+
+// Reload resolves the configuration from the source of the store, and applies it
+func (s *Store) Reload() (Reloaded, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	next, err := s.source()
+	if err != nil {
+		return Reloaded{}, err
+	}
+	return s.apply(*next)
+}
+
+// Watch reloads the configuration whenever the config file is modified, and reports the result of every reload
+// The file is checked at the given interval until ctx is done.
+func (s *Store) Watch(ctx context.Context, interval time.Duration, report func(Reloaded, error)) {
+	var modified time.Time
+	if fi, err := os.Stat(s.path); err == nil {
+		modified = fi.ModTime()
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			fi, err := os.Stat(s.path)
+			if err != nil || fi.ModTime().Equal(modified) {
+				continue
+			}
+			modified = fi.ModTime()
+			report(s.Reload())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Store) apply(next Config) (Reloaded, error) {
+	var r Reloaded
+	prev := s.Get()
+	merged := *prev
+	if !reflect.DeepEqual(prev.Devices, next.Devices) {
+		r.Refused = append(r.Refused, "devices")
+	}
+
+	prevFields := prev.Fields() // Only read, prev is never modified
+	mergedFields := merged.Fields()
+	for i, f := range next.Fields() {
+		if reflect.DeepEqual(f.value.Interface(), prevFields[i].value.Interface()) {
+			continue
+		}
+		if !f.Hot {
+			r.Refused = append(r.Refused, f.Path)
+			continue
+		}
+		mergedFields[i].value.Set(f.value)
+		r.Applied = append(r.Applied, f.Path)
+	}
+
+	if len(r.Applied) == 0 {
+		return r, nil
+	}
+	if err := merged.Validate(); err != nil {
+		return Reloaded{}, err
+	}
+	s.current.Store(&merged)
+	for _, f := range s.subscribers {
+		f(prev, &merged)
+	}
+	return r, nil
+}
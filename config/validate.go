@@ -0,0 +1,209 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/CG4002-AY2021S2-B16/comms-int/logging"
+)
+
+// adapterPattern matches the names of HCI adapters
+var adapterPattern = regexp.MustCompile(`^hci[0-9]+$`)
+
+// ValidationError lists every problem found with a configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// validator accumulates problems, so that every one of them is reported at once
+type validator struct {
+	problems []string
+}
+
+func (v *validator) check(ok bool, format string, args ...interface{}) {
+	if !ok {
+		v.problems = append(v.problems, fmt.Sprintf(format, args...))
+	}
+}
+
+func (v *validator) positive(name string, d time.Duration) {
+	v.check(d > 0, "%s must be positive, got %s", name, d)
+}
+
+func (v *validator) atLeast(name string, n int, min int) {
+	v.check(n >= min, "%s must be at least %d, got %d", name, min, n)
+}
+
+func (v *validator) fraction(name string, f float64) {
+	v.check(f > 0 && f <= 1, "%s must be within (0, 1], got %g", name, f)
+}
+
+// Validate checks that every setting is usable, and that related settings are consistent with each other
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	_, err := logging.ParseLevel(c.Logging.Level)
+	v.check(err == nil, "logging.level: %v", err)
+	_, err = logging.ParseFormat(c.Logging.Format)
+	v.check(err == nil, "logging.format: %v", err)
+
+	b := c.BLE
+	v.check(len(b.Adapters) > 0, "ble.adapters: at least one adapter must be given")
+	adapters := make(map[string]bool)
+	for _, a := range b.Adapters {
+		v.check(adapterPattern.MatchString(a), "ble.adapters: %q is not an HCI adapter such as hci0", a)
+		v.check(!adapters[a], "ble.adapters: %s is given more than once", a)
+		adapters[a] = true
+	}
+	v.positive("ble.connection_establish_timeout", b.ConnectionEstablishTimeout)
+	v.check(b.DialInterval >= 0, "ble.dial_interval must not be negative, got %s", b.DialInterval)
+	v.check(b.DialPriorityAging >= 0, "ble.dial_priority_aging must not be negative, got %s", b.DialPriorityAging)
+	v.positive("ble.connection_liveness_check_interval", b.ConnectionLivenessCheckInterval)
+	v.positive("ble.beetle_liveness_interval", b.BeetleLivenessInterval)
+	v.check(b.ConnectionLivenessTimeout > b.BeetleLivenessInterval,
+		"ble.connection_liveness_timeout (%s) must be greater than ble.beetle_liveness_interval (%s), "+
+			"otherwise idle blunos are disconnected before they send a liveness packet",
+		b.ConnectionLivenessTimeout, b.BeetleLivenessInterval)
+	v.check(b.ConnectionLivenessCheckInterval < b.ConnectionLivenessTimeout,
+		"ble.connection_liveness_check_interval (%s) must be less than ble.connection_liveness_timeout (%s)",
+		b.ConnectionLivenessCheckInterval, b.ConnectionLivenessTimeout)
+	v.positive("ble.max_fragment_age", b.MaxFragmentAge)
+	v.atLeast("ble.max_buffered_fragments", b.MaxBufferedFragments, 2)
+	v.atLeast("ble.reorder_window", b.ReorderWindow, 1)
+	v.positive("ble.expected_sample_interval", b.ExpectedSampleInterval)
+	v.positive("ble.loss_bucket_size", b.LossBucketSize)
+	v.check(b.LossWindow >= b.LossBucketSize, "ble.loss_window (%s) must be at least ble.loss_bucket_size (%s)", b.LossWindow, b.LossBucketSize)
+	v.positive("ble.continuity_report_interval", b.ContinuityReportInterval)
+	v.positive("ble.time_sync_interval", b.TimeSyncInterval)
+	v.check(b.RSSISampleInterval >= 0, "ble.rssi_sample_interval must not be negative, got %s", b.RSSISampleInterval)
+	v.check(b.RequestMTU >= 23 && b.RequestMTU <= 515, "ble.request_mtu must be within [23, 515], got %d", b.RequestMTU)
+	if b.ConnIntervalMin != 0 {
+		v.check(b.ConnIntervalMin >= 7500*time.Microsecond && b.ConnIntervalMax <= 4*time.Second && b.ConnIntervalMin <= b.ConnIntervalMax,
+			"ble.conn_interval_min (%s) and ble.conn_interval_max (%s) must be within [7.5ms, 4s], the min being at most the max",
+			b.ConnIntervalMin, b.ConnIntervalMax)
+		v.check(b.ConnIntervalMin%(1250*time.Microsecond) == 0 && b.ConnIntervalMax%(1250*time.Microsecond) == 0,
+			"ble.conn_interval_min (%s) and ble.conn_interval_max (%s) must be multiples of 1.25ms", b.ConnIntervalMin, b.ConnIntervalMax)
+		v.check(b.ConnSupervisionTimeout >= 100*time.Millisecond && b.ConnSupervisionTimeout <= 32*time.Second &&
+			b.ConnSupervisionTimeout%(10*time.Millisecond) == 0,
+			"ble.conn_supervision_timeout must be a multiple of 10ms within [100ms, 32s], got %s", b.ConnSupervisionTimeout)
+		v.check(b.ConnSupervisionTimeout > 2*b.ConnIntervalMax,
+			"ble.conn_supervision_timeout (%s) must be greater than twice ble.conn_interval_max (%s)", b.ConnSupervisionTimeout, b.ConnIntervalMax)
+	}
+	v.check(b.BatchSamples >= 1 && b.BatchSamples <= 255, "ble.batch_samples must be within [1, 255], got %d", b.BatchSamples)
+	if b.BatchSamples > 1 {
+		v.check(commsintconfig.BatchSize(b.BatchSamples) <= b.RequestMTU-3,
+			"ble.batch_samples (%d) needs notifications of %d bytes, which do not fit within ble.request_mtu (%d) less 3 bytes of ATT header",
+			b.BatchSamples, commsintconfig.BatchSize(b.BatchSamples), b.RequestMTU)
+	}
+	v.atLeast("ble.clock_sync_min_samples", b.ClockSyncMinSamples, 2)
+	v.check(b.ClockSyncWindow >= b.ClockSyncMinSamples, "ble.clock_sync_window (%d) must be at least ble.clock_sync_min_samples (%d)",
+		b.ClockSyncWindow, b.ClockSyncMinSamples)
+	v.positive("ble.clock_sync_max_rtt", b.ClockSyncMaxRTT)
+
+	m := c.Movement
+	v.check(m.IndicationThreshold > 0, "movement.indication_threshold must be positive, got %d", m.IndicationThreshold)
+	v.atLeast("movement.left_activation_count", int(m.LeftActivationCount), 1)
+	v.atLeast("movement.right_activation_count", int(m.RightActivationCount), 1)
+	v.atLeast("movement.not_sent_activation_count", int(m.NotSentActivationCount), 1)
+	v.check(m.LeftReducedActivationCount >= 1 && m.LeftReducedActivationCount <= m.LeftActivationCount,
+		"movement.left_reduced_activation_count (%d) must be within [1, movement.left_activation_count (%d)]",
+		m.LeftReducedActivationCount, m.LeftActivationCount)
+	v.check(m.RightReducedActivationCount >= 1 && m.RightReducedActivationCount <= m.RightActivationCount,
+		"movement.right_reduced_activation_count (%d) must be within [1, movement.right_activation_count (%d)]",
+		m.RightReducedActivationCount, m.RightActivationCount)
+
+	u := c.Upstream
+	v.check(u.DataSock != "", "upstream.data_sock must be set")
+	v.check(u.NotifSock != "", "upstream.notif_sock must be set")
+	v.check(u.DataSock != u.NotifSock, "upstream.data_sock and upstream.notif_sock must differ, both are %s", u.DataSock)
+	v.atLeast("upstream.notif_buffer_size", u.NotifBufferSize, 64)
+	v.positive("upstream.write_timeout", u.WriteTimeout)
+	v.atLeast("upstream.writer_window_queue_size", u.WriterWindowQueueSize, 1)
+	v.atLeast("upstream.writer_control_queue_size", u.WriterControlQueueSize, 1)
+	v.atLeast("upstream.retention_window", u.RetentionWindow, 1)
+	if u.SpoolDir != "" {
+		v.check(u.SpoolSegmentSize > 0, "upstream.spool_segment_size must be positive, got %d", u.SpoolSegmentSize)
+		v.check(u.SpoolMaxBytes >= u.SpoolSegmentSize, "upstream.spool_max_bytes (%d) must be at least upstream.spool_segment_size (%d)",
+			u.SpoolMaxBytes, u.SpoolSegmentSize)
+		v.check(u.SpoolSyncInterval >= 0, "upstream.spool_sync_interval must not be negative, got %s", u.SpoolSyncInterval)
+	}
+
+	o := c.Output
+	v.atLeast("output.size", o.Size, 1)
+	v.positive("output.dequeue_interval", o.DequeueInterval)
+	v.check(o.MaxQueuedPackets >= o.Size, "output.max_queued_packets (%d) must be at least output.size (%d)", o.MaxQueuedPackets, o.Size)
+	v.check(o.MaxQueuedBytes >= o.Size*commsintconfig.PacketOverhead, "output.max_queued_bytes (%d) must hold at least output.size (%d) packets of %d bytes",
+		o.MaxQueuedBytes, o.Size, commsintconfig.PacketOverhead)
+	v.fraction("output.shed_watermark", o.ShedWatermark)
+	v.atLeast("output.shed_thin_imu_factor", o.ShedThinIMUFactor, 1)
+	v.positive("output.shed_report_interval", o.ShedReportInterval)
+	if o.CreditFlowControl {
+		v.atLeast("output.initial_credits", o.InitialCredits, 0)
+	}
+
+	a := c.Analysis
+	if a.SyncEnabled {
+		v.check(a.OnsetEnergyThreshold > 0, "analysis.onset_energy_threshold must be positive, got %g", a.OnsetEnergyThreshold)
+		v.fraction("analysis.motion_energy_smoothing", a.MotionEnergySmoothing)
+		v.fraction("analysis.motion_baseline_smoothing", a.MotionBaselineSmoothing)
+		v.positive("analysis.onset_window", a.OnsetWindow)
+		v.positive("analysis.dancer_active_timeout", a.DancerActiveTimeout)
+	}
+
+	e := c.EMG
+	v.check(e.SampleRate > 0, "emg.sample_rate must be positive, got %g", e.SampleRate)
+	v.check(e.WindowSize >= 2 && e.WindowSize&(e.WindowSize-1) == 0, "emg.window_size must be a power of 2, got %d", e.WindowSize)
+	v.atLeast("emg.feature_window", e.FeatureWindow, 1)
+	v.atLeast("emg.baseline_windows", e.BaselineWindows, 1)
+	v.check(e.MaxFrequency > 0 && e.MaxFrequency <= e.SampleRate, "emg.max_frequency (%g) must be within (0, emg.sample_rate (%g)]",
+		e.MaxFrequency, e.SampleRate)
+	v.check(e.FrequencyWeight >= 0 && e.AmplitudeWeight >= 0 && e.FrequencyWeight+e.AmplitudeWeight > 0,
+		"emg.frequency_weight (%g) and emg.amplitude_weight (%g) must not be negative, and must not both be 0",
+		e.FrequencyWeight, e.AmplitudeWeight)
+	v.fraction("emg.full_fatigue_frequency_shift", e.FullFatigueFrequencyShift)
+	v.check(e.FullFatigueAmplitudeRise > 0, "emg.full_fatigue_amplitude_rise must be positive, got %g", e.FullFatigueAmplitudeRise)
+
+	v.positive("status.interval", c.Status.Interval)
+	h := c.Health
+	v.positive("health.window", h.Window)
+	v.atLeast("health.max_reconnects", h.MaxReconnects, 1)
+	v.atLeast("health.min_connections", h.MinConnections, 1)
+	v.fraction("health.quarantine_threshold", h.QuarantineThreshold)
+	v.positive("health.quarantine_cooldown", h.QuarantineCooldown)
+
+	v.check(c.Reload.WatchInterval >= 0, "reload.watch_interval must not be negative, got %s", c.Reload.WatchInterval)
+
+	nums := make(map[uint8]string)
+	addrs := make(map[string]string)
+	for i, d := range c.Devices {
+		name := fmt.Sprintf("devices[%d] (%s)", i, d.Name)
+		v.check(d.Num != 0, "%s: num must be set", name)
+		v.check(d.Name != "", "%s: name must be set", name)
+		_, err := net.ParseMAC(d.Address)
+		v.check(err == nil, "%s: address %q is not a bluetooth address such as 80:30:DC:D9:0C:B2", name, d.Address)
+		if other, ok := nums[d.Num]; ok {
+			v.check(false, "%s: num %d is already used by %s", name, d.Num, other)
+		}
+		if other, ok := addrs[strings.ToUpper(d.Address)]; ok {
+			v.check(false, "%s: address %s is already used by %s", name, d.Address, other)
+		}
+		v.check(d.Adapter == "" || adapters[d.Adapter], "%s: adapter %s is not one of ble.adapters", name, d.Adapter)
+		v.check(d.SampleInterval >= 0, "%s: sample_interval must not be negative, got %s", name, d.SampleInterval)
+		nums[d.Num] = d.Name
+		addrs[strings.ToUpper(d.Address)] = d.Name
+	}
+	v.check(len(c.EnabledDevices()) > 0, "devices: at least one device must be enabled")
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
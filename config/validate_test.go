@@ -0,0 +1,143 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultIsValid(t *testing.T) {
+	cfg := Default()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("default configuration is invalid: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   []string // Problems reported, in order
+	}{
+		{
+			"liveness timeout shorter than the beetle liveness interval",
+			func(c *Config) { c.BLE.ConnectionLivenessTimeout = 500 * time.Millisecond },
+			[]string{"ble.connection_liveness_timeout (500ms) must be greater than ble.beetle_liveness_interval (800ms), " +
+				"otherwise idle blunos are disconnected before they send a liveness packet"},
+		},
+		{
+			"liveness timeout equal to the beetle liveness interval",
+			func(c *Config) { c.BLE.ConnectionLivenessTimeout = c.BLE.BeetleLivenessInterval },
+			[]string{"ble.connection_liveness_timeout (800ms) must be greater than ble.beetle_liveness_interval (800ms), " +
+				"otherwise idle blunos are disconnected before they send a liveness packet"},
+		},
+		{
+			"liveness check no more often than the timeout",
+			func(c *Config) { c.BLE.ConnectionLivenessCheckInterval = 3 * time.Second },
+			[]string{"ble.connection_liveness_check_interval (3s) must be less than ble.connection_liveness_timeout (2s)"},
+		},
+		{
+			"no adapters",
+			func(c *Config) { c.BLE.Adapters = nil },
+			[]string{"ble.adapters: at least one adapter must be given"},
+		},
+		{
+			"repeated and misnamed adapters",
+			func(c *Config) { c.BLE.Adapters = []string{"hci0", "hci0", "usb1"} },
+			[]string{"ble.adapters: hci0 is given more than once", `ble.adapters: "usb1" is not an HCI adapter such as hci0`},
+		},
+		{
+			"non-positive durations",
+			func(c *Config) {
+				c.BLE.MaxFragmentAge = 0
+				c.Status.Interval = -time.Second
+			},
+			[]string{"ble.max_fragment_age must be positive, got 0s", "status.interval must be positive, got -1s"},
+		},
+		{
+			"too few buffered fragments",
+			func(c *Config) { c.BLE.MaxBufferedFragments = 1 },
+			[]string{"ble.max_buffered_fragments must be at least 2, got 1"},
+		},
+		{
+			"mtu out of range",
+			func(c *Config) { c.BLE.RequestMTU = 600 },
+			[]string{"ble.request_mtu must be within [23, 515], got 600"},
+		},
+		{
+			"batch larger than the mtu",
+			func(c *Config) {
+				c.BLE.RequestMTU = 23
+				c.BLE.BatchSamples = 8
+			},
+			[]string{"ble.batch_samples (8) needs notifications of"},
+		},
+		{
+			"shed watermark out of range",
+			func(c *Config) { c.Output.ShedWatermark = 1.5 },
+			[]string{"output.shed_watermark must be within (0, 1], got 1.5"},
+		},
+		{
+			"queued bytes smaller than a window",
+			func(c *Config) { c.Output.MaxQueuedBytes = 1 },
+			[]string{"output.max_queued_bytes (1) must hold at least output.size"},
+		},
+		{
+			"same socket for data and notifications",
+			func(c *Config) { c.Upstream.NotifSock = c.Upstream.DataSock },
+			[]string{"upstream.data_sock and upstream.notif_sock must differ"},
+		},
+		{
+			"repeated device",
+			func(c *Config) {
+				c.Devices = append(c.Devices[:2], Device{Num: 2, Name: "Again", Address: "80:30:dc:d9:0c:b2"})
+			},
+			[]string{"devices[2] (Again): num 2 is already used by BlunoTwo", "devices[2] (Again): address 80:30:dc:d9:0c:b2 is already used by BlunoTwo"},
+		},
+		{
+			"device through an unknown adapter",
+			func(c *Config) { c.Devices[1].Adapter = "hci9" },
+			[]string{"devices[1] (BlunoTwo): adapter hci9 is not one of ble.adapters"},
+		},
+		{
+			"malformed device address",
+			func(c *Config) { c.Devices[0].Address = "80:30:DC" },
+			[]string{`devices[0] (BlunoOne): address "80:30:DC" is not a bluetooth address`},
+		},
+		{
+			"no enabled devices",
+			func(c *Config) {
+				for i := range c.Devices {
+					c.Devices[i].Enabled = false
+				}
+			},
+			[]string{"devices: at least one device must be enabled"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.modify(&cfg)
+			err := cfg.Validate()
+			verr, ok := err.(*ValidationError)
+			if !ok {
+				t.Fatalf("Validate() = %v, want a validation error", err)
+			}
+			if len(verr.Problems) != len(tt.want) {
+				t.Fatalf("problems = %q, want %d", verr.Problems, len(tt.want))
+			}
+			for i, p := range verr.Problems {
+				if !strings.HasPrefix(p, tt.want[i]) {
+					t.Errorf("problem %d = %q, want %q", i, p, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidationErrorListsEveryProblem(t *testing.T) {
+	err := &ValidationError{Problems: []string{"first", "second"}}
+	if got, want := err.Error(), "invalid configuration:\n  first\n  second"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
@@ -1,76 +1,25 @@
 package constants
 
-import (
-	"time"
-
-	"github.com/CG4002-AY2021S2-B16/comms-int/bluno"
-)
-
-// IncomingNotifSock refers to the unix socket's pathname used for notifications
-// This needs to be mapped to a suitable location outside of the container
-var IncomingNotifSock string = "/tmp/www/comms/notif.sock"
-
-// OutgoingDataSock refers to the unix socket's pathname used for sending outgoing data
-// This needs to be mapped to a suitable location outside of the container
-var OutgoingDataSock string = "/tmp/www/comms/data.sock"
-
-// UpstreamCheckFreq decides how often upstream is checked for incoming messages
-var UpstreamCheckFreq time.Duration = 300 * time.Millisecond
-
-// BlunoStatusCheckFreq decides how often blunostates are monitored
-var BlunoStatusCheckFreq time.Duration = 5000 * time.Millisecond
-
 // UpstreamResumeMsg is the expected indication to resume the application
 var UpstreamResumeMsg string = "resume"
 
-// UpstreamNotifBufferSize refers to the max number of bytes to be read in for an incoming notif
-var UpstreamNotifBufferSize int = 1000
+// UpstreamTimeSyncMsg is the expected indication to perform an NTP-style time sync
+var UpstreamTimeSyncMsg string = "timesync"
 
-// Bluno configurations
-var blunoOne bluno.Bluno = bluno.Bluno{
-	Address:      "80:30:DC:E9:1C:34",
-	Name:         "BlunoOne",
-	Num:          1,
-	HandshakedAt: time.Time{},
-	User:         Elston,
-}
+// UpstreamCreditMsg is the expected indication that the consumer can accept more windows
+var UpstreamCreditMsg string = "credit"
 
-var blunoTwo bluno.Bluno = bluno.Bluno{
-	Address:      "80:30:DC:D9:0C:B2",
-	Name:         "BlunoTwo",
-	Num:          2,
-	HandshakedAt: time.Time{},
-	User:         Tamelly,
-}
+// UpstreamAckMsg is the expected indication that the consumer has received all windows up to a sequence number
+var UpstreamAckMsg string = "ack"
 
-var blunoThree bluno.Bluno = bluno.Bluno{
-	Address:      "80:30:DC:D9:1F:F0",
-	Name:         "BlunoThree",
-	Num:          3,
-	HandshakedAt: time.Time{},
-	User:         Matthew,
-}
+// UpstreamLogLevelMsg is the expected indication to change the log level, of a single subsystem if one is given
+var UpstreamLogLevelMsg string = "loglevel"
 
-var blunoFour bluno.Bluno = bluno.Bluno{
-	Address:      "34:B1:F7:D2:37:0C",
-	Name:         "BlunoFour",
-	Num:          4,
-	HandshakedAt: time.Time{},
-	User:         Sujay,
-}
+// UpstreamReloadMsg is the expected indication to reload the configuration, applying the settings that are safe to change while running
+var UpstreamReloadMsg string = "reload"
 
-var blunoFive bluno.Bluno = bluno.Bluno{
-	Address:      "80:30:DC:D9:23:4C",
-	Name:         "BlunoFive",
-	Num:          5,
-	HandshakedAt: time.Time{},
-	User:         ZiYun,
-}
+// UpstreamUnquarantineMsg is the expected indication to connect to a quarantined bluno again, or every quarantined bluno if none is given
+var UpstreamUnquarantineMsg string = "unquarantine"
 
-var blunoSix bluno.Bluno = bluno.Bluno{
-	Address:      "80:30:DC:D9:23:40",
-	Name:         "BlunoSix",
-	Num:          6,
-	HandshakedAt: time.Time{},
-	User:         Denise,
-}
+// UpstreamStatsMsg is the expected indication to send the statistics of every bluno since the relay started
+var UpstreamStatsMsg string = "stats"
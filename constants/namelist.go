@@ -1,11 +0,0 @@
-package constants
-
-const (
-	Elston    string = "elston"
-	Tamelly   string = "tamelly"
-	Matthew   string = "matthew"
-	Sujay     string = "sujay"
-	ZiYun     string = "ziyun"
-	Denise    string = "denise"
-	Anonymous string = "anonymous"
-)
@@ -0,0 +1,123 @@
+package emg
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// Features are the time and frequency domain features of a window of EMG samples
+// https://www.ncbi.nlm.nih.gov/pmc/articles/PMC6679263/
+type Features struct {
+	MAV float64 `json:"mean_absolute_value"`
+	RMS float64 `json:"root_mean_square"`
+	MNF float64 `json:"mean_frequency"`
+	MDF float64 `json:"median_frequency,omitempty"` // Only available when computed from raw samples
+}
+
+// ComputeFeatures computes MAV, RMS, MNF and MDF over a window of raw ADC samples taken at the given rate (in Hz)
+// The DC offset of the ADC is removed before computation.
+func ComputeFeatures(samples []uint16, rate float64) Features {
+	var f Features
+	if len(samples) == 0 {
+		return f
+	}
+
+	var mean float64
+	for _, s := range samples {
+		mean += float64(s)
+	}
+	mean /= float64(len(samples))
+
+	x := make([]float64, len(samples))
+	for i, s := range samples {
+		x[i] = float64(s) - mean
+		f.MAV += math.Abs(x[i])
+		f.RMS += x[i] * x[i]
+	}
+	f.MAV /= float64(len(x))
+	f.RMS = math.Sqrt(f.RMS / float64(len(x)))
+
+	psd := powerSpectrum(x)
+	resolution := rate / float64(len(x))
+
+	var total, weighted float64
+	for k, p := range psd {
+		total += p
+		weighted += float64(k) * resolution * p
+	}
+	if total == 0 {
+		return f
+	}
+	f.MNF = weighted / total
+
+	var cumulative float64
+	for k, p := range psd {
+		cumulative += p
+		if cumulative >= total/2 {
+			f.MDF = float64(k) * resolution
+			break
+		}
+	}
+	return f
+}
+
+// powerSpectrum returns the one-sided power spectrum of x, excluding the DC component
+// The input is zero-padded to the next power of 2.
+func powerSpectrum(x []float64) []float64 {
+	n := 1
+	for n < len(x) {
+		n <<= 1
+	}
+	c := make([]complex128, n)
+	for i, v := range x {
+		c[i] = complex(v, 0)
+	}
+	fft(c)
+
+	psd := make([]float64, n/2)
+	for k := 1; k < n/2; k++ {
+		a := cmplx.Abs(c[k])
+		psd[k] = a * a
+	}
+	return psd
+}
+
+// fft performs an in-place radix-2 Cooley-Tukey FFT, where len(c) must be a power of 2
+func fft(c []complex128) {
+	n := len(c)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			c[i], c[j] = c[j], c[i]
+		}
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		w := cmplx.Rect(1, -2*math.Pi/float64(size))
+		for start := 0; start < n; start += size {
+			wk := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				u := c[start+k]
+				v := c[start+k+size/2] * wk
+				c[start+k] = u + v
+				c[start+k+size/2] = u - v
+				wk *= w
+			}
+		}
+	}
+}
+
+// Validate returns true if features reported by the Beetle are finite and within physically possible ranges
+func Validate(mav float32, rms float32, mnf float32, maxAmplitude float64, maxFrequency float64) bool {
+	for _, v := range []float32{mav, rms, mnf} {
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) || v < 0 {
+			return false
+		}
+	}
+	// RMS is never less than MAV for the same window
+	return float64(mav) <= maxAmplitude && float64(rms) <= maxAmplitude && float64(mnf) <= maxFrequency && mav <= rms*1.001
+}
@@ -0,0 +1,147 @@
+package emg
+
+import (
+	"sync"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+	"github.com/CG4002-AY2021S2-B16/comms-int/logging"
+)
+
+var log = logging.For("emg")
+
+// Fatigue is emitted for a dancer whenever a new window of EMG features is available
+// Score ranges from 0 (as fresh as the baseline) to 100 (fully fatigued)
+type Fatigue struct {
+	BlunoNum  uint8    `json:"num"`
+	User      string   `json:"user"`
+	Timestamp int64    `json:"unix_timestamp_milliseconds"`
+	Score     float64  `json:"score"`
+	Features  Features `json:"features"`
+}
+
+// dancerEMG holds the window and baseline of a single bluno's EMG stream
+type dancerEMG struct {
+	samples   []uint16
+	features  []Features // On-device features accumulated towards a window
+	baseline  Features
+	baselined int // Number of windows folded into the baseline
+}
+
+// Processor validates EMG packets, computes features on the relay side when raw samples are received,
+// and derives a per-dancer fatigue score from the drift of those features away from their baseline
+type Processor struct {
+	sync.Mutex
+	cfg     *config.EMG
+	users   map[uint8]string
+	dancers map[uint8]*dancerEMG
+	emit    func(Fatigue)
+
+	Invalid uint32 // EMG packets discarded for carrying non-finite or out of range features
+}
+
+// CreateProcessor initializes and returns a processor given a mapping of bluno numbers to users,
+// which invokes emit for every window of EMG features. emit is called inline, so it must not block.
+func CreateProcessor(cfg *config.EMG, users map[uint8]string, emit func(Fatigue)) *Processor {
+	return &Processor{
+		cfg:     cfg,
+		users:   users,
+		dancers: make(map[uint8]*dancerEMG),
+		emit:    emit,
+	}
+}
+
+// Process takes in a packet and returns the packets to be written out in its place.
+// Non EMG packets are returned as is. EMG packets with invalid features are discarded.
+// Raw sample packets are accumulated, and replaced with a single feature packet once a window is complete.
+func (e *Processor) Process(p commsintconfig.Packet) []commsintconfig.Packet {
+	if p.Type != commsintconfig.DataEMG {
+		return []commsintconfig.Packet{p}
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	d, ok := e.dancers[p.BlunoNumber]
+	if !ok {
+		d = &dancerEMG{samples: make([]uint16, 0, e.cfg.WindowSize)}
+		e.dancers[p.BlunoNumber] = d
+	}
+
+	if len(p.EMGSamples) > 0 {
+		d.samples = append(d.samples, p.EMGSamples...)
+		if len(d.samples) < e.cfg.WindowSize {
+			return nil
+		}
+
+		f := ComputeFeatures(d.samples[:e.cfg.WindowSize], e.cfg.SampleRate)
+		d.samples = append(d.samples[:0], d.samples[e.cfg.WindowSize:]...)
+
+		p.EMGSamples = nil
+		p.MAV, p.RMS, p.MNF = float32(f.MAV), float32(f.RMS), float32(f.MNF)
+		e.update(d, p, f)
+		return []commsintconfig.Packet{p}
+	}
+
+	if !Validate(p.MAV, p.RMS, p.MNF, e.cfg.MaxAmplitude, e.cfg.MaxFrequency) {
+		e.Invalid++
+		log.Debug("invalid_features", "bluno", p.BlunoNumber, "mav", p.MAV, "rms", p.RMS, "mnf", p.MNF)
+		return nil
+	}
+
+	// Features computed on the Beetle are averaged over a window of packets
+	d.features = append(d.features, Features{MAV: float64(p.MAV), RMS: float64(p.RMS), MNF: float64(p.MNF)})
+	if len(d.features) >= e.cfg.FeatureWindow {
+		var f Features
+		for _, w := range d.features {
+			f.MAV += w.MAV / float64(len(d.features))
+			f.RMS += w.RMS / float64(len(d.features))
+			f.MNF += w.MNF / float64(len(d.features))
+		}
+		d.features = d.features[:0]
+		e.update(d, p, f)
+	}
+	return []commsintconfig.Packet{p}
+}
+
+// update folds a window of features into the baseline, or scores it against the baseline once one is established
+// Fatigue manifests as a drop in the frequency content of the signal and a rise in its amplitude.
+func (e *Processor) update(d *dancerEMG, p commsintconfig.Packet, f Features) {
+	if d.baselined < e.cfg.BaselineWindows {
+		n := float64(d.baselined)
+		d.baseline.MAV = (d.baseline.MAV*n + f.MAV) / (n + 1)
+		d.baseline.RMS = (d.baseline.RMS*n + f.RMS) / (n + 1)
+		d.baseline.MNF = (d.baseline.MNF*n + f.MNF) / (n + 1)
+		d.baseline.MDF = (d.baseline.MDF*n + f.MDF) / (n + 1)
+		d.baselined++
+		return
+	}
+
+	// Median frequency is the more robust indicator, fall back to mean frequency without raw samples
+	var freqShift float64
+	if d.baseline.MDF > 0 {
+		freqShift = 1 - f.MDF/d.baseline.MDF
+	} else if d.baseline.MNF > 0 {
+		freqShift = 1 - f.MNF/d.baseline.MNF
+	}
+	var ampRise float64
+	if d.baseline.RMS > 0 {
+		ampRise = f.RMS/d.baseline.RMS - 1
+	}
+
+	score := 100 * (e.cfg.FrequencyWeight*freqShift/e.cfg.FullFatigueFrequencyShift +
+		e.cfg.AmplitudeWeight*ampRise/e.cfg.FullFatigueAmplitudeRise)
+	if score < 0 {
+		score = 0
+	} else if score > 100 {
+		score = 100
+	}
+
+	e.emit(Fatigue{
+		BlunoNum:  p.BlunoNumber,
+		User:      e.users[p.BlunoNumber],
+		Timestamp: p.Timestamp,
+		Score:     score,
+		Features:  f,
+	})
+}
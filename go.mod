@@ -5,4 +5,5 @@ go 1.15
 require (
 	github.com/fatih/color v1.10.0
 	github.com/go-ble/ble v0.0.0-20200407180624-067514cd6e24
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,254 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// Level is the severity of a log entry
+type Level int32
+
+const (
+	// Trace is for fine grained entries, such as entering and exiting critical regions
+	Trace Level = iota
+	// Debug is for entries useful when diagnosing a problem, such as every packet received
+	Debug
+	// Info is for entries describing normal operation, such as connections and handshakes
+	Info
+	// Warn is for entries describing recoverable problems, such as failed connection attempts
+	Warn
+	// Error is for entries describing problems that lose data or functionality
+	Error
+)
+
+var levelNames = []string{"trace", "debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Trace || l > Error {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel converts the name of a level to a Level
+func ParseLevel(s string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q, expected one of %s", s, strings.Join(levelNames, ", "))
+}
+
+// Format is the encoding of log entries
+type Format int32
+
+const (
+	// Text writes entries as a timestamp, level, subsystem and message followed by key=value fields
+	Text Format = iota
+	// JSON writes entries as one json object per line, for log aggregation
+	JSON
+)
+
+// ParseFormat converts the name of a format to a Format
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "text":
+		return Text, nil
+	case "json":
+		return JSON, nil
+	}
+	return Text, fmt.Errorf("unknown log format %q, expected one of text, json", s)
+}
+
+var (
+	mu           sync.RWMutex
+	out          io.Writer = os.Stderr
+	format       Format    = Text
+	globalFields []interface{}
+	defaultLevel int32 = int32(Info)
+	levels             = make(map[string]Level)
+)
+
+// SetLevel changes the level of a subsystem at runtime. An empty subsystem changes the default level,
+// and clears every subsystem specific level.
+func SetLevel(subsystem string, l Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	if subsystem == "" {
+		atomic.StoreInt32(&defaultLevel, int32(l))
+		levels = make(map[string]Level)
+		return
+	}
+	levels[subsystem] = l
+}
+
+// GetLevel returns the level in effect for a subsystem
+func GetLevel(subsystem string) Level {
+	mu.RLock()
+	defer mu.RUnlock()
+	if l, ok := levels[subsystem]; ok {
+		return l
+	}
+	return Level(atomic.LoadInt32(&defaultLevel))
+}
+
+// SetFormat changes the encoding of log entries
+func SetFormat(f Format) {
+	mu.Lock()
+	defer mu.Unlock()
+	format = f
+}
+
+// SetOutput changes the destination of log entries
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+// SetGlobalFields attaches key-value pairs to every log entry, e.g. the session id
+func SetGlobalFields(kv ...interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	globalFields = kv
+}
+
+// Logger writes entries for a single subsystem, with a set of fields attached to every entry
+type Logger struct {
+	subsystem string
+	fields    []interface{}
+}
+
+// For returns the logger of a subsystem, e.g. ble, upstream or appstate
+func For(subsystem string) *Logger {
+	return &Logger{subsystem: subsystem}
+}
+
+// With returns a logger which attaches the given key-value pairs to every entry
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &Logger{subsystem: l.subsystem, fields: fields}
+}
+
+// Enabled returns true if entries of the given level are written for this logger's subsystem
+// It should be checked before building expensive fields.
+func (l *Logger) Enabled(lvl Level) bool {
+	return lvl >= GetLevel(l.subsystem)
+}
+
+// Log writes an entry at the given level
+func (l *Logger) Log(lvl Level, msg string, kv ...interface{}) { l.log(lvl, msg, kv) }
+
+// Trace writes an entry at trace level
+func (l *Logger) Trace(msg string, kv ...interface{}) { l.log(Trace, msg, kv) }
+
+// Debug writes an entry at debug level
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(Debug, msg, kv) }
+
+// Info writes an entry at info level
+func (l *Logger) Info(msg string, kv ...interface{}) { l.log(Info, msg, kv) }
+
+// Warn writes an entry at warn level
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.log(Warn, msg, kv) }
+
+// Error writes an entry at error level
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(Error, msg, kv) }
+
+// Fatal writes an entry at error level and exits
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(Error, msg, kv)
+	os.Exit(1)
+}
+
+func (l *Logger) log(lvl Level, msg string, kv []interface{}) {
+	if !l.Enabled(lvl) {
+		return
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	t := time.Now()
+	all := make([]interface{}, 0, len(globalFields)+len(l.fields)+len(kv))
+	all = append(append(append(all, globalFields...), l.fields...), kv...)
+
+	var line []byte
+	if format == JSON {
+		line = encodeJSON(t, lvl, l.subsystem, msg, all)
+	} else {
+		line = encodeText(t, lvl, l.subsystem, msg, all)
+	}
+	out.Write(line)
+}
+
+// value converts a field value into one that encodes sensibly
+func value(v interface{}) interface{} {
+	switch x := v.(type) {
+	case error:
+		if x == nil {
+			return nil
+		}
+		return x.Error()
+	case time.Duration:
+		return x.String()
+	case fmt.Stringer:
+		return x.String()
+	}
+	return v
+}
+
+func encodeJSON(t time.Time, lvl Level, subsystem string, msg string, kv []interface{}) []byte {
+	entry := make(map[string]interface{}, 4+len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		entry[fmt.Sprint(kv[i])] = value(kv[i+1])
+	}
+	entry["ts"] = t.Format(time.RFC3339Nano)
+	entry["level"] = lvl.String()
+	entry["subsystem"] = subsystem
+	entry["msg"] = msg
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"ts": t.Format(time.RFC3339Nano), "level": lvl.String(), "subsystem": subsystem, "msg": msg, "log_err": err.Error()})
+	}
+	return append(b, '\n')
+}
+
+var levelColors = map[Level]*color.Color{
+	Trace: color.New(color.FgHiBlack),
+	Debug: color.New(color.FgCyan),
+	Info:  color.New(color.FgGreen),
+	Warn:  color.New(color.FgYellow),
+	Error: color.New(color.FgRed),
+}
+
+func encodeText(t time.Time, lvl Level, subsystem string, msg string, kv []interface{}) []byte {
+	var sb strings.Builder
+	sb.WriteString(t.Format("2006/01/02 15:04:05.000000"))
+	sb.WriteByte(' ')
+	sb.WriteString(levelColors[lvl].Sprintf("%-5s", strings.ToUpper(lvl.String())))
+	sb.WriteByte(' ')
+	sb.WriteString(subsystem)
+	sb.WriteByte(' ')
+	sb.WriteString(msg)
+	for i := 0; i+1 < len(kv); i += 2 {
+		v := value(kv[i+1])
+		s := fmt.Sprint(v)
+		if strings.ContainsAny(s, " \"=") {
+			s = fmt.Sprintf("%q", s)
+		}
+		fmt.Fprintf(&sb, " %v=%s", kv[i], s)
+	}
+	sb.WriteByte('\n')
+	return []byte(sb.String())
+}
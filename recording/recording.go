@@ -0,0 +1,115 @@
+package recording
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/CG4002-AY2021S2-B16/comms-int/logging"
+)
+
+var log = logging.For("recording")
+
+// record is a single line of a recording
+// Fields left out of the output representation of a packet are kept, so that a replayed packet
+// goes through the same processing (e.g. EMG feature extraction) as a live one.
+type record struct {
+	commsintconfig.Packet
+	Type       commsintconfig.PacketType `json:"type"`
+	EMGSamples []uint16                  `json:"emg_samples,omitempty"`
+	SensorTime uint32                    `json:"sensor_time"`
+}
+
+// Recorder writes every packet received from the blunos to a file as json lines, for later replay
+type Recorder struct {
+	sync.Mutex
+	f   *os.File
+	w   *bufio.Writer
+	enc *json.Encoder
+
+	Packets uint64
+}
+
+// CreateRecorder creates (or truncates) the recording at the given path
+func CreateRecorder(path string) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	return &Recorder{f: f, w: w, enc: json.NewEncoder(w)}, nil
+}
+
+// Write appends a packet to the recording
+func (r *Recorder) Write(p commsintconfig.Packet) {
+	r.Lock()
+	defer r.Unlock()
+	if err := r.enc.Encode(record{Packet: p, Type: p.Type, EMGSamples: p.EMGSamples, SensorTime: p.SensorTime}); err != nil {
+		log.Error("write", "err", err)
+		return
+	}
+	r.Packets++
+}
+
+// Close flushes and closes the recording
+func (r *Recorder) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	if err := r.w.Flush(); err != nil {
+		r.f.Close()
+		return err
+	}
+	log.Info("closed", "path", r.f.Name(), "packets", r.Packets)
+	return r.f.Close()
+}
+
+// Replay reads the recording at the given path and passes every packet to wr, paced by the packets' timestamps
+// A speed of 2 replays twice as fast as recorded, while a speed of 0 replays as fast as possible.
+// Timestamps are shifted so that the recording appears to have started when the replay did.
+// It returns the number of packets replayed.
+func Replay(ctx context.Context, path string, speed float64, wr func(commsintconfig.Packet)) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	start := time.Now()
+	var first int64
+	var n int
+
+	for dec.More() {
+		var r record
+		if err := dec.Decode(&r); err != nil {
+			return n, err
+		}
+		p := r.Packet
+		p.Type = r.Type
+		p.EMGSamples = r.EMGSamples
+		p.SensorTime = r.SensorTime
+
+		if n == 0 {
+			first = p.Timestamp
+		}
+		offset := time.Duration(p.Timestamp-first) * time.Millisecond
+		if speed > 0 {
+			select {
+			case <-time.After(time.Until(start.Add(time.Duration(float64(offset) / speed)))):
+			case <-ctx.Done():
+				return n, ctx.Err()
+			}
+		} else if ctx.Err() != nil {
+			return n, ctx.Err()
+		}
+		p.Timestamp = start.Add(offset).UnixNano() / int64(time.Millisecond)
+
+		wr(p)
+		n++
+	}
+	return n, nil
+}
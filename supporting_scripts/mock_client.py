@@ -13,6 +13,9 @@ DATA_SOCK_PATH = "/tmp/www/comms/data.sock"
 RESUME_CMD = "resume"
 PAUSE_CMD = "pause"
 
+# Messages on the data socket, other than packets, that are printed as is
+EVENT_KEYS = ("timestamps", "timesync", "sync_delay", "fatigue", "reload", "health", "bluno_status", "stats")
+
 
 """
 To be run after golang server has started
@@ -66,11 +69,15 @@ def read_ble_data():
 
         try:
             parsed = json.loads(msg)
-            if parsed.get('timestamps') is not None:
+            if any(parsed.get(k) is not None for k in EVENT_KEYS):
                 print(parsed)
             elif parsed.get('packets') is not None:
+                # Legacy output format
                 for item in parsed.get('packets'):
                     queues[item.get('bluno')].put(item)
+            elif parsed.get('imu') is not None:
+                for item in parsed.get('imu'):
+                    queues[item.get('bluno')].put(item)
         except json.JSONDecodeError:
             pass
  
@@ -1,26 +1,50 @@
 package upstream
 
 import (
-	"container/list"
 	"context"
-	"log"
 	"sync"
 	"time"
 
 	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
 )
 
-// OutputBuffer acts as a buffer for outgoing packets in the form of json data
+// ShedStats counts the packets shed by the output buffer, by reason, and the messages the writer could not send
+type ShedStats struct {
+	LivenessDerived uint64 `json:"liveness_derived"`
+	ThinnedIMU      uint64 `json:"thinned_imu"`
+	Overflow        uint64 `json:"overflow"`
+	Unsent          uint64 `json:"unsent"` // Messages lost with the consumer, which are not retained for retransmission
+}
+
+// Total returns the total number of packets shed
+func (s ShedStats) Total() uint64 {
+	return s.LivenessDerived + s.ThinnedIMU + s.Overflow
+}
+
+// OutputBuffer acts as a bounded buffer for outgoing packets in the form of json data
+// Once the consumer falls behind and the buffer fills up, low priority packets are shed
+// so that movement events are always delivered.
 type OutputBuffer struct {
 	sync.Mutex
-	L           *list.List
+	L           []commsintconfig.Packet
+	cfg         *config.Store
+	bytes       int
+	credits     int
+	thinned     map[uint8]int
 	enqueueChan chan commsintconfig.Packet
+	Shed        ShedStats
 }
 
 // CreateOutputBuffer initializes and returns an output buffer
-func CreateOutputBuffer() *OutputBuffer {
+// The window size and dequeue interval are read from the store as they are used, so that they can be reloaded while running.
+func CreateOutputBuffer(cfg *config.Store) *OutputBuffer {
+	out := cfg.Get().Output
 	return &OutputBuffer{
-		L:           list.New(),
+		L:           make([]commsintconfig.Packet, 0, out.MaxQueuedPackets),
+		cfg:         cfg,
+		credits:     out.InitialCredits,
+		thinned:     make(map[uint8]int),
 		enqueueChan: make(chan commsintconfig.Packet),
 	}
 }
@@ -30,6 +54,20 @@ func (o *OutputBuffer) EnqueueBuffer(c commsintconfig.Packet) {
 	o.enqueueChan <- c
 }
 
+// AddCredits grants the given number of windows to be sent, when credit based flow control is enabled
+func (o *OutputBuffer) AddCredits(n int) {
+	o.Lock()
+	defer o.Unlock()
+	o.credits += n
+}
+
+// ShedStats returns the number of packets shed so far
+func (o *OutputBuffer) ShedStats() ShedStats {
+	o.Lock()
+	defer o.Unlock()
+	return o.Shed
+}
+
 // EnqueueChannelProcessor listens to the enqueue channel and adds it to the buffer.
 // This should be run within a permanent goroutine
 func (o *OutputBuffer) EnqueueChannelProcessor(ctx context.Context) {
@@ -37,36 +75,129 @@ func (o *OutputBuffer) EnqueueChannelProcessor(ctx context.Context) {
 		select {
 		case p := <-o.enqueueChan:
 			o.Lock()
-			o.L.PushBack(p)
+			o.admit(p)
 			o.Unlock()
 		case <-ctx.Done():
-			log.Println("Shutting down EnqueueChannelProcessor")
+			log.Info("shutdown", "routine", "EnqueueChannelProcessor")
+			return
+		}
+	}
+}
+
+// size returns the estimated memory held by a packet
+func size(p commsintconfig.Packet) int {
+	return commsintconfig.PacketOverhead + 2*len(p.EMGSamples)
+}
+
+// admit adds a packet to the buffer, shedding packets according to their priority if the buffer is filling up
+// The lock must be held by the caller.
+func (o *OutputBuffer) admit(p commsintconfig.Packet) {
+	cfg := &o.cfg.Get().Output
+	if float64(len(o.L)) >= cfg.ShedWatermark*float64(cfg.MaxQueuedPackets) ||
+		float64(o.bytes) >= cfg.ShedWatermark*float64(cfg.MaxQueuedBytes) {
+		if cfg.ShedLivenessDerived && p.Type == commsintconfig.Gap {
+			o.Shed.LivenessDerived++
+			return
+		}
+		if cfg.ShedThinIMUFactor > 1 && p.Type == commsintconfig.Data && p.Movement == 0 {
+			o.thinned[p.BlunoNumber]++
+			if o.thinned[p.BlunoNumber]%cfg.ShedThinIMUFactor != 0 {
+				o.Shed.ThinnedIMU++
+				return
+			}
+		}
+	}
+
+	for len(o.L) >= cfg.MaxQueuedPackets || o.bytes+size(p) > cfg.MaxQueuedBytes {
+		if o.evict() {
+			continue
+		}
+		// Everything queued is a movement event, so only another movement event may displace one
+		if p.Movement == 0 {
+			o.Shed.Overflow++
 			return
 		}
+		if len(o.L) == 0 {
+			break // A movement event that is larger than the buffer on its own is still delivered
+		}
+		o.bytes -= size(o.L[0])
+		o.L = o.L[1:]
+		o.Shed.Overflow++
+	}
+
+	o.L = append(o.L, p)
+	o.bytes += size(p)
+}
+
+// evict removes the oldest queued packet without a movement event, returning false if there are none
+func (o *OutputBuffer) evict() bool {
+	for i, q := range o.L {
+		if q.Movement == 0 {
+			o.bytes -= size(q)
+			o.L = append(o.L[:i], o.L[i+1:]...)
+			o.Shed.Overflow++
+			return true
+		}
 	}
+	return false
 }
 
-// DequeueProcessor periodically wakes up to create output and send it over to the ext comms interface
+// DequeueProcessor periodically wakes up to create output and hand it over to the single writer goroutine
+// Windows are only formed while the writer has room for them (and the consumer has credits, if enabled),
+// otherwise packets remain in the bounded buffer.
 // This should be run within a permanent goroutine
 func (o *OutputBuffer) DequeueProcessor(ctx context.Context, us *IOHandler) {
-	t := time.NewTicker(commsintconfig.OutputDequeueInterval)
+	interval := o.cfg.Get().Output.DequeueInterval
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	rt := time.NewTicker(o.cfg.Get().Output.ShedReportInterval)
+	defer rt.Stop()
+	var reported uint64
 
 	for {
 		select {
 		case <-t.C:
-			o.Lock()
-			if o.L.Len() >= commsintconfig.OutputSize {
-				var arr []commsintconfig.Packet
+			cfg := &o.cfg.Get().Output
+			if cfg.DequeueInterval != interval {
+				interval = cfg.DequeueInterval
+				t.Reset(interval)
+			}
 
-				for i := 1; i <= commsintconfig.OutputSize; i++ {
-					arr = append(arr, o.L.Remove(o.L.Front()).(commsintconfig.Packet))
+			o.Lock()
+			for len(o.L) >= cfg.Size && us.WindowSlots() > 0 &&
+				(!cfg.CreditFlowControl || o.credits > 0) {
+				arr := make([]commsintconfig.Packet, cfg.Size)
+				copy(arr, o.L[:cfg.Size])
+				for _, p := range arr {
+					o.bytes -= size(p)
+				}
+				o.L = o.L[cfg.Size:]
+				if cfg.CreditFlowControl {
+					o.credits--
 				}
-				go us.WriteRoutine(&arr)
+				us.WriteRoutine(&arr)
 			}
 			o.Unlock()
+		case <-rt.C:
+			shed := o.ShedStats()
+			if us.Unsent != nil {
+				shed.Unsent = us.Unsent()
+			}
+			if shed.Total()+shed.Unsent != reported {
+				reported = shed.Total() + shed.Unsent
+				log.Warn("shed", "total", shed.Total(), "liveness_derived", shed.LivenessDerived,
+					"thinned_imu", shed.ThinnedIMU, "overflow", shed.Overflow, "unsent", shed.Unsent, "queued", o.Len())
+			}
 		case <-ctx.Done():
-			log.Println("Shutting down DequeueProcessor")
+			log.Info("shutdown", "routine", "DequeueProcessor")
 			return
 		}
 	}
 }
+
+// Len returns the number of packets currently queued
+func (o *OutputBuffer) Len() int {
+	o.Lock()
+	defer o.Unlock()
+	return len(o.L)
+}
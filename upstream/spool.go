@@ -0,0 +1,338 @@
+package upstream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+)
+
+// recordHeaderSize is the size of the header preceding every spooled message: 4 byte length, 8 byte sequence number
+const recordHeaderSize = 12
+
+// segment is a single append-only spool file, holding messages with consecutive sequence numbers starting from first
+type segment struct {
+	path    string
+	first   uint64
+	offsets []int64 // Offset of each record within the file
+	size    int64
+	reader  *os.File // Opened upon the first read from the segment, and kept until the segment is removed
+}
+
+// last returns the sequence number of the last message in the segment
+func (s *segment) last() uint64 {
+	return s.first + uint64(len(s.offsets)) - 1
+}
+
+// remove closes the segment's read handle, if any, and deletes its file
+func (s *segment) remove() {
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+	os.Remove(s.path)
+}
+
+// readRecord reads the message with the given sequence number from the segment
+func (s *segment) readRecord(seq uint64) ([]byte, error) {
+	if s.reader == nil {
+		f, err := os.Open(s.path)
+		if err != nil {
+			return nil, err
+		}
+		s.reader = f
+	}
+
+	hdr := make([]byte, recordHeaderSize)
+	off := s.offsets[seq-s.first]
+	if _, err := s.reader.ReadAt(hdr, off); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.LittleEndian.Uint32(hdr[0:4]))
+	if _, err := s.reader.ReadAt(msg, off+recordHeaderSize); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Spool is a write-ahead log of outgoing windows, made up of segmented append-only files with a size cap.
+// Windows are delivered from the spool, and remain there until the consumer acknowledges them,
+// so that they can be replayed in order when a consumer reconnects, even across restarts of the relay.
+type Spool struct {
+	sync.Mutex
+	dir      string
+	cfg      *config.Upstream
+	segments []*segment
+	active   *os.File
+	syncedAt time.Time // When the active segment was last flushed to disk
+	nextSeq  uint64    // Sequence number of the next message appended
+	acked    uint64    // All messages up to and including this sequence number have been acknowledged
+	cursor   uint64    // Sequence number of the next message to be delivered
+	notify   chan struct{}
+
+	Evicted uint64 // Unacknowledged messages discarded to stay within the size cap
+}
+
+// OpenSpool opens (or creates) a spool within the configured directory, recovering any messages left from a previous run
+func OpenSpool(cfg *config.Upstream) (*Spool, error) {
+	dir := cfg.SpoolDir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{dir: dir, cfg: cfg, nextSeq: 1, notify: make(chan struct{}, 1)}
+
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "acked")); err == nil {
+		s.acked, _ = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		seg, err := recoverSegment(p)
+		if err != nil {
+			return nil, err
+		}
+		if len(seg.offsets) == 0 || seg.last() <= s.acked {
+			os.Remove(p)
+			continue
+		}
+		s.segments = append(s.segments, seg)
+		s.nextSeq = seg.last() + 1
+	}
+	if s.acked >= s.nextSeq {
+		s.nextSeq = s.acked + 1
+	}
+	s.cursor = s.acked + 1
+	if len(s.segments) > 0 && s.cursor < s.segments[0].first {
+		s.cursor = s.segments[0].first
+	}
+
+	log.Info("spool_opened", "dir", dir, "segments", len(s.segments), "acked", s.acked, "next_seq", s.nextSeq)
+	return s, nil
+}
+
+// recoverSegment indexes the records of an existing segment, truncating a partially written trailing record
+func recoverSegment(path string) (*segment, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	seg := &segment{path: path}
+	var off int64
+	for off+recordHeaderSize <= int64(len(b)) {
+		l := int64(binary.LittleEndian.Uint32(b[off : off+4]))
+		if off+recordHeaderSize+l > int64(len(b)) {
+			break
+		}
+		if len(seg.offsets) == 0 {
+			seg.first = binary.LittleEndian.Uint64(b[off+4 : off+12])
+		}
+		seg.offsets = append(seg.offsets, off)
+		off += recordHeaderSize + l
+	}
+
+	if off != int64(len(b)) {
+		log.Warn("spool_truncated", "path", path, "bytes", int64(len(b))-off)
+		if err := os.Truncate(path, off); err != nil {
+			return nil, err
+		}
+	}
+	seg.size = off
+	return seg, nil
+}
+
+// NextSeq returns the sequence number that the next appended message will be given
+func (s *Spool) NextSeq() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.nextSeq
+}
+
+// Append writes a message to the end of the spool, returning its sequence number
+func (s *Spool) Append(msg []byte) (uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	seg := s.tail()
+	if seg == nil || seg.size+int64(len(msg))+recordHeaderSize > s.cfg.SpoolSegmentSize {
+		var err error
+		if seg, err = s.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	rec := make([]byte, recordHeaderSize+len(msg))
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(len(msg)))
+	binary.LittleEndian.PutUint64(rec[4:12], s.nextSeq)
+	copy(rec[recordHeaderSize:], msg)
+	if _, err := s.active.Write(rec); err != nil {
+		return 0, err
+	}
+	if now := time.Now(); now.Sub(s.syncedAt) >= s.cfg.SpoolSyncInterval {
+		if err := s.active.Sync(); err != nil {
+			log.Error("spool_sync", "path", seg.path, "err", err)
+		}
+		s.syncedAt = now
+	}
+
+	seg.offsets = append(seg.offsets, seg.size)
+	seg.size += int64(len(rec))
+	seq := s.nextSeq
+	s.nextSeq++
+	s.enforceCap()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return seq, nil
+}
+
+// tail returns the segment currently being appended to
+func (s *Spool) tail() *segment {
+	if s.active == nil || len(s.segments) == 0 {
+		return nil
+	}
+	return s.segments[len(s.segments)-1]
+}
+
+// rotate flushes and closes the active segment and starts a new one
+func (s *Spool) rotate() (*segment, error) {
+	if s.active != nil {
+		if err := s.active.Sync(); err != nil {
+			log.Error("spool_sync", "err", err)
+		}
+		s.active.Close()
+	}
+	seg := &segment{
+		path:  filepath.Join(s.dir, fmt.Sprintf("segment-%020d.log", s.nextSeq)),
+		first: s.nextSeq,
+	}
+	f, err := os.OpenFile(seg.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.active = f
+	s.segments = append(s.segments, seg)
+	return seg, nil
+}
+
+// enforceCap removes the oldest segments, acknowledged or not, while the spool exceeds its size cap
+func (s *Spool) enforceCap() {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	for total > s.cfg.SpoolMaxBytes && len(s.segments) > 1 {
+		seg := s.segments[0]
+		if seg.last() > s.acked {
+			lost := seg.last() - s.acked
+			if seg.first > s.acked {
+				lost = uint64(len(seg.offsets))
+			}
+			s.Evicted += lost
+			log.Warn("spool_evicted", "path", seg.path, "unacked", lost)
+		}
+		total -= seg.size
+		seg.remove()
+		s.segments = s.segments[1:]
+		if s.cursor <= seg.last() {
+			s.cursor = seg.last() + 1
+		}
+	}
+}
+
+// Ack records that the consumer has received every message up to and including seq,
+// and removes segments that have been fully acknowledged
+func (s *Spool) Ack(seq uint64) {
+	s.Lock()
+	defer s.Unlock()
+
+	if seq <= s.acked || seq >= s.nextSeq {
+		return
+	}
+	s.acked = seq
+	if s.cursor <= seq {
+		s.cursor = seq + 1
+	}
+	if err := ioutil.WriteFile(filepath.Join(s.dir, "acked"), []byte(strconv.FormatUint(seq, 10)), 0644); err != nil {
+		log.Error("spool_ack_persist", "err", err)
+	}
+
+	for len(s.segments) > 1 && s.segments[0].last() <= s.acked {
+		s.segments[0].remove()
+		s.segments = s.segments[1:]
+	}
+}
+
+// Rewind moves delivery back to the first unacknowledged message, to be called when a consumer (re)connects
+func (s *Spool) Rewind() {
+	s.Lock()
+	defer s.Unlock()
+	s.cursor = s.acked + 1
+	if len(s.segments) > 0 && s.cursor < s.segments[0].first {
+		s.cursor = s.segments[0].first
+	}
+}
+
+// Next returns the next message to be delivered and advances delivery past it
+func (s *Spool) Next() ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.segments) > 0 && s.cursor < s.segments[0].first {
+		s.cursor = s.segments[0].first
+	}
+	for _, seg := range s.segments {
+		if s.cursor < seg.first || s.cursor > seg.last() {
+			continue
+		}
+		msg, err := seg.readRecord(s.cursor)
+		if err != nil {
+			log.Error("spool_read", "seq", s.cursor, "err", err)
+			return nil, false
+		}
+		s.cursor++
+		return msg, true
+	}
+	return nil, false
+}
+
+// Notify returns a channel which is signalled whenever a message is appended
+func (s *Spool) Notify() <-chan struct{} {
+	return s.notify
+}
+
+// Close closes the read handles of every segment, and flushes and closes the active segment
+func (s *Spool) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	for _, seg := range s.segments {
+		if seg.reader != nil {
+			seg.reader.Close()
+			seg.reader = nil
+		}
+	}
+	if s.active == nil {
+		return nil
+	}
+	if err := s.active.Sync(); err != nil {
+		s.active.Close()
+		return err
+	}
+	return s.active.Close()
+}
@@ -0,0 +1,227 @@
+package upstream
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+)
+
+// spoolConfig returns the configuration of a spool within a temporary directory, with segments of about 3 messages
+func spoolConfig(t *testing.T) *config.Upstream {
+	cfg := config.Default().Upstream
+	cfg.SpoolDir = t.TempDir()
+	cfg.SpoolSegmentSize = int64(3 * (recordHeaderSize + len(message(0))))
+	cfg.SpoolMaxBytes = 1 << 20
+	cfg.SpoolSyncInterval = 0
+	return &cfg
+}
+
+// message returns the spooled message with the given index, all of which are the same length
+func message(i int) []byte {
+	return []byte(fmt.Sprintf(`{"window":%04d}`, i))
+}
+
+func openSpool(t *testing.T, cfg *config.Upstream) *Spool {
+	s, err := OpenSpool(cfg)
+	if err != nil {
+		t.Fatalf("OpenSpool: %v", err)
+	}
+	return s
+}
+
+func appendMessages(t *testing.T, s *Spool, from int, to int) {
+	for i := from; i < to; i++ {
+		seq, err := s.Append(message(i))
+		if err != nil {
+			t.Fatalf("Append(%d): %v", i, err)
+		}
+		if seq != uint64(i+1) {
+			t.Fatalf("Append(%d) = seq %d, want %d", i, seq, i+1)
+		}
+	}
+}
+
+// expectNext checks that the spool delivers the messages with the given indices, and then nothing else
+func expectNext(t *testing.T, s *Spool, want ...int) {
+	t.Helper()
+	for _, i := range want {
+		msg, ok := s.Next()
+		if !ok || string(msg) != string(message(i)) {
+			t.Fatalf("Next() = %q, %v, want %q", msg, ok, message(i))
+		}
+	}
+	if msg, ok := s.Next(); ok {
+		t.Fatalf("Next() = %q, want nothing", msg)
+	}
+}
+
+func TestSpoolDeliversAcrossRotation(t *testing.T) {
+	cfg := spoolConfig(t)
+	s := openSpool(t, cfg)
+	defer s.Close()
+
+	appendMessages(t, s, 0, 8)
+	if len(s.segments) != 3 {
+		t.Fatalf("%d segments, want 3", len(s.segments))
+	}
+	expectNext(t, s, 0, 1, 2, 3, 4, 5, 6, 7)
+
+	s.Ack(4)
+	s.Rewind()
+	expectNext(t, s, 4, 5, 6, 7)
+
+	appendMessages(t, s, 8, 10)
+	expectNext(t, s, 8, 9)
+
+	s.Rewind()
+	expectNext(t, s, 4, 5, 6, 7, 8, 9)
+}
+
+func TestSpoolAckRemovesSegments(t *testing.T) {
+	cfg := spoolConfig(t)
+	s := openSpool(t, cfg)
+	defer s.Close()
+
+	appendMessages(t, s, 0, 7)
+	s.Ack(6)
+	if len(s.segments) != 1 || s.segments[0].first != 7 {
+		t.Fatalf("segments after ack = %d starting from %d, want 1 starting from 7", len(s.segments), s.segments[0].first)
+	}
+	paths, _ := filepath.Glob(filepath.Join(cfg.SpoolDir, "segment-*.log"))
+	if len(paths) != 1 {
+		t.Errorf("%d segment files left, want 1", len(paths))
+	}
+}
+
+func TestSpoolRecoversAcrossOpens(t *testing.T) {
+	cfg := spoolConfig(t)
+	s := openSpool(t, cfg)
+	appendMessages(t, s, 0, 8)
+	s.Ack(4)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	s = openSpool(t, cfg)
+	defer s.Close()
+	if s.acked != 4 || s.NextSeq() != 9 {
+		t.Fatalf("recovered acked %d, next seq %d, want 4 and 9", s.acked, s.NextSeq())
+	}
+	expectNext(t, s, 4, 5, 6, 7)
+	appendMessages(t, s, 8, 9)
+	expectNext(t, s, 8)
+}
+
+func TestSpoolRecoversEverythingAcked(t *testing.T) {
+	cfg := spoolConfig(t)
+	s := openSpool(t, cfg)
+	appendMessages(t, s, 0, 3)
+	s.Ack(3)
+	s.Close()
+
+	s = openSpool(t, cfg)
+	defer s.Close()
+	if s.NextSeq() != 4 {
+		t.Fatalf("recovered next seq %d, want 4", s.NextSeq())
+	}
+	expectNext(t, s)
+}
+
+func TestRecoverSegmentTruncatesPartialRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		partial int // Bytes of a fourth record that were written before the crash
+	}{
+		{"complete", 0},
+		{"partial header", recordHeaderSize / 2},
+		{"header only", recordHeaderSize},
+		{"partial message", recordHeaderSize + 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := spoolConfig(t)
+			cfg.SpoolSegmentSize = 1 << 10
+			s := openSpool(t, cfg)
+			appendMessages(t, s, 0, 4)
+			s.Close()
+
+			path := s.segments[0].path
+			full := s.segments[0].offsets[3]
+			if tt.partial == 0 {
+				full = s.segments[0].size
+			}
+			if err := os.Truncate(path, full+int64(tt.partial)); err != nil {
+				t.Fatal(err)
+			}
+
+			seg, err := recoverSegment(path)
+			if err != nil {
+				t.Fatalf("recoverSegment: %v", err)
+			}
+			want := 3
+			if tt.partial == 0 {
+				want = 4
+			}
+			if len(seg.offsets) != want || seg.first != 1 || seg.size != full {
+				t.Fatalf("recovered %d records from %d, %d bytes, want %d records from 1, %d bytes",
+					len(seg.offsets), seg.first, seg.size, want, full)
+			}
+			if fi, _ := os.Stat(path); fi.Size() != full {
+				t.Errorf("file is %d bytes, want it truncated to %d", fi.Size(), full)
+			}
+
+			s = openSpool(t, cfg)
+			defer s.Close()
+			if s.NextSeq() != uint64(want+1) {
+				t.Errorf("next seq %d, want %d", s.NextSeq(), want+1)
+			}
+		})
+	}
+}
+
+func TestSpoolEnforceCap(t *testing.T) {
+	tests := []struct {
+		name      string
+		ack       uint64
+		evicted   uint64
+		firstSeg  uint64
+		delivered int // Messages delivered before the cap is exceeded
+		wantNext  int // Index of the next message delivered once the cap is exceeded
+	}{
+		{"nothing acked", 0, 3, 4, 0, 3},
+		{"partly acked", 2, 1, 4, 0, 3},
+		{"everything acked", 3, 0, 4, 0, 3},
+		{"cursor beyond evicted", 0, 3, 4, 5, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := spoolConfig(t)
+			cfg.SpoolMaxBytes = 3 * cfg.SpoolSegmentSize // Full once a fourth segment is started
+			s := openSpool(t, cfg)
+			defer s.Close()
+
+			appendMessages(t, s, 0, 9)
+			for i := 0; i < tt.delivered; i++ {
+				s.Next()
+			}
+			s.Ack(tt.ack)
+			appendMessages(t, s, 9, 10)
+
+			if s.Evicted != tt.evicted {
+				t.Errorf("evicted %d, want %d", s.Evicted, tt.evicted)
+			}
+			if s.segments[0].first != tt.firstSeg {
+				t.Errorf("oldest segment starts from %d, want %d", s.segments[0].first, tt.firstSeg)
+			}
+			if _, err := os.Stat(filepath.Join(cfg.SpoolDir, "segment-00000000000000000001.log")); !os.IsNotExist(err) {
+				t.Errorf("evicted segment file still exists: %v", err)
+			}
+			if msg, ok := s.Next(); !ok || string(msg) != string(message(tt.wantNext)) {
+				t.Errorf("Next() = %q, %v, want %q", msg, ok, message(tt.wantNext))
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package upstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Stream names of messages sent over the data socket, each of which is numbered independently
+// Replies to time syncs are not numbered, since a retransmitted reply would carry times from before the outage.
+const (
+	WindowStream    = "windows"
+	SyncDelayStream = "sync_delay"
+	FatigueStream   = "fatigue"
+	ReloadStream    = "reload"
+	HealthStream    = "health"
+	StatusStream    = "bluno_status"
+	StatsStream     = "stats"
+)
+
+// envelope is merged into every sequenced message
+// ID is an idempotency key, which stays the same when a message is retransmitted.
+type envelope struct {
+	Stream string `json:"stream"`
+	Seq    uint64 `json:"seq"`
+	ID     string `json:"id"`
+}
+
+// withEnvelope merges the envelope fields into a marshalled json object
+func withEnvelope(msg []byte, e envelope) []byte {
+	eb, _ := json.Marshal(e)
+	if len(msg) < 2 || msg[0] != '{' {
+		return msg
+	}
+	if msg[1] == '}' {
+		return eb
+	}
+	out := make([]byte, 0, len(eb)+len(msg))
+	out = append(out, eb[:len(eb)-1]...)
+	out = append(out, ',')
+	return append(out, msg[1:]...)
+}
+
+// retainedMessage is a message kept until acknowledged, in case it has to be retransmitted
+type retainedMessage struct {
+	order uint64 // Order across all streams, so that retransmissions are interleaved as originally sent
+	seq   uint64
+	msg   []byte
+}
+
+// stream numbers the messages of a single kind, and retains those not yet acknowledged
+type stream struct {
+	next     uint64
+	acked    uint64
+	retained []retainedMessage
+}
+
+// Streams assigns monotonically increasing sequence numbers to messages of every stream,
+// and retains a bounded window of unacknowledged messages for retransmission to a reconnecting consumer
+type Streams struct {
+	sync.Mutex
+	session   string
+	retention int
+	order     uint64
+	streams   map[string]*stream
+
+	Evicted uint64 // Unacknowledged messages that fell out of the retention window
+}
+
+// CreateStreams initializes and returns streams for the given session,
+// retaining up to the given number of unacknowledged messages per stream
+func CreateStreams(session string, retention int) *Streams {
+	return &Streams{
+		session:   session,
+		retention: retention,
+		streams:   make(map[string]*stream),
+	}
+}
+
+// get returns the named stream, creating it if required. The lock must be held by the caller.
+func (s *Streams) get(name string) *stream {
+	st, ok := s.streams[name]
+	if !ok {
+		st = &stream{next: 1}
+		s.streams[name] = st
+	}
+	return st
+}
+
+// ID returns the idempotency key of a message
+func (s *Streams) ID(name string, seq uint64) string {
+	return fmt.Sprintf("%s-%s-%d", s.session, name, seq)
+}
+
+// Stamp numbers a message on the named stream, and retains it until it is acknowledged
+func (s *Streams) Stamp(name string, msg []byte) []byte {
+	s.Lock()
+	defer s.Unlock()
+
+	st := s.get(name)
+	seq := st.next
+	st.next++
+	out := withEnvelope(msg, envelope{Stream: name, Seq: seq, ID: s.ID(name, seq)})
+
+	s.order++
+	st.retained = append(st.retained, retainedMessage{order: s.order, seq: seq, msg: out})
+	if len(st.retained) > s.retention {
+		s.Evicted++
+		log.Debug("retention_evicted", "stream", name, "seq", st.retained[0].seq)
+		st.retained = st.retained[1:]
+	}
+	return out
+}
+
+// Ack discards every retained message on the named stream up to and including seq
+func (s *Streams) Ack(name string, seq uint64) {
+	s.Lock()
+	defer s.Unlock()
+
+	st, ok := s.streams[name]
+	if !ok || seq <= st.acked {
+		return
+	}
+	st.acked = seq
+	var i int
+	for i < len(st.retained) && st.retained[i].seq <= seq {
+		i++
+	}
+	st.retained = st.retained[i:]
+}
+
+// Unacknowledged returns every retained message across all streams, in the order they were originally sent
+func (s *Streams) Unacknowledged() [][]byte {
+	s.Lock()
+	defer s.Unlock()
+
+	var all []retainedMessage
+	for _, st := range s.streams {
+		all = append(all, st.retained...)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].order < all[j].order })
+
+	msgs := make([][]byte, len(all))
+	for i, r := range all {
+		msgs[i] = r.msg
+	}
+	return msgs
+}
@@ -0,0 +1,147 @@
+package upstream
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// stampedEnvelope unmarshals the envelope and payload of a stamped message
+func stampedEnvelope(t *testing.T, msg []byte) (envelope, int) {
+	t.Helper()
+	var m struct {
+		envelope
+		N int `json:"n"`
+	}
+	if err := json.Unmarshal(msg, &m); err != nil {
+		t.Fatalf("stamped message %s is not json: %v", msg, err)
+	}
+	return m.envelope, m.N
+}
+
+func payload(n int) []byte {
+	b, _ := json.Marshal(struct {
+		N int `json:"n"`
+	}{n})
+	return b
+}
+
+func TestStreamsStamp(t *testing.T) {
+	s := CreateStreams("session", 16)
+	for i, name := range []string{HealthStream, HealthStream, StatusStream, HealthStream, StatusStream} {
+		e, n := stampedEnvelope(t, s.Stamp(name, payload(i)))
+		if n != i {
+			t.Errorf("message %d carries %d", i, n)
+		}
+		if e.Stream != name || e.ID != s.ID(name, e.Seq) {
+			t.Errorf("message %d stamped as %+v on %s", i, e, name)
+		}
+	}
+
+	tests := []struct {
+		stream string
+		want   []uint64
+	}{
+		{HealthStream, []uint64{1, 2, 3}},
+		{StatusStream, []uint64{1, 2}},
+	}
+	msgs := s.Unacknowledged()
+	for _, tt := range tests {
+		var got []uint64
+		for _, m := range msgs {
+			if e, _ := stampedEnvelope(t, m); e.Stream == tt.stream {
+				got = append(got, e.Seq)
+			}
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s numbered %v, want %v", tt.stream, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s numbered %v, want %v", tt.stream, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestStreamsUnacknowledged(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention int
+		acks      map[string]uint64
+		want      []int // Payloads of the messages retransmitted, in order
+		evicted   uint64
+	}{
+		{"nothing acknowledged", 16, nil, []int{0, 1, 2, 3, 4, 5}, 0},
+		{"one stream acknowledged", 16, map[string]uint64{HealthStream: 3}, []int{1, 4, 5}, 0},
+		{"partly acknowledged", 16, map[string]uint64{HealthStream: 1, StatusStream: 1}, []int{2, 3, 4, 5}, 0},
+		{"everything acknowledged", 16, map[string]uint64{HealthStream: 4, StatusStream: 2}, nil, 0},
+		{"acknowledged beyond the last", 16, map[string]uint64{HealthStream: 10}, []int{1, 4}, 0},
+		{"unknown stream acknowledged", 16, map[string]uint64{"unknown": 1}, []int{0, 1, 2, 3, 4, 5}, 0},
+		{"beyond retention", 2, nil, []int{1, 3, 4, 5}, 2},
+		{"beyond retention and acknowledged", 2, map[string]uint64{HealthStream: 3}, []int{1, 4, 5}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := CreateStreams("session", tt.retention)
+			// Health 1 to 4 are payloads 0, 2, 3 and 5, status 1 and 2 are payloads 1 and 4
+			for i, name := range []string{HealthStream, StatusStream, HealthStream, HealthStream, StatusStream, HealthStream} {
+				s.Stamp(name, payload(i))
+			}
+			for name, seq := range tt.acks {
+				s.Ack(name, seq)
+			}
+
+			var got []int
+			for _, m := range s.Unacknowledged() {
+				_, n := stampedEnvelope(t, m)
+				got = append(got, n)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("retransmitted %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("retransmitted %v, want %v", got, tt.want)
+				}
+			}
+			if s.Evicted != tt.evicted {
+				t.Errorf("evicted %d, want %d", s.Evicted, tt.evicted)
+			}
+		})
+	}
+}
+
+func TestStreamsAckIsMonotonic(t *testing.T) {
+	s := CreateStreams("session", 16)
+	for i := 0; i < 4; i++ {
+		s.Stamp(HealthStream, payload(i))
+	}
+	s.Ack(HealthStream, 3)
+	s.Ack(HealthStream, 1) // A stale acknowledgement changes nothing
+	if got := s.Unacknowledged(); len(got) != 1 {
+		t.Fatalf("%d retransmitted after a stale ack, want 1", len(got))
+	}
+	if _, n := stampedEnvelope(t, s.Unacknowledged()[0]); n != 3 {
+		t.Errorf("retransmitted payload %d, want 3", n)
+	}
+}
+
+func TestWithEnvelope(t *testing.T) {
+	e := envelope{Stream: "s", Seq: 2, ID: "x-s-2"}
+	tests := []struct {
+		name string
+		msg  string
+		want string
+	}{
+		{"object", `{"a":1}`, `{"stream":"s","seq":2,"id":"x-s-2","a":1}`},
+		{"empty object", `{}`, `{"stream":"s","seq":2,"id":"x-s-2"}`},
+		{"not an object", `[1]`, `[1]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(withEnvelope([]byte(tt.msg), e)); got != tt.want {
+				t.Errorf("withEnvelope(%s) = %s, want %s", tt.msg, got, tt.want)
+			}
+		})
+	}
+}
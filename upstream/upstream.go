@@ -3,37 +3,61 @@ package upstream
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net"
 	"os"
 	"sync"
 	"time"
 
+	"github.com/CG4002-AY2021S2-B16/comms-int/analysis"
+	"github.com/CG4002-AY2021S2-B16/comms-int/bluno"
 	"github.com/CG4002-AY2021S2-B16/comms-int/commsintconfig"
-	"github.com/CG4002-AY2021S2-B16/comms-int/constants"
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+	"github.com/CG4002-AY2021S2-B16/comms-int/emg"
+	"github.com/CG4002-AY2021S2-B16/comms-int/logging"
 )
 
+var log = logging.For("upstream")
+
 // IOHandler is a wrapper for a IO
 type IOHandler struct {
 	sync.Mutex
 	ReadChan          chan Instruction
 	WriteRoutine      func(p *[]commsintconfig.Packet)
 	WriteTimestamp    func(uint64)
+	WriteTimeSync     func(Instruction)
 	WriteBlunoMapping func()
+	WriteSyncDelay    func(analysis.SyncDelay)
+	WriteFatigue      func(emg.Fatigue)
+	WriteReload       func(config.Reloaded, error)
+	WriteHealth       func(commsintconfig.HealthReport)
+	WriteStatus       func(commsintconfig.StatusTransition)
+	WriteStats        func(commsintconfig.SessionReport)
+	WindowSlots       func() int
+	Unsent            func() uint64
+	spool             *Spool
+	streams           *Streams
 	sent              int
 	received          int
 }
 
 // Instruction is an incoming message from upstream
 type Instruction struct {
-	Cmd  string `json:"cmd"`
-	Data uint64 `json:"t_one"`
+	Cmd        string    `json:"cmd"`
+	Data       uint64    `json:"t_one"`
+	Credits    int       `json:"credits"`
+	Stream     string    `json:"stream"`
+	Seq        uint64    `json:"seq"`
+	Level      string    `json:"level"`
+	Subsystem  string    `json:"subsystem"`
+	Bluno      uint8     `json:"bluno"`
+	ReceivedAt time.Time `json:"-"` // t2, recorded as soon as the instruction is read off the socket
 }
 
 // NewUpstreamConnection creates and returns a new wrapper for input and output sockets
-func NewUpstreamConnection() (*IOHandler, error) {
-	os.Remove(constants.OutgoingDataSock)
-	os.Remove(constants.IncomingNotifSock)
+// The given blunos are those announced to the consumer, and whose clocks are reported upon time syncs.
+func NewUpstreamConnection(cfg *config.Config, blunos []*bluno.Bluno) (*IOHandler, error) {
+	os.Remove(cfg.Upstream.DataSock)
+	os.Remove(cfg.Upstream.NotifSock)
 
 	inc := make(chan Instruction)
 
@@ -43,84 +67,132 @@ func NewUpstreamConnection() (*IOHandler, error) {
 		received: 0,
 	}
 
-	outgoingListener, err := net.Listen("unix", constants.OutgoingDataSock)
+	outgoingListener, err := net.Listen("unix", cfg.Upstream.DataSock)
 	if err != nil {
-		log.Fatalf("upstream|establishing_data_sock|err=%s", err)
+		log.Fatal("establishing_data_sock", "err", err)
 		return &IOHandler{}, err
 	}
 
-	incomingListener, err := net.Listen("unix", constants.IncomingNotifSock)
+	incomingListener, err := net.Listen("unix", cfg.Upstream.NotifSock)
 	if err != nil {
-		log.Fatalf("upstream|establishing_notif_sock|err=%s", err)
+		log.Fatal("establishing_notif_sock", "err", err)
 		return &IOHandler{}, err
 	}
 
 	outgoing, err := outgoingListener.Accept()
-	log.Printf("upstream|outgoing_listener_accept")
+	log.Info("outgoing_listener_accept")
 	if err != nil {
-		log.Fatalf("upstream|outgoing_listener_accept|err=%s", err)
+		log.Fatal("outgoing_listener_accept", "err", err)
 		return &IOHandler{}, err
 	}
-	ioh.WriteRoutine = writeRoutine(outgoing)
-	ioh.WriteTimestamp = writeTimestamps(outgoing)
-	ioh.WriteBlunoMapping = writeBlunoMapping(outgoing)
+	if cfg.Upstream.SpoolDir != "" {
+		ioh.spool, err = OpenSpool(&cfg.Upstream)
+		if err != nil {
+			log.Error("open_spool", "err", err)
+			return &IOHandler{}, err
+		}
+	}
+
+	// Consumers that reconnect are sent the bluno mapping again before anything else
+	ioh.streams = CreateStreams(commsintconfig.SessionID, cfg.Upstream.RetentionWindow)
+	mapping := blunoMappingMessage(blunos)
+	w := newWriter(outgoing, &cfg.Upstream, ioh.spool, ioh.streams, mapping)
+	go w.accept(outgoingListener)
+	ioh.WriteRoutine = writeRoutine(w, cfg.Output.LegacyFormat)
+	ioh.WriteTimestamp = writeTimestamps(w, blunos)
+	ioh.WriteTimeSync = writeTimeSync(w, blunos)
+	ioh.WriteBlunoMapping = writeBlunoMapping(w, mapping)
+	ioh.WriteSyncDelay = writeSyncDelay(w)
+	ioh.WriteFatigue = writeFatigue(w)
+	ioh.WriteReload = writeReload(w)
+	ioh.WriteHealth = writeHealth(w)
+	ioh.WriteStatus = writeStatus(w)
+	ioh.WriteStats = writeStats(w)
+	ioh.WindowSlots = w.windowSlots
+	ioh.Unsent = w.Unsent
 
 	incoming, err := incomingListener.Accept()
-	log.Printf("upstream|incoming_listener_accept")
+	log.Info("incoming_listener_accept")
 	if err != nil {
-		log.Printf("upstream|incoming_listener_accept|err=%s", err)
+		log.Error("incoming_listener_accept", "err", err)
 		return &IOHandler{}, err
 	}
 
 	// Start up a read goroutine
-	go readRoutine(incoming, inc)
+	go readRoutine(incoming, inc, cfg.Upstream.NotifBufferSize)
 
 	return ioh, nil
 }
 
+// Ack records that the consumer has received every message on a stream up to and including seq
+// Acks without a stream refer to windows.
+func (ioh *IOHandler) Ack(stream string, seq uint64) {
+	if stream == "" {
+		stream = WindowStream
+	}
+	if stream == WindowStream && ioh.spool != nil {
+		ioh.spool.Ack(seq)
+		return
+	}
+	ioh.streams.Ack(stream, seq)
+}
+
+// Close flushes and closes any resources held for the data socket
+func (ioh *IOHandler) Close() {
+	if ioh.spool != nil {
+		ioh.spool.Close()
+	}
+}
+
 // writeBlunoMapping sends names associated with blunos that are expected to connect
-func writeBlunoMapping(oConn net.Conn) func() {
-	oConn.SetWriteDeadline(time.Time{}) // Set to zero (no timeout)
+func writeBlunoMapping(w *writer, mapping func() []byte) func() {
+	return func() {
+		if msg := mapping(); msg != nil {
+			w.send("", msg) // Resent upon every reconnection, so it is left unnumbered
+		}
+	}
+}
 
+// blunoMappingMessage returns a function creating the message naming the blunos that are expected to connect
+func blunoMappingMessage(blunos []*bluno.Bluno) func() []byte {
 	type blunoMapEntry struct {
 		Num  uint8  `json:"num"`
 		Name string `json:"username"`
 	}
 
 	type blunoMapping struct {
+		Session string          `json:"session"`
 		Mapping []blunoMapEntry `json:"bluno_mapping"`
 	}
 
-	return func() {
-		var bm blunoMapping
+	bm := blunoMapping{Session: commsintconfig.SessionID}
 
-		for _, b := range constants.RetrieveValidBlunos() {
-			bme := blunoMapEntry{Num: b.Num, Name: fmt.Sprintf("%s_%d", b.User, b.Num)}
-			bm.Mapping = append(bm.Mapping, bme)
-		}
+	for _, b := range blunos {
+		bme := blunoMapEntry{Num: b.Num, Name: fmt.Sprintf("%s_%d", b.User, b.Num)}
+		bm.Mapping = append(bm.Mapping, bme)
+	}
 
+	return func() []byte {
 		bmj, err := json.Marshal(bm)
 		if err != nil {
-			log.Printf("upstream|write_bluno_count_marshal|err=%s", err)
-		} else {
-			_, err := oConn.Write(bmj)
-			if err != nil {
-				log.Printf("upstream|write_bluno_count|err=%s", err)
-				return
-			}
+			log.Error("write_bluno_count_marshal", "err", err)
+			return nil
 		}
+		return bmj
 	}
 }
 
 // writeTimestamps sends t2, t3 for each active bluno when a time sync request is received
-func writeTimestamps(oConn net.Conn) func(t_one uint64) {
-	oConn.SetWriteDeadline(time.Time{}) // Set to zero (no timeout)
-
+// t2 and t3 are the local send and receive times of the latest time sync exchange with each bluno,
+// and sensor_time is the bluno's millis() reported within that exchange
+func writeTimestamps(w *writer, blunos []*bluno.Bluno) func(t_one uint64) {
 	type timestamp struct {
-		OriginalTOne uint64 `json:"t_one"`
-		BlunoNum     uint8  `json:"num"`
-		Ttwo         int64  `json:"t_two"`
-		Tthree       int64  `json:"t_three"`
+		OriginalTOne uint64  `json:"t_one"`
+		BlunoNum     uint8   `json:"num"`
+		Ttwo         int64   `json:"t_two"`
+		Tthree       int64   `json:"t_three"`
+		SensorTime   uint32  `json:"sensor_time"`
+		DriftPPM     float64 `json:"drift_ppm"`
 	}
 
 	type blunoTimestamps struct {
@@ -130,85 +202,257 @@ func writeTimestamps(oConn net.Conn) func(t_one uint64) {
 	var bt blunoTimestamps = blunoTimestamps{Timestamps: make([]timestamp, 0)}
 
 	return func(t_one uint64) {
-		bt.Timestamps = nil
-		for _, b := range constants.RetrieveValidBlunos() {
-			if b.Num > 3 { // this is hardcoded to prevent EMG timestamps
-				continue
+		bt.Timestamps = make([]timestamp, 0)
+		for _, b := range blunos {
+			c := b.ClockSnapshot()
+			if c == nil || !c.Ready() {
+				continue // No exchange has been completed with this bluno yet
 			}
 
-			if b.HandshakedAt.IsZero() {
-				bt.Timestamps = append(bt.Timestamps, timestamp{
-					OriginalTOne: t_one,
-					BlunoNum:     b.Num,
-					Ttwo:         b.HandShakeInit.UnixNano() / int64(time.Millisecond),
-					Tthree:       b.HandshakedAt.UnixNano() / int64(time.Millisecond),
-				})
-			} else {
-				displacement := time.Now().Sub(b.HandshakedAt)
-				bt.Timestamps = append(bt.Timestamps, timestamp{
-					OriginalTOne: t_one,
-					BlunoNum:     b.Num,
-					Ttwo:         b.HandShakeInit.UnixNano()/int64(time.Millisecond) + displacement.Milliseconds(),
-					Tthree:       b.HandshakedAt.UnixNano()/int64(time.Millisecond) + displacement.Milliseconds(),
-				})
-			}
+			bt.Timestamps = append(bt.Timestamps, timestamp{
+				OriginalTOne: t_one,
+				BlunoNum:     b.Num,
+				Ttwo:         c.LastSyncSentAt.UnixNano() / int64(time.Millisecond),
+				Tthree:       c.LastSyncReceivedAt.UnixNano() / int64(time.Millisecond),
+				SensorTime:   c.LastSyncSensorTime,
+				DriftPPM:     c.DriftPPM(),
+			})
 		}
 		msg, err := json.Marshal(bt)
 		if err != nil {
-			log.Printf("upstream|write_timestamps_marshal|err=%s", err)
+			log.Error("write_timestamps_marshal", "err", err)
 		} else {
-			_, err := oConn.Write(msg)
+			w.send("", msg) // Unnumbered, so that it is never retransmitted with stale times
+		}
+
+	}
+
+}
+
+// writeTimeSync replies to a timesync instruction with the relay's receive (t2) and transmit (t3) times,
+// and the offset of the relay's clock from each bluno's clock.
+// t3 is derived from t2 using the monotonic clock, so that wall clock adjustments cannot reorder t2 and t3.
+// The evaluation server can compute its offset from the relay as ((t2 - t1) + (t3 - t4)) / 2,
+// and add the relay-to-sensor offset to map a dancer's sensor timestamp onto its own clock.
+func writeTimeSync(w *writer, blunos []*bluno.Bluno) func(Instruction) {
+	type sensorOffset struct {
+		BlunoNum uint8   `json:"num"`
+		OffsetMs float64 `json:"offset_ms"` // unix_ms = sensor_ms + offset_ms
+		DriftPPM float64 `json:"drift_ppm"`
+		RttMs    float64 `json:"rtt_ms"`
+	}
+
+	type timeSync struct {
+		Tone    uint64         `json:"t_one"`
+		Ttwo    float64        `json:"t_two"`
+		Tthree  float64        `json:"t_three"`
+		Offsets []sensorOffset `json:"offsets"`
+	}
+
+	type timeSyncReply struct {
+		TimeSync timeSync `json:"timesync"`
+	}
+
+	toMillis := func(t time.Time) float64 {
+		return float64(t.UnixNano()) / float64(time.Millisecond)
+	}
+
+	return func(i Instruction) {
+		ts := timeSync{Tone: i.Data, Ttwo: toMillis(i.ReceivedAt), Offsets: make([]sensorOffset, 0)}
+
+		for _, b := range blunos {
+			c := b.ClockSnapshot()
+			if c == nil || !c.Ready() {
+				continue // No exchange has been completed with this bluno yet
+			}
+			ts.Offsets = append(ts.Offsets, sensorOffset{
+				BlunoNum: b.Num,
+				OffsetMs: c.Offset(time.Now()),
+				DriftPPM: c.DriftPPM(),
+				RttMs:    float64(c.LastRTT()) / float64(time.Millisecond),
+			})
+		}
+
+		// t3 is taken by the writer goroutine, immediately before the reply is written
+		// It is unnumbered, so that it is never retransmitted with stale times.
+		w.sendLazy("", func() []byte {
+			ts.Tthree = toMillis(i.ReceivedAt.Add(time.Since(i.ReceivedAt)))
+			msg, err := json.Marshal(timeSyncReply{TimeSync: ts})
 			if err != nil {
-				log.Printf("upstream|write_timestamp|err=%s", err)
-				return
+				log.Error("write_timesync_marshal", "err", err)
+				return nil
 			}
+			return msg
+		})
+	}
+}
+
+// writeSyncDelay sends the spread in move onsets between dancers, dropping it rather than stalling the analyzer
+func writeSyncDelay(w *writer) func(analysis.SyncDelay) {
+	type syncDelay struct {
+		SyncDelay analysis.SyncDelay `json:"sync_delay"`
+	}
+
+	return func(sd analysis.SyncDelay) {
+		msg, err := json.Marshal(syncDelay{SyncDelay: sd})
+		if err != nil {
+			log.Error("write_sync_delay_marshal", "err", err)
+			return
+		}
+		w.trySend(SyncDelayStream, msg)
+	}
+}
+
+// writeFatigue sends a dancer's EMG features and fatigue score, dropping them rather than stalling the processor
+func writeFatigue(w *writer) func(emg.Fatigue) {
+	type fatigue struct {
+		Fatigue emg.Fatigue `json:"fatigue"`
+	}
+
+	return func(f emg.Fatigue) {
+		msg, err := json.Marshal(fatigue{Fatigue: f})
+		if err != nil {
+			log.Error("write_fatigue_marshal", "err", err)
+			return
+		}
+		w.trySend(FatigueStream, msg)
+	}
+}
+
+// writeReload sends the outcome of a configuration reload, i.e. the settings that were applied and those that need a restart
+func writeReload(w *writer) func(config.Reloaded, error) {
+	type reload struct {
+		Reload config.Reloaded `json:"reload"`
+		Error  string          `json:"error,omitempty"`
+	}
+
+	return func(r config.Reloaded, err error) {
+		m := reload{Reload: r}
+		if err != nil {
+			m.Error = err.Error()
 		}
+		msg, err := json.Marshal(m)
+		if err != nil {
+			log.Error("write_reload_marshal", "err", err)
+			return
+		}
+		w.send(ReloadStream, msg)
+	}
+}
 
+// writeHealth sends the health of a bluno, which is degraded while the bluno is quarantined
+func writeHealth(w *writer) func(commsintconfig.HealthReport) {
+	type health struct {
+		Health commsintconfig.HealthReport `json:"health"`
 	}
 
+	return func(h commsintconfig.HealthReport) {
+		msg, err := json.Marshal(health{Health: h})
+		if err != nil {
+			log.Error("write_health_marshal", "err", err)
+			return
+		}
+		w.send(HealthStream, msg)
+	}
+}
+
+// writeStatus sends a bluno moving from one status to another, e.g. dropping out while transmitting
+func writeStatus(w *writer) func(commsintconfig.StatusTransition) {
+	type status struct {
+		Transition commsintconfig.StatusTransition `json:"bluno_status"`
+	}
+
+	return func(t commsintconfig.StatusTransition) {
+		msg, err := json.Marshal(status{Transition: t})
+		if err != nil {
+			log.Error("write_status_marshal", "err", err)
+			return
+		}
+		w.send(StatusStream, msg)
+	}
+}
+
+// writeStats sends the statistics of every bluno since the relay started, in reply to the stats instruction
+func writeStats(w *writer) func(commsintconfig.SessionReport) {
+	type stats struct {
+		Stats commsintconfig.SessionReport `json:"stats"`
+	}
+
+	return func(r commsintconfig.SessionReport) {
+		msg, err := json.Marshal(stats{Stats: r})
+		if err != nil {
+			log.Error("write_stats_marshal", "err", err)
+			return
+		}
+		w.send(StatsStream, msg)
+	}
 }
 
 // writeRoutine listens for incoming write requests from the application
-// and writes them out to the unix socket
-func writeRoutine(oConn net.Conn) func(p *[]commsintconfig.Packet) {
-	oConn.SetWriteDeadline(time.Time{}) // Set to zero (no timeout)
+// and queues them to be written out to the unix socket
+// It blocks if the writer is full, so WindowSlots should be checked beforehand.
+func writeRoutine(w *writer, legacy bool) func(p *[]commsintconfig.Packet) {
 	return func(p *[]commsintconfig.Packet) {
+		msg, err := marshalWindow(p, legacy)
+		if err != nil {
+			log.Error("write_routine_marshal", "err", err)
+		} else {
+			w.sendWindow(msg)
+		}
+	}
+}
+
+// marshalWindow converts a window of packets into a message, where IMU samples, EMG samples and
+// gap markers are each given their own schema, unless the legacy output format is selected
+func marshalWindow(p *[]commsintconfig.Packet, legacy bool) ([]byte, error) {
+	if legacy {
 		type packets struct {
 			Packets *[]commsintconfig.Packet `json:"packets"`
 		}
+		return json.Marshal(packets{Packets: p})
+	}
 
-		msg, err := json.Marshal(packets{Packets: p})
-		if err != nil {
-			log.Printf("upstream|write_routine_marshal|err=%s", err)
-		} else {
-			_, err := oConn.Write(msg)
-			if err != nil {
-				log.Printf("upstream|write_routine|err=%s", err)
-				return
-			}
+	type samples struct {
+		IMU  []commsintconfig.IMUSample `json:"imu,omitempty"`
+		EMG  []commsintconfig.EMGSample `json:"emg,omitempty"`
+		Gaps []commsintconfig.GapMarker `json:"gaps,omitempty"`
+	}
+
+	var s samples
+	for _, pkt := range *p {
+		switch pkt.Type {
+		case commsintconfig.Data:
+			s.IMU = append(s.IMU, pkt.IMUSample())
+		case commsintconfig.DataEMG:
+			s.EMG = append(s.EMG, pkt.EMGSample())
+		case commsintconfig.Gap:
+			s.Gaps = append(s.Gaps, pkt.GapMarker())
 		}
 	}
+	return json.Marshal(s)
 }
 
 // readRoutine listens to the incoming notifications and sends them
 // out to the main application via the provided channel
-func readRoutine(iConn net.Conn, comm chan Instruction) {
+func readRoutine(iConn net.Conn, comm chan Instruction, bufferSize int) {
 	iConn.SetReadDeadline(time.Time{}) // Set to zero (no timeout)
-	var i Instruction
-	b := make([]byte, constants.UpstreamNotifBufferSize)
+	b := make([]byte, bufferSize)
 
 	for {
 		num, err := iConn.Read(b)
-		log.Printf("upstream|read_routine|string=%s", string(b))
+		receivedAt := time.Now()
 		if err != nil {
-			log.Printf("upstream|read_routine|err=%s", err)
+			log.Error("read_routine", "err", err)
 			return
 		}
 
+		var i Instruction
 		err = json.Unmarshal(b[:num], &i)
+		i.ReceivedAt = receivedAt
 		if err != nil {
-			log.Printf("upstream|read_routine_unmarshal|err=%s|data=%s", err, string(b))
+			log.Warn("read_routine_unmarshal", "err", err, "data", string(b[:num]))
 		} else {
+			log.Debug("read_routine", "data", string(b[:num]))
 			comm <- i
 		}
 	}
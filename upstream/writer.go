@@ -0,0 +1,265 @@
+package upstream
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/CG4002-AY2021S2-B16/comms-int/config"
+)
+
+// writer serializes every write to the data socket through a single goroutine,
+// so that each message is written with its own deadline and messages are never interleaved or reordered
+// When the consumer disconnects, the writer waits for it to reconnect, and retransmits every unacknowledged
+// message. If a spool is provided, windows are delivered from the spool instead of being retained in memory.
+type writer struct {
+	conn      net.Conn
+	cfg       *config.Upstream
+	conns     chan net.Conn
+	control   chan controlMessage // Timestamps, mappings and events, which take priority over windows
+	windows   chan []byte         // Only used without a spool
+	spool     *Spool
+	streams   *Streams
+	onConnect func() []byte
+
+	pending         []byte // Message to be written again, after a write timed out before writing any of it
+	pendingRetained bool   // Whether the pending message is retained for retransmission, or lost with the consumer
+	unsent          uint64 // Messages that were neither written nor retained for retransmission, accessed atomically
+}
+
+// controlMessage is built by the writer goroutine immediately before it is written,
+// and numbered on its stream unless the stream is empty
+type controlMessage struct {
+	stream string
+	build  func() []byte
+}
+
+// newWriter creates a writer for the given connection and starts its goroutine
+// onConnect builds a message that is written first to every consumer that reconnects.
+func newWriter(conn net.Conn, cfg *config.Upstream, spool *Spool, streams *Streams, onConnect func() []byte) *writer {
+	w := &writer{
+		conn:      conn,
+		cfg:       cfg,
+		conns:     make(chan net.Conn),
+		control:   make(chan controlMessage, cfg.WriterControlQueueSize),
+		windows:   make(chan []byte, cfg.WriterWindowQueueSize),
+		spool:     spool,
+		streams:   streams,
+		onConnect: onConnect,
+	}
+	go w.run()
+	return w
+}
+
+// run writes out queued messages, preferring control messages over windows
+// A message whose write timed out is written again before anything else, so that a slow consumer loses nothing.
+func (w *writer) run() {
+	var spoolNotify <-chan struct{}
+	if w.spool != nil {
+		spoolNotify = w.spool.Notify()
+	}
+
+	for {
+		if w.conn == nil {
+			w.awaitConnection()
+			continue
+		}
+
+		if w.pending != nil {
+			select {
+			case c := <-w.conns:
+				w.replace(c)
+			default:
+				w.write(w.pending, w.pendingRetained)
+			}
+			continue
+		}
+
+		select {
+		case cm := <-w.control:
+			w.write(w.build(cm), cm.stream != "")
+			continue
+		default:
+		}
+
+		if w.spool != nil {
+			if msg, ok := w.spool.Next(); ok {
+				w.write(msg, true)
+				continue
+			}
+		}
+
+		select {
+		case cm := <-w.control:
+			w.write(w.build(cm), cm.stream != "")
+		case msg := <-w.windows:
+			w.write(msg, true)
+		case <-spoolNotify:
+		case c := <-w.conns:
+			w.replace(c)
+		}
+	}
+}
+
+// build creates a control message, numbering it on its stream
+func (w *writer) build(cm controlMessage) []byte {
+	msg := cm.build()
+	if msg == nil || cm.stream == "" {
+		return msg
+	}
+	return w.streams.Stamp(cm.stream, msg)
+}
+
+// awaitConnection blocks until a consumer connects, so that producers are never blocked by a missing consumer
+// control messages are still built in the meantime, to be retransmitted upon reconnection if they are sequenced
+func (w *writer) awaitConnection() {
+	select {
+	case c := <-w.conns:
+		w.attach(c)
+	case cm := <-w.control:
+		if w.build(cm) != nil && cm.stream == "" {
+			atomic.AddUint64(&w.unsent, 1)
+			log.Debug("write_discarded", "reason", "no_consumer")
+		}
+	}
+}
+
+// replace drops the current consumer in favour of a newly connected one
+func (w *writer) replace(c net.Conn) {
+	w.conn.Close()
+	w.conn = nil
+	w.dropPending()
+	w.attach(c)
+}
+
+// dropPending forgets the message waiting to be written again, counting it as unsent unless it is retained
+// for retransmission (or in the spool), in which case the next consumer receives it
+func (w *writer) dropPending() {
+	if w.pending != nil && !w.pendingRetained {
+		atomic.AddUint64(&w.unsent, 1)
+	}
+	w.pending = nil
+}
+
+// Unsent returns the number of messages that were neither written nor retained for retransmission
+func (w *writer) Unsent() uint64 {
+	return atomic.LoadUint64(&w.unsent)
+}
+
+// attach switches over to a newly connected consumer
+func (w *writer) attach(c net.Conn) {
+	w.conn = c
+	log.Info("consumer_connected", "addr", c.RemoteAddr())
+
+	// Windows queued for the previous consumer are stale, the spool holds them if they are to be replayed
+	for len(w.windows) > 0 {
+		<-w.windows
+	}
+	if w.spool != nil {
+		w.spool.Rewind()
+	}
+	if w.onConnect != nil {
+		w.write(w.onConnect(), true) // Written again upon every connection
+	}
+
+	retransmit := w.streams.Unacknowledged()
+	if len(retransmit) > 0 {
+		log.Info("retransmit", "messages", len(retransmit))
+	}
+	for _, msg := range retransmit {
+		if w.conn == nil || w.pending != nil {
+			return // The rest are retransmitted upon the next connection, or left to the run loop
+		}
+		w.write(msg, true)
+	}
+}
+
+// write performs a single write bounded by the upstream write timeout, where retained tells whether the message
+// is kept for retransmission to the next consumer (or in the spool)
+// A write that timed out before writing anything leaves the consumer connected, and the message is written again.
+// Any other error, including a timeout partway through a message, is treated as a disconnection, since the stream
+// can no longer be framed.
+func (w *writer) write(msg []byte, retained bool) {
+	w.pending = nil
+	if msg == nil {
+		return
+	}
+
+	w.conn.SetWriteDeadline(time.Now().Add(w.cfg.WriteTimeout))
+	n, err := w.conn.Write(msg)
+	if err == nil {
+		return
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && n == 0 {
+		log.Warn("write_timeout", "bytes", len(msg), "err", err)
+		w.pending, w.pendingRetained = msg, retained
+		return
+	}
+	if n > 0 {
+		log.Warn("write_partial", "written", n, "bytes", len(msg), "err", err)
+	}
+	log.Warn("consumer_disconnected", "err", err)
+	w.conn.Close()
+	w.conn = nil
+	if !retained {
+		atomic.AddUint64(&w.unsent, 1)
+	}
+}
+
+// accept hands every subsequent connection on the listener over to the writer
+// This should be run within a permanent goroutine
+func (w *writer) accept(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Error("outgoing_listener_accept", "err", err)
+			return
+		}
+		w.conns <- c
+	}
+}
+
+// send queues a control message on the given stream, which is left unnumbered if empty
+func (w *writer) send(stream string, msg []byte) {
+	w.control <- controlMessage{stream: stream, build: func() []byte { return msg }}
+}
+
+// sendLazy queues a control message that is only built immediately before it is written, e.g. to timestamp it
+func (w *writer) sendLazy(stream string, build func() []byte) {
+	w.control <- controlMessage{stream: stream, build: build}
+}
+
+// trySend queues a control message on the given stream without blocking, for producers that must not stall
+// on a slow consumer. The message is dropped if the control queue is full.
+func (w *writer) trySend(stream string, msg []byte) bool {
+	select {
+	case w.control <- controlMessage{stream: stream, build: func() []byte { return msg }}:
+		return true
+	default:
+		log.Warn("control_dropped", "stream", stream, "reason", "queue_full")
+		return false
+	}
+}
+
+// sendWindow numbers and queues a window of packets
+// With a spool, windows are numbered by and appended to the spool, otherwise they are retained in memory.
+func (w *writer) sendWindow(msg []byte) {
+	if w.spool != nil {
+		seq := w.spool.NextSeq() // Only the dequeue goroutine appends windows, so seq cannot be taken in between
+		msg = withEnvelope(msg, envelope{Stream: WindowStream, Seq: seq, ID: w.streams.ID(WindowStream, seq)})
+		if _, err := w.spool.Append(msg); err != nil {
+			log.Error("spool_append", "err", err)
+		}
+		return
+	}
+	w.windows <- w.streams.Stamp(WindowStream, msg)
+}
+
+// windowSlots returns the number of windows that can be queued without blocking
+func (w *writer) windowSlots() int {
+	if w.spool != nil {
+		return 1 // The spool enforces its own size cap
+	}
+	return cap(w.windows) - len(w.windows)
+}